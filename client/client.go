@@ -0,0 +1,317 @@
+// Package client implements Go client of the assets HTTP API,
+// its methods mirror service.Assets ones.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bbars/assets/service/types"
+	"github.com/bbars/assets/utils"
+	"github.com/pkg/errors"
+)
+
+type Client struct {
+	// BaseUrl - URL of the HTTP server, e.g. http://localhost:8080
+	BaseUrl string
+
+	// HttpClient - client to send requests with (http.DefaultClient if nil)
+	HttpClient *http.Client
+}
+
+func New(baseUrl string) *Client {
+	return &Client{
+		BaseUrl: strings.TrimRight(baseUrl, "/"),
+	}
+}
+
+// Error is returned when the server responds with an error.
+type Error struct {
+	// StatusCode - HTTP status of the response
+	StatusCode int
+
+	// Code - stable error class (invalid, forbidden, not_found, conflict, too_large, internal, unavailable)
+	Code string
+
+	// Message - error message
+	Message string
+}
+
+var _ error = &Error{}
+
+func (err *Error) Error() string {
+	if err.Message == "" {
+		return http.StatusText(err.StatusCode)
+	}
+	return err.Message
+}
+
+type envelope struct {
+	Res  json.RawMessage `json:"res"`
+	Err  string          `json:"err"`
+	Code string          `json:"code"`
+}
+
+func (c *Client) DescribeByKey(ctx context.Context, assetKey string) (asset *types.Asset, err error) {
+	asset = &types.Asset{}
+	err = c.doJson(ctx, http.MethodGet, "/assets/"+url.PathEscape(assetKey)+"/meta", nil, nil, asset)
+	if err != nil {
+		asset = nil
+		err = errors.Wrapf(err, "describe asset_key=%+q", assetKey)
+		return
+	}
+	return
+}
+
+// GetByKey opens the asset contents (or its range if rng is not nil).
+// The asset is described by response headers, so only its public fields are set.
+func (c *Client) GetByKey(ctx context.Context, assetKey string, rng *utils.Range) (asset *types.Asset, rc io.ReadCloser, err error) {
+	asset, rc, err = c.getContent(ctx, http.MethodGet, "/assets/"+url.PathEscape(assetKey), nil, rng)
+	if err != nil {
+		err = errors.Wrapf(err, "get asset_key=%+q", assetKey)
+		return
+	}
+	asset.AssetKey = assetKey
+	return
+}
+
+// HeadByKey checks the asset is readable without reading its contents.
+func (c *Client) HeadByKey(ctx context.Context, assetKey string) (asset *types.Asset, err error) {
+	asset, _, err = c.getContent(ctx, http.MethodHead, "/assets/"+url.PathEscape(assetKey), nil, nil)
+	if err != nil {
+		err = errors.Wrapf(err, "head asset_key=%+q", assetKey)
+		return
+	}
+	asset.AssetKey = assetKey
+	return
+}
+
+// GetByOriginalUrl opens the asset contents by original URL, the server fetches unknown URLs.
+// The asset is described by response headers, so only its public fields are set.
+func (c *Client) GetByOriginalUrl(ctx context.Context, originalUrl string, rng *utils.Range) (asset *types.Asset, rc io.ReadCloser, err error) {
+	q := url.Values{}
+	q.Set("originalUrl", originalUrl)
+	asset, rc, err = c.getContent(ctx, http.MethodGet, "/getByOriginalUrl", q, rng)
+	if err != nil {
+		err = errors.Wrapf(err, "get original_url=%+q", originalUrl)
+		return
+	}
+	return
+}
+
+// Store uploads data as a new asset, extra provides its metadata.
+func (c *Client) Store(ctx context.Context, extra *types.Asset, data io.Reader) (asset *types.Asset, err error) {
+	q := url.Values{}
+	setNotEmpty(q, "contentType", extra.ContentType)
+	setNotEmpty(q, "originalName", extra.OriginalName)
+	setNotEmpty(q, "userId", extra.UserId)
+	setNotEmpty(q, "originalUrl", extra.OriginalUrl)
+	setNotEmpty(q, "info", extra.Info)
+	asset = &types.Asset{}
+	err = c.doJson(ctx, http.MethodPost, "/assets?"+q.Encode(), data, nil, asset)
+	if err != nil {
+		asset = nil
+		err = errors.Wrap(err, "store asset")
+		return
+	}
+	return
+}
+
+// StoreByOriginalUrl starts fetching of the original URL.
+// With wait the asset may still be processing if the remote object is too large to wait for.
+func (c *Client) StoreByOriginalUrl(ctx context.Context, originalUrl string, userId string, wait bool) (asset *types.Asset, err error) {
+	q := url.Values{}
+	q.Set("originalUrl", originalUrl)
+	setNotEmpty(q, "userId", userId)
+	if wait {
+		q.Set("wait", "1")
+	}
+	asset = &types.Asset{}
+	err = c.doJson(ctx, http.MethodGet, "/storeByOriginalUrl?"+q.Encode(), nil, nil, asset)
+	if err != nil {
+		asset = nil
+		err = errors.Wrapf(err, "store original_url=%+q", originalUrl)
+		return
+	}
+	return
+}
+
+func (c *Client) UpdateMetaByKey(ctx context.Context, assetKey string, meta *types.AssetMeta) (asset *types.Asset, err error) {
+	body, err := json.Marshal(meta)
+	if err != nil {
+		err = errors.Wrap(err, "encode asset meta")
+		return
+	}
+	header := http.Header{}
+	header.Set("content-type", "application/json")
+	asset = &types.Asset{}
+	err = c.doJson(ctx, http.MethodPut, "/assets/"+url.PathEscape(assetKey)+"/meta", bytes.NewReader(body), header, asset)
+	if err != nil {
+		asset = nil
+		err = errors.Wrapf(err, "update meta of asset_key=%+q", assetKey)
+		return
+	}
+	return
+}
+
+func (c *Client) DeleteByKey(ctx context.Context, assetKey string) (asset *types.Asset, err error) {
+	asset = &types.Asset{}
+	err = c.doJson(ctx, http.MethodDelete, "/assets/"+url.PathEscape(assetKey), nil, nil, asset)
+	if err != nil {
+		asset = nil
+		err = errors.Wrapf(err, "delete asset_key=%+q", assetKey)
+		return
+	}
+	return
+}
+
+func (c *Client) Usage(ctx context.Context, userId string) (usage *types.Usage, err error) {
+	q := url.Values{}
+	q.Set("userId", userId)
+	usage = &types.Usage{}
+	err = c.doJson(ctx, http.MethodGet, "/usage?"+q.Encode(), nil, nil, usage)
+	if err != nil {
+		usage = nil
+		err = errors.Wrapf(err, "usage of user_id=%+q", userId)
+		return
+	}
+	return
+}
+
+func (c *Client) doJson(ctx context.Context, method string, path string, body io.Reader, header http.Header, res any) (err error) {
+	response, err := c.do(ctx, method, path, body, header)
+	if err != nil {
+		return
+	}
+	defer response.Body.Close()
+
+	data := envelope{}
+	err = json.NewDecoder(response.Body).Decode(&data)
+	if err != nil {
+		err = errors.Wrapf(err, "decode response with status %s", response.Status)
+		return
+	}
+	if data.Err != "" || response.StatusCode < 200 || response.StatusCode >= 300 {
+		err = &Error{
+			StatusCode: response.StatusCode,
+			Code:       data.Code,
+			Message:    data.Err,
+		}
+		return
+	}
+	err = json.Unmarshal(data.Res, res)
+	if err != nil {
+		err = errors.Wrap(err, "decode response result")
+		return
+	}
+	return
+}
+
+func (c *Client) getContent(ctx context.Context, method string, path string, q url.Values, rng *utils.Range) (asset *types.Asset, rc io.ReadCloser, err error) {
+	if len(q) > 0 {
+		path += "?" + q.Encode()
+	}
+	header := http.Header{}
+	if rng != nil {
+		header.Set("range", rng.HttpRangeHeader())
+	}
+	response, err := c.do(ctx, method, path, nil, header)
+	if err != nil {
+		return
+	}
+	if response.StatusCode != http.StatusOK && response.StatusCode != http.StatusPartialContent {
+		defer response.Body.Close()
+		err = responseError(response)
+		return
+	}
+
+	asset, err = assetFromHeader(response.Header, response.ContentLength)
+	if err != nil {
+		response.Body.Close()
+		return
+	}
+	rc = response.Body
+	return
+}
+
+func (c *Client) do(ctx context.Context, method string, path string, body io.Reader, header http.Header) (response *http.Response, err error) {
+	request, err := http.NewRequestWithContext(ctx, method, c.BaseUrl+path, body)
+	if err != nil {
+		err = errors.Wrap(err, "create request")
+		return
+	}
+	for name, values := range header {
+		request.Header[name] = values
+	}
+	httpClient := c.HttpClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	response, err = httpClient.Do(request)
+	if err != nil {
+		err = errors.Wrap(err, "send request")
+		return
+	}
+	return
+}
+
+// responseError extracts the error from JSON envelope if any (HEAD responses have no body).
+func responseError(response *http.Response) error {
+	data := envelope{}
+	_ = json.NewDecoder(response.Body).Decode(&data)
+	return &Error{
+		StatusCode: response.StatusCode,
+		Code:       data.Code,
+		Message:    data.Err,
+	}
+}
+
+func assetFromHeader(header http.Header, contentLength int64) (asset *types.Asset, err error) {
+	asset = &types.Asset{
+		Size:         contentLength,
+		ContentHash:  header.Get("etag"),
+		ContentType:  header.Get("content-type"),
+		OriginalName: header.Get("x-asset-original-name"),
+		OriginalUrl:  header.Get("x-asset-original-url"),
+		Status:       types.AssetStatus_done,
+	}
+	if contentRange := header.Get("content-range"); contentRange != "" {
+		// bytes 0-9/10
+		slash := strings.LastIndexByte(contentRange, '/')
+		asset.Size, err = strconv.ParseInt(contentRange[slash+1:], 10, 64)
+		if err != nil {
+			err = errors.Wrapf(err, "parse content-range %+q", contentRange)
+			return
+		}
+	}
+	if btime := header.Get("x-asset-btime"); btime != "" {
+		asset.Btime, err = time.Parse(time.RFC3339Nano, btime)
+		if err != nil {
+			err = errors.Wrapf(err, "parse x-asset-btime %+q", btime)
+			return
+		}
+	}
+	if mtime := header.Get("x-asset-mtime"); mtime != "" {
+		var t time.Time
+		t, err = time.Parse(time.RFC3339Nano, mtime)
+		if err != nil {
+			err = errors.Wrapf(err, "parse x-asset-mtime %+q", mtime)
+			return
+		}
+		asset.Mtime = &t
+	}
+	return
+}
+
+func setNotEmpty(q url.Values, key string, value string) {
+	if value != "" {
+		q.Set(key, value)
+	}
+}
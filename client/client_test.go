@@ -0,0 +1,178 @@
+package client
+
+import (
+	"context"
+	"database/sql"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	"github.com/bbars/assets/commands"
+	"github.com/bbars/assets/service"
+	"github.com/bbars/assets/service/repository"
+	"github.com/bbars/assets/service/storage"
+	"github.com/bbars/assets/service/types"
+	"github.com/bbars/assets/utils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestServer(t *testing.T, config service.AssetsConfig) *httptest.Server {
+	migrations := fstest.MapFS{}
+	names, err := filepath.Glob(filepath.Join("..", repository.SqliteMigrationsDir, "*.sql"))
+	require.NoError(t, err)
+	for _, name := range names {
+		data, err := os.ReadFile(name)
+		require.NoError(t, err)
+		migrations[repository.SqliteMigrationsDir+"/"+filepath.Base(name)] = &fstest.MapFile{Data: data}
+	}
+
+	dir := t.TempDir()
+	db, err := sql.Open("sqlite3", filepath.Join(dir, "assets.db"))
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = db.Close() })
+	repo := repository.NewSqlite(db, migrations)
+	require.NoError(t, repo.Migrate(context.Background()))
+
+	assets := &service.Assets{
+		Storage: &storage.DirStorage{
+			Dir:       dir,
+			PathDepth: 2,
+			DirPerm:   0755,
+			FilePerm:  0644,
+		},
+		Repo:   repo,
+		Config: config,
+	}
+	if assets.Config.OriginalUrlPattern == nil {
+		assets.Config.OriginalUrlPattern = regexp.MustCompile(`^http://127\.0\.0\.1`)
+	}
+	server := httptest.NewServer(commands.NewHttpHandler(assets, commands.HttpOptions{
+		FallbackMimetype: "application/octet-stream",
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestClient(t *testing.T) {
+	ctx := context.Background()
+	c := New(newTestServer(t, service.AssetsConfig{}).URL)
+
+	stored, err := c.Store(ctx, &types.Asset{
+		ContentType:  "text/plain",
+		OriginalName: "hello.txt",
+		UserId:       "u1",
+	}, strings.NewReader("hello world"))
+	require.NoError(t, err)
+	assert.Len(t, stored.AssetKey, types.AssetKeyLen)
+	assert.Equal(t, int64(11), stored.Size)
+
+	described, err := c.DescribeByKey(ctx, stored.AssetKey)
+	require.NoError(t, err)
+	assert.Equal(t, stored.ContentHash, described.ContentHash)
+
+	asset, rc, err := c.GetByKey(ctx, stored.AssetKey, nil)
+	require.NoError(t, err)
+	data, err := io.ReadAll(rc)
+	require.NoError(t, rc.Close())
+	assert.Equal(t, "hello world", string(data))
+	assert.Equal(t, stored.ContentHash, asset.ContentHash)
+	assert.Equal(t, "text/plain", asset.ContentType)
+	assert.Equal(t, "hello.txt", asset.OriginalName)
+
+	asset, rc, err = c.GetByKey(ctx, stored.AssetKey, &utils.Range{From: 6, To: 0})
+	require.NoError(t, err)
+	data, err = io.ReadAll(rc)
+	require.NoError(t, rc.Close())
+	assert.Equal(t, "world", string(data))
+	assert.Equal(t, int64(11), asset.Size)
+
+	asset, err = c.HeadByKey(ctx, stored.AssetKey)
+	require.NoError(t, err)
+	assert.Equal(t, int64(11), asset.Size)
+
+	name := "renamed.txt"
+	updated, err := c.UpdateMetaByKey(ctx, stored.AssetKey, &types.AssetMeta{OriginalName: &name})
+	require.NoError(t, err)
+	assert.Equal(t, name, updated.OriginalName)
+	assert.Equal(t, "text/plain", updated.ContentType)
+
+	usage, err := c.Usage(ctx, "u1")
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), usage.Count)
+
+	deleted, err := c.DeleteByKey(ctx, stored.AssetKey)
+	require.NoError(t, err)
+	assert.True(t, deleted.Deleted)
+
+	_, _, err = c.GetByKey(ctx, stored.AssetKey, nil)
+	clientErr := &Error{}
+	require.ErrorAs(t, err, &clientErr)
+	assert.Equal(t, http.StatusNotFound, clientErr.StatusCode)
+	assert.Equal(t, "not_found", clientErr.Code)
+
+	_, err = c.DescribeByKey(ctx, "unknown")
+	require.ErrorAs(t, err, &clientErr)
+	assert.Equal(t, http.StatusNotFound, clientErr.StatusCode)
+}
+
+func TestClientOriginalUrl(t *testing.T) {
+	ctx := context.Background()
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("content-type", "image/png")
+		_, _ = w.Write([]byte("not really a png"))
+	}))
+	t.Cleanup(origin.Close)
+	c := New(newTestServer(t, service.AssetsConfig{}).URL)
+
+	fetched, err := c.StoreByOriginalUrl(ctx, origin.URL+"/1.png", "u1", true)
+	require.NoError(t, err)
+	assert.Equal(t, types.AssetStatus_done, fetched.Status)
+	assert.Equal(t, int64(16), fetched.Size)
+	assert.Equal(t, "1.png", fetched.OriginalName)
+
+	asset, rc, err := c.GetByOriginalUrl(ctx, origin.URL+"/1.png", &utils.Range{From: 0, To: 3})
+	require.NoError(t, err)
+	data, err := io.ReadAll(rc)
+	require.NoError(t, rc.Close())
+	assert.Equal(t, "not", string(data))
+	assert.Equal(t, fetched.ContentHash, asset.ContentHash)
+
+	_, err = c.StoreByOriginalUrl(ctx, "https://example.com/1.png", "", true)
+	clientErr := &Error{}
+	require.ErrorAs(t, err, &clientErr)
+	assert.Equal(t, http.StatusForbidden, clientErr.StatusCode)
+	assert.Equal(t, "forbidden", clientErr.Code)
+}
+
+func TestClientOriginalUrlUnknownSize(t *testing.T) {
+	ctx := context.Background()
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// flushing makes the response chunked, so its size is unknown
+		for i := 0; i < len(r.URL.Path); i++ {
+			_, _ = w.Write([]byte("0123456789"))
+			w.(http.Flusher).Flush()
+		}
+	}))
+	t.Cleanup(origin.Close)
+	c := New(newTestServer(t, service.AssetsConfig{
+		MaxRemoteSize: 50,
+	}).URL)
+
+	fetched, err := c.StoreByOriginalUrl(ctx, origin.URL+"/abc", "", true)
+	require.NoError(t, err)
+	assert.Equal(t, types.AssetStatus_done, fetched.Status)
+	assert.Equal(t, int64(40), fetched.Size)
+
+	_, err = c.StoreByOriginalUrl(ctx, origin.URL+"/abcdef", "", true)
+	clientErr := &Error{}
+	require.ErrorAs(t, err, &clientErr)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, clientErr.StatusCode)
+	assert.Equal(t, "too_large", clientErr.Code)
+}
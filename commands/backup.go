@@ -0,0 +1,52 @@
+package commands
+
+import (
+	"github.com/bbars/assets/service"
+	"github.com/bbars/assets/utils"
+	"github.com/urfave/cli/v2"
+)
+
+func NewBackupCommand(initAssets InitAssets) *cli.Command {
+	b := backup{
+		assets: nil,
+	}
+	return &cli.Command{
+		Name:   "backup",
+		Usage:  "Write snapshot of metadata and blobs to a directory",
+		Action: b.Action,
+		Before: func(ctx *cli.Context) (err error) {
+			b.assets, err = initAssets(ctx)
+			return
+		},
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:     "target-dir",
+				Aliases:  []string{"t"},
+				Usage:    "Directory to write the backup to (must be empty or not exist).",
+				Required: true,
+			},
+			&cli.StringFlag{
+				Name:  "base",
+				Usage: "Directory of previous backup, blobs archived there are not archived again.",
+			},
+		},
+	}
+}
+
+type backup struct {
+	assets *service.Assets
+}
+
+func (b *backup) Action(ctx *cli.Context) (err error) {
+	manifest, err := b.assets.Backup(ctx.Context, ctx.String("target-dir"), ctx.String("base"))
+	if err != nil {
+		return
+	}
+	utils.ContextLogger(ctx.Context).Info(
+		"backup done",
+		"blobs", len(manifest.Blobs),
+		"archived", manifest.Archived,
+		"archivedSize", manifest.ArchivedSize,
+	)
+	return
+}
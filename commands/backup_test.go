@@ -0,0 +1,79 @@
+package commands
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/bbars/assets/service"
+	"github.com/bbars/assets/service/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/urfave/cli/v2"
+)
+
+func TestBackupRestore(t *testing.T) {
+	ctx := context.Background()
+	assets := newTestAssets(t)
+	run := func(assets *service.Assets, args ...string) error {
+		app := &cli.App{
+			Commands: []*cli.Command{
+				NewBackupCommand(func(ctx *cli.Context) (*service.Assets, error) { return assets, nil }),
+				NewRestoreCommand(func(ctx *cli.Context) (*service.Assets, error) { return assets, nil }),
+			},
+		}
+		return app.Run(append([]string{"assets"}, args...))
+	}
+	store := func(data string) string {
+		asset, err := assets.Store(ctx, &types.Asset{UserId: "u1"}, bytes.NewReader([]byte(data)))
+		require.NoError(t, err)
+		return asset.AssetKey
+	}
+
+	keys := []string{store("first"), store("second"), store("second")}
+	fullDir := filepath.Join(t.TempDir(), "full")
+	require.NoError(t, run(assets, "backup", "-t", fullDir))
+	full, err := service.ReadBackupManifest(fullDir)
+	require.NoError(t, err)
+	assert.Len(t, full.Blobs, 2)
+	assert.Equal(t, 2, full.Archived)
+	assert.Equal(t, int64(len("first")+len("second")), full.ArchivedSize)
+
+	// the backup directory must be empty
+	assert.Error(t, run(assets, "backup", "-t", fullDir))
+
+	keys = append(keys, store("third"))
+	incDir := filepath.Join(t.TempDir(), "inc")
+	require.NoError(t, run(assets, "backup", "-t", incDir, "--base", fullDir))
+	inc, err := service.ReadBackupManifest(incDir)
+	require.NoError(t, err)
+	assert.Len(t, inc.Blobs, 3)
+	assert.Equal(t, 1, inc.Archived)
+	assert.Equal(t, int64(len("third")), inc.ArchivedSize)
+
+	t.Run("restore incremental", func(t *testing.T) {
+		restored := newTestAssets(t)
+		require.NoError(t, run(restored, "restore", incDir))
+		for i, want := range []string{"first", "second", "second", "third"} {
+			_, rc, err := restored.GetByKey(ctx, keys[i], nil)
+			require.NoError(t, err)
+			data, err := io.ReadAll(rc)
+			require.NoError(t, rc.Close())
+			require.NoError(t, err)
+			assert.Equal(t, want, string(data))
+		}
+	})
+
+	t.Run("missing base", func(t *testing.T) {
+		require.NoError(t, os.Rename(fullDir, fullDir+".moved"))
+		t.Cleanup(func() { _ = os.Rename(fullDir+".moved", fullDir) })
+		restored := newTestAssets(t)
+		assert.Error(t, run(restored, "restore", incDir))
+		// metadata is not replaced if blobs are not restored
+		_, err := restored.DescribeByKey(ctx, keys[0])
+		assert.Error(t, err)
+	})
+}
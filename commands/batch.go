@@ -0,0 +1,201 @@
+package commands
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"sync"
+
+	"github.com/bbars/assets/service/types"
+	"github.com/bbars/assets/utils"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli/v2"
+)
+
+// batchFlags configure batch commands processing a list of items (storeurls, storefiles, storedir).
+var batchFlags = []cli.Flag{
+	&cli.IntFlag{
+		Name:    "concurrency",
+		Aliases: []string{"j"},
+		Usage:   "Number of items processed in parallel.",
+		Value:   1,
+	},
+	&cli.BoolFlag{
+		Name:  "ordered",
+		Usage: "Write results in the order of input items (otherwise as soon as they are ready).",
+		Value: true,
+	},
+}
+
+// batchFeed sends items to process until send returns false (the batch is interrupted).
+type batchFeed[T any] func(send func(item T) bool) error
+
+// batchProcess stores an item, the error is logged by it.
+type batchProcess[T any] func(ctx context.Context, item T) (asset *types.Asset, err error)
+
+// batchSummary counts results of a batch.
+type batchSummary struct {
+	Stored       int
+	Deduplicated int
+	Failed       int
+	Bytes        int64
+}
+
+type batchItem[T any] struct {
+	index int
+	item  T
+}
+
+type batchResult struct {
+	index int
+	asset *types.Asset
+	err   error
+}
+
+// runBatch processes items sent by feed with a pool of workers,
+// writes resulting assets as JSON lines and logs the summary.
+// Not started items are skipped when ctx is done.
+func runBatch[T any](ctx *cli.Context, jsonOut *json.Encoder, feed batchFeed[T], process batchProcess[T]) (err error) {
+	concurrency := ctx.Int("concurrency")
+	if concurrency < 1 {
+		err = errors.Errorf("invalid value for concurrency flag: %d", concurrency)
+		return
+	}
+	ordered := ctx.Bool("ordered")
+	logger := utils.ContextLogger(ctx.Context)
+
+	items := make(chan batchItem[T])
+	feedErrCh := make(chan error, 1)
+	go func() {
+		index := 0
+		feedErrCh <- feed(func(item T) bool {
+			select {
+			case items <- batchItem[T]{index: index, item: item}:
+				index++
+				return true
+			case <-ctx.Context.Done():
+				return false
+			}
+		})
+		close(items)
+	}()
+
+	results := make(chan batchResult)
+	wg := sync.WaitGroup{}
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				// the feed may be blocked reading stdin, so don't wait for it when interrupted
+				select {
+				case item, ok := <-items:
+					if !ok {
+						return
+					}
+					asset, err := process(ctx.Context, item.item)
+					results <- batchResult{index: item.index, asset: asset, err: err}
+				case <-ctx.Context.Done():
+					return
+				}
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	summary := batchSummary{}
+	pending := make(map[int]batchResult)
+	next := 0
+	for result := range results {
+		if !ordered {
+			writeBatchResult(logger, jsonOut, &summary, result)
+			continue
+		}
+		pending[result.index] = result
+		for {
+			result, ok := pending[next]
+			if !ok {
+				break
+			}
+			delete(pending, next)
+			next++
+			writeBatchResult(logger, jsonOut, &summary, result)
+		}
+	}
+
+	logger.Info(
+		"summary",
+		"stored", summary.Stored,
+		"deduplicated", summary.Deduplicated,
+		"failed", summary.Failed,
+		"bytes", summary.Bytes,
+	)
+
+	if ctx.Context.Err() != nil {
+		err = errors.Wrap(ctx.Context.Err(), "interrupted")
+		return
+	}
+	// not interrupted, so the feed is done
+	err = <-feedErrCh
+	if err != nil {
+		return
+	}
+	if summary.Failed > 0 {
+		err = errors.Errorf("%d of %d items failed", summary.Failed, summary.Stored+summary.Deduplicated+summary.Failed)
+		return
+	}
+	return
+}
+
+// feedArgs feeds arguments of the command, a dash reads them from stdin line by line.
+func feedArgs(ctx *cli.Context, stdin io.Reader) batchFeed[string] {
+	return func(send func(item string) bool) (err error) {
+		var scanner *bufio.Scanner
+		args := ctx.Args()
+		for i := 0; i < args.Len(); i++ {
+			if args.Get(i) == "-" {
+				scanner = bufio.NewScanner(stdin)
+				continue
+			}
+			if !send(args.Get(i)) {
+				return
+			}
+		}
+		if scanner != nil {
+			for scanner.Scan() {
+				if !send(scanner.Text()) {
+					return
+				}
+			}
+			err = scanner.Err()
+			if err != nil {
+				err = errors.Wrap(err, "read stdin")
+				return
+			}
+		}
+		return
+	}
+}
+
+func writeBatchResult(logger *utils.Logger, jsonOut *json.Encoder, summary *batchSummary, result batchResult) {
+	switch {
+	case result.err != nil || result.asset == nil:
+		summary.Failed++
+	case result.asset.Dedup:
+		summary.Deduplicated++
+		summary.Bytes += result.asset.Size
+	default:
+		summary.Stored++
+		summary.Bytes += result.asset.Size
+	}
+	if result.asset != nil {
+		jsonErr := jsonOut.Encode(result.asset)
+		if jsonErr != nil {
+			logger.Error("write json failed", "err", jsonErr)
+		}
+	}
+}
@@ -0,0 +1,128 @@
+package commands
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bbars/assets/service/types"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/urfave/cli/v2"
+)
+
+func TestRunBatch(t *testing.T) {
+	tests := []struct {
+		name  string
+		args  []string
+		stdin string
+		// finish - order items are processed in, other items are processed at once
+		finish    []string
+		wantNames []string
+		// unordered - compare names as a set
+		unordered bool
+		wantErr   bool
+	}{
+		{
+			name:      "sequential",
+			args:      []string{"a", "bb", "ccc"},
+			finish:    []string{"a", "bb", "ccc"},
+			wantNames: []string{"a", "bb", "ccc"},
+		},
+		{
+			name:      "ordered",
+			args:      []string{"--concurrency", "3", "ccc", "bb", "a"},
+			finish:    []string{"a", "bb", "ccc"},
+			wantNames: []string{"ccc", "bb", "a"},
+		},
+		{
+			name:      "unordered",
+			args:      []string{"--concurrency", "3", "--ordered=false", "ccc", "bb", "a"},
+			finish:    []string{"a", "bb", "ccc"},
+			wantNames: []string{"a", "bb", "ccc"},
+			unordered: true,
+		},
+		{
+			name:      "stdin",
+			args:      []string{"-j", "2", "a", "-"},
+			stdin:     "bb\nccc\n",
+			wantNames: []string{"a", "bb", "ccc"},
+		},
+		{
+			name:      "failure",
+			args:      []string{"-j", "2", "a", "fail", "bb"},
+			finish:    []string{"bb", "a"},
+			wantNames: []string{"a", "bb"},
+			wantErr:   true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// an item is processed when its gate is closed, the next gate is closed when the item is finished
+			started := make(map[string]chan struct{})
+			gates := make(map[string]chan struct{})
+			finished := make(map[string]chan struct{})
+			for _, item := range tt.finish {
+				started[item] = make(chan struct{})
+				gates[item] = make(chan struct{})
+				finished[item] = make(chan struct{})
+			}
+			driven := make(chan struct{})
+			go func() {
+				defer close(driven)
+				for _, item := range tt.finish {
+					select {
+					case <-started[item]:
+					case <-time.After(5 * time.Second):
+						t.Errorf("%s is not started", item)
+						return
+					}
+					close(gates[item])
+					<-finished[item]
+				}
+			}()
+
+			out := bytes.Buffer{}
+			app := &cli.App{
+				Flags: batchFlags,
+				Action: func(ctx *cli.Context) error {
+					return runBatch(ctx, json.NewEncoder(&out), feedArgs(ctx, strings.NewReader(tt.stdin)), func(ctx context.Context, item string) (*types.Asset, error) {
+						if item == "fail" {
+							return nil, errors.New("failed")
+						}
+						if gate, ok := gates[item]; ok {
+							close(started[item])
+							<-gate
+							defer close(finished[item])
+						}
+						return &types.Asset{OriginalName: item, Size: int64(len(item))}, nil
+					})
+				},
+			}
+			err := app.Run(append([]string{"batch"}, tt.args...))
+			<-driven
+			if tt.wantErr {
+				assert.Error(t, err)
+			} else {
+				require.NoError(t, err)
+			}
+
+			var names []string
+			dec := json.NewDecoder(&out)
+			for dec.More() {
+				asset := types.Asset{}
+				require.NoError(t, dec.Decode(&asset))
+				names = append(names, asset.OriginalName)
+			}
+			if tt.unordered {
+				assert.ElementsMatch(t, tt.wantNames, names)
+			} else {
+				assert.Equal(t, tt.wantNames, names)
+			}
+		})
+	}
+}
@@ -0,0 +1,135 @@
+package commands
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/bbars/assets/service"
+	"github.com/bbars/assets/utils"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli/v2"
+)
+
+// blobFlags configure commands processing all blobs of stored assets (migrate-storage, rekey).
+var blobFlags = []cli.Flag{
+	&cli.IntFlag{
+		Name:    "concurrency",
+		Aliases: []string{"j"},
+		Usage:   "Number of blobs processed in parallel.",
+		Value:   1,
+	},
+	&cli.DurationFlag{
+		Name:  "progress-interval",
+		Usage: "Interval of logging the progress.",
+		Value: 5 * time.Second,
+	},
+}
+
+// blobProcess handles the blob, changed is false if there was nothing to do with it.
+type blobProcess func(ctx context.Context, contentHash string) (changed bool, err error)
+
+// blobProgress - counters of processed blobs shared by workers.
+type blobProgress struct {
+	total   int64
+	done    int64
+	changed int64
+	failed  int64
+	bytes   int64
+}
+
+// processBlobs runs process for blobs of stored assets by a pool of workers logging the progress periodically,
+// failed blobs are logged and skipped, so the command fails only after all of them are processed.
+func processBlobs(ctx *cli.Context, assets *service.Assets, process blobProcess) (err error) {
+	concurrency := ctx.Int("concurrency")
+	if concurrency < 1 {
+		err = errors.Errorf("invalid value for concurrency flag: %d", concurrency)
+		return
+	}
+	logger := utils.ContextLogger(ctx.Context)
+
+	blobs, err := assets.ListBlobs(ctx.Context)
+	if err != nil {
+		return
+	}
+	contentHashes := make([]string, 0, len(blobs))
+	for contentHash := range blobs {
+		contentHashes = append(contentHashes, contentHash)
+	}
+	sort.Strings(contentHashes)
+
+	progress := &blobProgress{total: int64(len(contentHashes))}
+	logProgress := func(msg string) {
+		logger.Info(
+			msg,
+			"total", progress.total,
+			"done", atomic.LoadInt64(&progress.done),
+			"changed", atomic.LoadInt64(&progress.changed),
+			"failed", atomic.LoadInt64(&progress.failed),
+			"bytes", atomic.LoadInt64(&progress.bytes),
+		)
+	}
+
+	contentHashCh := make(chan string)
+	go func() {
+		defer close(contentHashCh)
+		for _, contentHash := range contentHashes {
+			select {
+			case contentHashCh <- contentHash:
+			case <-ctx.Context.Done():
+				return
+			}
+		}
+	}()
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for contentHash := range contentHashCh {
+				changed, processErr := process(ctx.Context, contentHash)
+				if processErr != nil {
+					logger.Error("process blob failed", "contentHash", contentHash, "err", processErr)
+					atomic.AddInt64(&progress.failed, 1)
+					continue
+				}
+				logger.Debug("blob processed", "contentHash", contentHash, "changed", changed)
+				atomic.AddInt64(&progress.done, 1)
+				if changed {
+					atomic.AddInt64(&progress.changed, 1)
+					atomic.AddInt64(&progress.bytes, blobs[contentHash])
+				}
+			}
+		}()
+	}
+	workersDone := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(workersDone)
+	}()
+
+	ticker := time.NewTicker(ctx.Duration("progress-interval"))
+	defer ticker.Stop()
+	for running := true; running; {
+		select {
+		case <-ticker.C:
+			logProgress("progress")
+		case <-workersDone:
+			running = false
+		}
+	}
+	logProgress("summary")
+
+	if ctx.Context.Err() != nil {
+		err = errors.Wrap(ctx.Context.Err(), "interrupted")
+		return
+	}
+	if progress.failed > 0 {
+		err = errors.Errorf("%d of %d blobs failed", progress.failed, progress.total)
+		return
+	}
+	return
+}
@@ -0,0 +1,62 @@
+package commands
+
+import (
+	"encoding/json"
+	"os"
+
+	"github.com/bbars/assets/service"
+	"github.com/bbars/assets/utils"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli/v2"
+)
+
+func NewDescribeCommand(initAssets InitAssets) *cli.Command {
+	d := describe{
+		assets:  nil,
+		jsonOut: json.NewEncoder(os.Stdout),
+	}
+	return &cli.Command{
+		Name:      "describe",
+		Usage:     "Show assets as JSON",
+		ArgsUsage: "<assetKey>...",
+		Action:    d.Action,
+		Before: func(ctx *cli.Context) (err error) {
+			d.assets, err = initAssets(ctx)
+			return
+		},
+	}
+}
+
+type describe struct {
+	assets  *service.Assets
+	jsonOut *json.Encoder
+}
+
+func (d *describe) Action(ctx *cli.Context) (err error) {
+	args := ctx.Args()
+	if args.Len() == 0 {
+		err = errors.New("at least one assetKey expected")
+		return
+	}
+
+	failed := 0
+	for _, assetKey := range args.Slice() {
+		logger := utils.ContextLogger(ctx.Context).With("assetKey", assetKey)
+		asset, describeErr := d.assets.DescribeByKey(ctx.Context, assetKey)
+		if describeErr != nil {
+			logger.Error("describe asset failed", "err", describeErr)
+			failed++
+			continue
+		}
+		jsonErr := d.jsonOut.Encode(asset)
+		if jsonErr != nil {
+			logger.Error("write json failed", "err", jsonErr)
+		}
+	}
+
+	if failed > 0 {
+		err = errors.Errorf("%d of %d assets failed", failed, args.Len())
+		return
+	}
+	return
+}
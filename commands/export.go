@@ -0,0 +1,272 @@
+package commands
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bbars/assets/service"
+	"github.com/bbars/assets/service/types"
+	"github.com/bbars/assets/utils"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli/v2"
+)
+
+func NewExportCommand(initAssets InitAssets) *cli.Command {
+	e := export{
+		assets:  nil,
+		jsonOut: json.NewEncoder(os.Stdout),
+	}
+	return &cli.Command{
+		Name:   "export",
+		Usage:  "Write assets to files of a directory",
+		Action: e.Action,
+		Before: func(ctx *cli.Context) (err error) {
+			e.assets, err = initAssets(ctx)
+			return
+		},
+		Flags: append([]cli.Flag{
+			&cli.StringFlag{
+				Name:     "target-dir",
+				Aliases:  []string{"t"},
+				Usage:    "Directory to write files to (created if not exists).",
+				Required: true,
+			},
+			&cli.StringFlag{
+				Name:    "user-id",
+				Aliases: []string{"user"},
+				Usage:   "Export all assets of the user if no asset keys passed.",
+			},
+			&cli.BoolFlag{
+				Name:  "link",
+				Usage: "Hard-link files from the storage directory instead of copying when possible, linked files are the blobs themselves.",
+			},
+			&cli.BoolFlag{
+				Name:  "restore-mtime",
+				Usage: "Set mtime of files stored by storefiles or storedir to the original one.",
+				Value: true,
+			},
+			&cli.StringFlag{
+				Name:  "manifest",
+				Usage: "File to write JSON object mapping asset keys to paths of written files.",
+			},
+		}, batchFlags...),
+	}
+}
+
+type export struct {
+	assets  *service.Assets
+	jsonOut *json.Encoder
+}
+
+// exportOptions - options of the export shared by workers.
+type exportOptions struct {
+	targetDir    string
+	link         bool
+	restoreMtime bool
+}
+
+func (e *export) Action(ctx *cli.Context) (err error) {
+	options := exportOptions{
+		targetDir:    ctx.String("target-dir"),
+		link:         ctx.Bool("link"),
+		restoreMtime: ctx.Bool("restore-mtime"),
+	}
+	err = os.MkdirAll(options.targetDir, 0755)
+	if err != nil {
+		err = errors.Wrap(err, "create target directory")
+		return
+	}
+
+	var feed batchFeed[string]
+	if ctx.NArg() > 0 {
+		feed = feedArgs(ctx, os.Stdin)
+	} else if ctx.IsSet("user-id") {
+		feed = func(send func(item string) bool) (err error) {
+			assets, err := e.assets.ListByUserId(ctx.Context, ctx.String("user-id"))
+			if err != nil {
+				return
+			}
+			for _, asset := range assets {
+				if !send(asset.AssetKey) {
+					return
+				}
+			}
+			return
+		}
+	} else {
+		err = errors.New("no asset keys passed (use --user-id to export all assets of a user)")
+		return
+	}
+
+	manifest := make(map[string]string)
+	manifestMu := sync.Mutex{}
+	err = runBatch(ctx, e.jsonOut, feed, func(c context.Context, assetKey string) (asset *types.Asset, err error) {
+		asset, path, err := e.processOne(c, assetKey, options)
+		if err == nil {
+			manifestMu.Lock()
+			manifest[assetKey] = path
+			manifestMu.Unlock()
+		}
+		return
+	})
+
+	if ctx.String("manifest") != "" {
+		manifestErr := writeManifest(ctx.String("manifest"), manifest)
+		if manifestErr != nil && err == nil {
+			err = manifestErr
+		}
+	}
+	return
+}
+
+// processOne writes the asset to a file named by its original name, a numeric suffix is added
+// to the name if there is such a file already.
+func (e *export) processOne(ctx context.Context, assetKey string, options exportOptions) (asset *types.Asset, path string, err error) {
+	logger := utils.ContextLogger(ctx).With("assetKey", assetKey)
+	defer func() {
+		if err != nil {
+			logger.Error("export asset failed", "err", err)
+		}
+	}()
+
+	asset, rc, err := e.assets.GetByKey(ctx, assetKey, nil)
+	if err != nil {
+		return
+	}
+	defer func() {
+		closeErr := rc.Close()
+		if closeErr != nil && err == nil {
+			err = errors.Wrap(closeErr, "close asset reader")
+		}
+	}()
+	name := exportName(asset)
+
+	mtime, restoreMtime := infoFileMtime(asset.Info)
+	restoreMtime = restoreMtime && options.restoreMtime
+	// the linked file shares mtime with the blob, so files to restore mtime of are copied
+	if options.link && !restoreMtime {
+		var linked bool
+		path, linked, err = e.link(asset, options.targetDir, name)
+		if err != nil {
+			return
+		}
+		if linked {
+			logger.Debug("asset is linked", "path", path)
+			return
+		}
+	}
+
+	var f *os.File
+	path, err = createUnique(options.targetDir, name, func(path string) (err error) {
+		f, err = os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		return
+	})
+	if err != nil {
+		err = errors.Wrap(err, "create file")
+		return
+	}
+	_, err = io.Copy(f, rc)
+	closeErr := f.Close()
+	if err == nil && closeErr != nil {
+		err = closeErr
+	}
+	if err != nil {
+		err = errors.Wrapf(err, "write file %+q", path)
+		return
+	}
+
+	if restoreMtime {
+		err = os.Chtimes(path, mtime, mtime)
+		if err != nil {
+			err = errors.Wrapf(err, "restore mtime of %+q", path)
+			return
+		}
+	}
+	return
+}
+
+// blobPathStorage is implemented by storages keeping blobs as is in files (DirStorage, CompressedStorage).
+type blobPathStorage interface {
+	Path(contentHash string) (path string, err error)
+}
+
+// link hard-links the blob of the asset, linked is false if the storage doesn't allow it
+// (e.g. the blob is compressed). The linked file is the blob itself, so its mode and mtime are not changed.
+func (e *export) link(asset *types.Asset, targetDir string, name string) (path string, linked bool, err error) {
+	pathStorage, ok := e.assets.Storage.(blobPathStorage)
+	if !ok {
+		return
+	}
+	blobPath, err := pathStorage.Path(asset.ContentHash)
+	if errors.Is(err, os.ErrNotExist) {
+		// copying reports a missing blob
+		err = nil
+		return
+	} else if err != nil {
+		err = errors.Wrap(err, "find blob")
+		return
+	}
+	var linkErr error
+	path, err = createUnique(targetDir, name, func(path string) error {
+		linkErr = os.Link(blobPath, path)
+		if os.IsExist(linkErr) {
+			return linkErr
+		}
+		// e.g. another device, so fall back to copying
+		return nil
+	})
+	if err != nil {
+		err = errors.Wrap(err, "link file")
+		return
+	}
+	linked = linkErr == nil
+	return
+}
+
+// createUnique calls create with paths of the name in the directory until it doesn't fail as existing:
+// name.ext, name-1.ext, name-2.ext and so on.
+func createUnique(dir string, name string, create func(path string) error) (path string, err error) {
+	ext := filepath.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+	for i := 0; ; i++ {
+		candidate := name
+		if i > 0 {
+			candidate = base + "-" + strconv.Itoa(i) + ext
+		}
+		path = filepath.Join(dir, candidate)
+		err = create(path)
+		if !os.IsExist(err) {
+			return
+		}
+	}
+}
+
+// exportName returns safe file name of the asset, its key if there is no original name.
+func exportName(asset *types.Asset) string {
+	name := filepath.Base(strings.ReplaceAll(asset.OriginalName, "\\", "/"))
+	switch name {
+	case "", ".", "..", "/":
+		return asset.AssetKey
+	}
+	return name
+}
+
+// infoFileMtime extracts mtime saved by storefiles and storedir commands.
+func infoFileMtime(info string) (mtime time.Time, ok bool) {
+	fileInfo := struct {
+		File struct {
+			Mtime *time.Time `json:"mtime"`
+		} `json:"file"`
+	}{}
+	if json.Unmarshal([]byte(info), &fileInfo) != nil || fileInfo.File.Mtime == nil {
+		return
+	}
+	return *fileInfo.File.Mtime, true
+}
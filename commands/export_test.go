@@ -0,0 +1,111 @@
+package commands
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/bbars/assets/service"
+	"github.com/bbars/assets/service/storage"
+	"github.com/bbars/assets/service/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/urfave/cli/v2"
+)
+
+func TestExport(t *testing.T) {
+	ctx := context.Background()
+	assets := newTestAssets(t)
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	info, err := json.Marshal(map[string]map[string]any{"file": {"mtime": mtime}})
+	require.NoError(t, err)
+
+	var keys []string
+	for _, extra := range []*types.Asset{
+		{OriginalName: "a.txt", UserId: "u1", Info: string(info)},
+		{OriginalName: "a.txt", UserId: "u1"},
+		{OriginalName: "../../etc/passwd", UserId: "u1"},
+		{OriginalName: "", UserId: "u2"},
+	} {
+		asset, err := assets.Store(ctx, extra, bytes.NewReader([]byte(extra.OriginalName+extra.UserId)))
+		require.NoError(t, err)
+		keys = append(keys, asset.AssetKey)
+	}
+
+	run := func(args ...string) (dir string, manifest map[string]string) {
+		dir = t.TempDir()
+		manifestPath := filepath.Join(t.TempDir(), "manifest.json")
+		app := &cli.App{
+			Commands: []*cli.Command{
+				NewExportCommand(func(ctx *cli.Context) (*service.Assets, error) { return assets, nil }),
+			},
+		}
+		require.NoError(t, app.Run(append([]string{"assets", "export", "-t", dir, "--manifest", manifestPath}, args...)))
+		data, err := os.ReadFile(manifestPath)
+		require.NoError(t, err)
+		require.NoError(t, json.Unmarshal(data, &manifest))
+		return
+	}
+
+	t.Run("copy", func(t *testing.T) {
+		dir, manifest := run("--user-id", "u1")
+		assert.Equal(t, map[string]string{
+			keys[0]: filepath.Join(dir, "a.txt"),
+			keys[1]: filepath.Join(dir, "a-1.txt"),
+			keys[2]: filepath.Join(dir, "passwd"),
+		}, manifest)
+		data, err := os.ReadFile(filepath.Join(dir, "a-1.txt"))
+		require.NoError(t, err)
+		assert.Equal(t, "a.txtu1", string(data))
+		stat, err := os.Stat(filepath.Join(dir, "a.txt"))
+		require.NoError(t, err)
+		assert.True(t, mtime.Equal(stat.ModTime()))
+	})
+
+	blobStat := func(t *testing.T, assetKey string) os.FileInfo {
+		asset, err := assets.DescribeByKey(ctx, assetKey)
+		require.NoError(t, err)
+		blobPath, err := assets.Storage.(*storage.DirStorage).Path(asset.ContentHash)
+		require.NoError(t, err)
+		stat, err := os.Stat(blobPath)
+		require.NoError(t, err)
+		return stat
+	}
+
+	t.Run("link", func(t *testing.T) {
+		before := blobStat(t, keys[3])
+		dir, manifest := run("--link", keys[3])
+		path := filepath.Join(dir, keys[3])
+		assert.Equal(t, map[string]string{keys[3]: path}, manifest)
+		stat, err := os.Stat(path)
+		require.NoError(t, err)
+		assert.Equal(t, int64(len("u2")), stat.Size())
+		after := blobStat(t, keys[3])
+		assert.True(t, os.SameFile(after, stat))
+		assert.Equal(t, before.Mode(), after.Mode(), "blob mode is kept")
+		assert.True(t, before.ModTime().Equal(after.ModTime()), "blob mtime is kept")
+	})
+
+	t.Run("link with restore-mtime", func(t *testing.T) {
+		before := blobStat(t, keys[0])
+
+		// mtime of the blob can't be restored, so the file is copied
+		dir, _ := run("--link", keys[0])
+		stat, err := os.Stat(filepath.Join(dir, "a.txt"))
+		require.NoError(t, err)
+		after := blobStat(t, keys[0])
+		assert.False(t, os.SameFile(after, stat))
+		assert.True(t, mtime.Equal(stat.ModTime()))
+		assert.Equal(t, before.Mode(), after.Mode(), "blob mode is kept")
+		assert.True(t, before.ModTime().Equal(after.ModTime()), "blob mtime is kept")
+
+		dir, _ = run("--link", "--restore-mtime=false", keys[0])
+		stat, err = os.Stat(filepath.Join(dir, "a.txt"))
+		require.NoError(t, err)
+		assert.True(t, os.SameFile(blobStat(t, keys[0]), stat))
+	})
+}
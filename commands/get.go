@@ -0,0 +1,124 @@
+package commands
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/bbars/assets/service"
+	"github.com/bbars/assets/service/types"
+	"github.com/bbars/assets/utils"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli/v2"
+)
+
+func NewGetCommand(initAssets InitAssets) *cli.Command {
+	g := get{
+		assets:  nil,
+		jsonOut: json.NewEncoder(os.Stdout),
+	}
+	return &cli.Command{
+		Name:      "get",
+		Aliases:   []string{"cat"},
+		Usage:     "Write asset contents to stdout or a file",
+		ArgsUsage: "<assetKey|originalUrl>",
+		Action:    g.Action,
+		Before: func(ctx *cli.Context) (err error) {
+			g.assets, err = initAssets(ctx)
+			return
+		},
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:    "range",
+				Aliases: []string{"r"},
+				Usage:   "Range of bytes to write in Range header syntax. Example: 'bytes=0-99', '-100' (the last 100 bytes).",
+			},
+			&cli.StringFlag{
+				Name:    "output",
+				Aliases: []string{"o"},
+				Usage:   "File to write the contents to instead of stdout (the asset is printed as JSON then).",
+			},
+		},
+	}
+}
+
+type get struct {
+	assets  *service.Assets
+	jsonOut *json.Encoder
+}
+
+func (g *get) Action(ctx *cli.Context) (err error) {
+	if ctx.NArg() != 1 {
+		err = errors.New("exactly one asset key or original URL expected")
+		return
+	}
+	ref := ctx.Args().First()
+
+	var rng *utils.Range
+	if ctx.String("range") != "" {
+		headerRange := ctx.String("range")
+		if !strings.HasPrefix(headerRange, "bytes=") {
+			headerRange = "bytes=" + headerRange
+		}
+		rng, err = utils.ParseHttpRangeHeader(headerRange)
+		if err != nil {
+			err = errors.Wrap(err, "invalid value for range flag")
+			return
+		}
+	}
+
+	var asset *types.Asset
+	var rc io.ReadCloser
+	if strings.Contains(ref, "://") {
+		asset, rc, err = g.assets.GetByOriginalUrl(ctx.Context, ref, rng)
+		// unknown URL is fetched in background while it is read, so wait for the asset to be saved
+		defer func() {
+			drainErr := g.assets.Drain(ctx.Context)
+			if drainErr != nil && err == nil {
+				err = drainErr
+			}
+		}()
+	} else {
+		asset, rc, err = g.assets.GetByKey(ctx.Context, ref, rng)
+	}
+	if err != nil {
+		return
+	}
+	if asset == nil || rc == nil {
+		err = errors.Errorf("no asset for %+q", ref)
+		return
+	}
+	defer func() {
+		closeErr := rc.Close()
+		if closeErr != nil && err == nil {
+			err = errors.Wrap(closeErr, "close asset reader")
+		}
+	}()
+
+	output := ctx.String("output")
+	if output == "" {
+		_, err = io.Copy(os.Stdout, rc)
+		if err != nil {
+			err = errors.Wrap(err, "write asset to stdout")
+		}
+		return
+	}
+
+	f, err := os.Create(output)
+	if err != nil {
+		err = errors.Wrap(err, "create output file")
+		return
+	}
+	_, err = io.Copy(f, rc)
+	closeErr := f.Close()
+	if err == nil && closeErr != nil {
+		err = closeErr
+	}
+	if err != nil {
+		err = errors.Wrapf(err, "write asset to %+q", output)
+		return
+	}
+	err = g.jsonOut.Encode(asset)
+	return
+}
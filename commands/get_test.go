@@ -0,0 +1,104 @@
+package commands
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/bbars/assets/service"
+	"github.com/bbars/assets/service/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/urfave/cli/v2"
+)
+
+func TestGet(t *testing.T) {
+	assets := newTestAssets(t)
+	stored, err := assets.Store(context.Background(), &types.Asset{}, bytes.NewReader([]byte("hello world")))
+	require.NoError(t, err)
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		_, _ = w.Write([]byte("remote contents"))
+	}))
+	t.Cleanup(origin.Close)
+
+	tests := []struct {
+		name     string
+		args     []string
+		wantData string
+		wantErr  bool
+	}{
+		{
+			name:     "by key",
+			args:     []string{stored.AssetKey},
+			wantData: "hello world",
+		},
+		{
+			name:     "range",
+			args:     []string{"--range", "bytes=2-8", stored.AssetKey},
+			wantData: "llo wor",
+		},
+		{
+			name:     "tail range without unit",
+			args:     []string{"-r", "-5", stored.AssetKey},
+			wantData: "world",
+		},
+		{
+			name:    "invalid range",
+			args:    []string{"-r", "bytes=5-1", stored.AssetKey},
+			wantErr: true,
+		},
+		{
+			name:    "unknown key",
+			args:    []string{"unknown"},
+			wantErr: true,
+		},
+		{
+			name:     "by original url",
+			args:     []string{origin.URL + "/r.txt"},
+			wantData: "remote contents",
+		},
+		{
+			name:    "missing original url",
+			args:    []string{origin.URL + "/missing"},
+			wantErr: true,
+		},
+		{
+			name:    "original url rejected by policy",
+			args:    []string{"http://example.com/r.txt"},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			output := filepath.Join(t.TempDir(), "out")
+			app := &cli.App{
+				Commands: []*cli.Command{
+					NewGetCommand(func(ctx *cli.Context) (*service.Assets, error) { return assets, nil }),
+				},
+			}
+			err := app.Run(append([]string{"assets", "get", "-o", output}, tt.args...))
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			data, err := os.ReadFile(output)
+			require.NoError(t, err)
+			assert.Equal(t, tt.wantData, string(data))
+		})
+	}
+
+	// the fetched asset is saved before the command exits
+	asset, rc, err := assets.GetByOriginalUrl(context.Background(), origin.URL+"/r.txt", nil)
+	require.NoError(t, err)
+	require.NoError(t, rc.Close())
+	assert.Equal(t, types.AssetStatus_done, asset.Status)
+}
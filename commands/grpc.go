@@ -0,0 +1,155 @@
+package commands
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/bbars/assets/grpcapi"
+	"github.com/bbars/assets/service"
+	"github.com/bbars/assets/utils"
+	"github.com/urfave/cli/v2"
+	"google.golang.org/grpc"
+)
+
+// GrpcOptions configures gRPC API server.
+type GrpcOptions struct {
+	// ChunkSize - max size of content chunks streamed by Get
+	ChunkSize int
+
+	// WatchInterval - how often Watch checks the asset status
+	WatchInterval time.Duration
+}
+
+// defaultWatchInterval - how often asset status is checked for watchers
+const defaultWatchInterval = 500 * time.Millisecond
+
+var defaultGrpcOptions = GrpcOptions{
+	ChunkSize:     64 * 1024,
+	WatchInterval: defaultWatchInterval,
+}
+
+func NewGrpcCommand(initAssets InitAssets) *cli.Command {
+	sg := serveGrpc{
+		assets: nil,
+	}
+	return &cli.Command{
+		Name:   "grpc",
+		Usage:  "Start gRPC server",
+		Action: sg.Action,
+		Before: func(ctx *cli.Context) (err error) {
+			sg.assets, err = initAssets(ctx)
+			return
+		},
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:    "bind",
+				Usage:   "Address to bind gRPC server.",
+				Value:   ":9090",
+				EnvVars: []string{"ASSETS_GRPC_BIND"},
+			},
+			&cli.IntFlag{
+				Name:    "chunk-size",
+				Usage:   "Max size of content chunks streamed to clients.",
+				Value:   defaultGrpcOptions.ChunkSize,
+				EnvVars: []string{"ASSETS_GRPC_CHUNK_SIZE"},
+			},
+			&cli.DurationFlag{
+				Name:    "watch-interval",
+				Usage:   "How often Watch checks the asset status.",
+				Value:   defaultGrpcOptions.WatchInterval,
+				EnvVars: []string{"ASSETS_GRPC_WATCH_INTERVAL"},
+			},
+			&cli.DurationFlag{
+				Name:    "shutdown-timeout",
+				Usage:   "Time to drain active requests and background fetches on shutdown.",
+				Value:   30 * time.Second,
+				EnvVars: []string{"ASSETS_GRPC_SHUTDOWN_TIMEOUT"},
+			},
+			&cli.BoolFlag{
+				Name:    "resume-fetches",
+				Usage:   "Resume fetches by original URL left unfinished on previous shutdown.",
+				Value:   true,
+				EnvVars: []string{"ASSETS_GRPC_RESUME_FETCHES"},
+			},
+		},
+	}
+}
+
+type serveGrpc struct {
+	assets *service.Assets
+}
+
+func (sg *serveGrpc) Action(ctx *cli.Context) error {
+	lis, err := net.Listen("tcp", ctx.String("bind"))
+	if err != nil {
+		return err
+	}
+
+	fmt.Println(lis.Addr().String())
+	logger := utils.ContextLogger(ctx.Context)
+	logger.Info("grpc server started", "addr", lis.Addr().String())
+
+	// see serveHttp.Action
+	bgCtx, bgCancel := context.WithCancel(utils.ContextDetach(ctx.Context))
+	defer bgCancel()
+
+	if ctx.Bool("resume-fetches") {
+		resumeFetches(logger, sg.assets, bgCtx)
+	}
+
+	grpcServer := newGrpcServer(sg.assets, bgCtx, GrpcOptions{
+		ChunkSize:     ctx.Int("chunk-size"),
+		WatchInterval: ctx.Duration("watch-interval"),
+	})
+	closed := make(chan struct{})
+	go func() {
+		grpcServerErr := grpcServer.Serve(lis)
+		if grpcServerErr != nil {
+			logger.Error("grpc server failed", "err", grpcServerErr)
+		}
+		close(closed)
+	}()
+
+	select {
+	case <-ctx.Context.Done():
+		err = shutdown(logger, sg.assets, bgCancel, ctx.Duration("shutdown-timeout"), func(ctx context.Context) error {
+			return stopGrpc(ctx, logger, grpcServer)
+		})
+	case <-closed:
+	}
+	return err
+}
+
+// newGrpcServer builds gRPC server of the assets API.
+// Fetches by URL started by requests run in bgCtx instead of the request context, so they outlive requests.
+func newGrpcServer(assets *service.Assets, bgCtx context.Context, options GrpcOptions) *grpc.Server {
+	server := grpc.NewServer(
+		grpc.ChainUnaryInterceptor(unaryInterceptor),
+		grpc.ChainStreamInterceptor(streamInterceptor),
+	)
+	grpcapi.RegisterAssetsServer(server, &grpcAssets{
+		assets:  assets,
+		bgCtx:   bgCtx,
+		options: options,
+	})
+	return server
+}
+
+// stopGrpc waits for active requests, when ctx is done remaining ones are cancelled.
+func stopGrpc(ctx context.Context, logger *utils.Logger, server *grpc.Server) error {
+	stopped := make(chan struct{})
+	go func() {
+		server.GracefulStop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+		return nil
+	case <-ctx.Done():
+		logger.Warn("grpc shutdown timed out, closing connections", "err", ctx.Err())
+		server.Stop()
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,213 @@
+package commands
+
+import (
+	"context"
+	"io"
+
+	"github.com/bbars/assets/grpcapi"
+	"github.com/bbars/assets/service"
+	"github.com/bbars/assets/service/types"
+	"github.com/bbars/assets/utils"
+	"github.com/pkg/errors"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+type grpcAssets struct {
+	grpcapi.UnimplementedAssetsServer
+	assets  *service.Assets
+	bgCtx   context.Context
+	options GrpcOptions
+}
+
+func (ga *grpcAssets) Describe(ctx context.Context, req *grpcapi.DescribeRequest) (*grpcapi.Asset, error) {
+	asset, err := ga.assets.DescribeByKey(ctx, req.AssetKey)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return assetToProto(asset), nil
+}
+
+func (ga *grpcAssets) Get(req *grpcapi.GetRequest, stream grpcapi.Assets_GetServer) (err error) {
+	ctx := stream.Context()
+	var rr *utils.Range
+	if req.Range != nil {
+		rr = &utils.Range{
+			From: req.Range.From,
+			To:   req.Range.To,
+		}
+	}
+	asset, rc, err := ga.assets.GetByKey(ctx, req.AssetKey, rr)
+	if err != nil {
+		return grpcError(err)
+	}
+	defer func() {
+		closeErr := rc.Close()
+		if closeErr != nil {
+			utils.ContextLogger(ctx).Error("close asset reader failed", "err", closeErr)
+		}
+	}()
+
+	head := &grpcapi.GetResponse{
+		Asset: assetToProto(asset),
+	}
+	if rr != nil {
+		// normalized by GetByKey
+		head.Range = &grpcapi.Range{
+			From: rr.From,
+			To:   rr.To,
+		}
+	}
+	err = stream.Send(head)
+	if err != nil {
+		return
+	}
+
+	buf := make([]byte, ga.options.ChunkSize)
+	for {
+		n, readErr := io.ReadFull(rc, buf)
+		if n > 0 {
+			err = stream.Send(&grpcapi.GetResponse{
+				Chunk: buf[:n],
+			})
+			if err != nil {
+				return
+			}
+		}
+		if readErr == io.EOF || readErr == io.ErrUnexpectedEOF {
+			return nil
+		} else if readErr != nil {
+			return grpcError(errors.Wrap(readErr, "read asset"))
+		}
+	}
+}
+
+func (ga *grpcAssets) Store(stream grpcapi.Assets_StoreServer) error {
+	ctx := stream.Context()
+	req, err := stream.Recv()
+	if err != nil {
+		return err
+	}
+	meta := req.GetMeta()
+	if meta == nil {
+		return status.Error(codes.InvalidArgument, "first message must carry meta")
+	}
+	extra := &types.Asset{
+		Size:         meta.Size,
+		ContentType:  meta.ContentType,
+		OriginalName: meta.OriginalName,
+		UserId:       meta.UserId,
+		OriginalUrl:  meta.OriginalUrl,
+		Info:         meta.Info,
+	}
+	asset, err := ga.assets.Store(ctx, extra, &storeStreamReader{stream: stream})
+	if err != nil {
+		return grpcError(err)
+	}
+	return stream.SendAndClose(assetToProto(asset))
+}
+
+func (ga *grpcAssets) StoreByOriginalUrl(ctx context.Context, req *grpcapi.StoreByOriginalUrlRequest) (*grpcapi.Asset, error) {
+	// The fetch outlives the request, so it runs in the server context ignoring client cancellation
+	ctx = service.ContextWithBackground(ctx, ga.bgCtx)
+	asset, err := ga.assets.StoreByOriginalUrl(ctx, req.OriginalUrl, req.UserId, req.Wait)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return assetToProto(asset), nil
+}
+
+func (ga *grpcAssets) Watch(req *grpcapi.WatchRequest, stream grpcapi.Assets_WatchServer) error {
+	err := ga.assets.WatchByKey(stream.Context(), req.AssetKey, ga.options.WatchInterval, func(asset *types.Asset) error {
+		return stream.Send(assetToProto(asset))
+	})
+	return grpcError(err)
+}
+
+// storeStreamReader reads contents chunks sent by client.
+type storeStreamReader struct {
+	stream grpcapi.Assets_StoreServer
+	buf    []byte
+}
+
+func (r *storeStreamReader) Read(p []byte) (n int, err error) {
+	for len(r.buf) == 0 {
+		var req *grpcapi.StoreRequest
+		req, err = r.stream.Recv()
+		if err != nil {
+			return
+		}
+		if req.GetMeta() != nil {
+			err = service.NewError(service.ErrorCode_invalid, errors.New("meta must be sent in the first message only"))
+			return
+		}
+		r.buf = req.GetChunk()
+	}
+	n = copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return
+}
+
+func assetToProto(asset *types.Asset) *grpcapi.Asset {
+	res := &grpcapi.Asset{
+		AssetKey:     asset.AssetKey,
+		Btime:        timestamppb.New(asset.Btime),
+		Size:         asset.Size,
+		ContentHash:  asset.ContentHash,
+		ContentType:  asset.ContentType,
+		OriginalName: asset.OriginalName,
+		UserId:       asset.UserId,
+		OriginalUrl:  asset.OriginalUrl,
+		Deleted:      asset.Deleted,
+		StorageName:  asset.StorageName,
+		Status:       string(asset.Status),
+		Info:         asset.Info,
+		Error:        asset.Error,
+	}
+	if asset.Mtime != nil {
+		res.Mtime = timestamppb.New(*asset.Mtime)
+	}
+	if asset.Dtime != nil {
+		res.Dtime = timestamppb.New(*asset.Dtime)
+	}
+	if asset.Progress != nil {
+		res.Progress = &grpcapi.FetchProgress{
+			Received: asset.Progress.Received,
+			Total:    asset.Progress.Total,
+		}
+	}
+	return res
+}
+
+// grpcError converts service error to gRPC status, see errorStatus for HTTP.
+func grpcError(err error) error {
+	if err == nil {
+		return nil
+	}
+	if errors.As(err, &errRangeError) {
+		return status.Error(codes.OutOfRange, err.Error())
+	}
+	if errors.Is(err, context.Canceled) {
+		return status.Error(codes.Canceled, err.Error())
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return status.Error(codes.DeadlineExceeded, err.Error())
+	}
+	code := codes.Internal
+	switch service.ErrorCodeOf(err) {
+	case service.ErrorCode_invalid:
+		code = codes.InvalidArgument
+	case service.ErrorCode_notFound:
+		code = codes.NotFound
+	case service.ErrorCode_forbidden:
+		code = codes.PermissionDenied
+	case service.ErrorCode_tooLarge:
+		code = codes.ResourceExhausted
+	case service.ErrorCode_conflict:
+		code = codes.FailedPrecondition
+	case service.ErrorCode_unavailable:
+		code = codes.Unavailable
+	}
+	return status.Error(code, err.Error())
+}
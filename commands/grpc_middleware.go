@@ -0,0 +1,111 @@
+package commands
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/bbars/assets/service/metrics"
+	"github.com/bbars/assets/service/tracing"
+	"github.com/bbars/assets/utils"
+	"go.opentelemetry.io/otel/attribute"
+	otelcodes "go.opentelemetry.io/otel/codes"
+	semconv "go.opentelemetry.io/otel/semconv/v1.17.0"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+var (
+	metricGrpcRequests = metrics.NewCounter(
+		"assets_grpc_requests_total",
+		"gRPC requests by method and status code.",
+		"method",
+		"code",
+	)
+	metricGrpcRequestDuration = metrics.NewHistogram(
+		"assets_grpc_request_duration_seconds",
+		"gRPC request latencies by method.",
+		nil,
+		"method",
+	)
+)
+
+func unaryInterceptor(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (res any, err error) {
+	ctx, done := instrumentGrpc(ctx, info.FullMethod)
+	defer func() { done(err) }()
+	return handler(ctx, req)
+}
+
+func streamInterceptor(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) (err error) {
+	ctx, done := instrumentGrpc(ss.Context(), info.FullMethod)
+	defer func() { done(err) }()
+	return handler(srv, &contextServerStream{ServerStream: ss, ctx: ctx})
+}
+
+// instrumentGrpc does the same as serveHttp.instrument: collects metrics, traces the request,
+// writes access log and attaches a logger with request ID to the context.
+func instrumentGrpc(ctx context.Context, method string) (context.Context, func(err error)) {
+	start := time.Now()
+	md, _ := metadata.FromIncomingContext(ctx)
+	header := http.Header{}
+	for key, values := range md {
+		for _, value := range values {
+			header.Add(key, value)
+		}
+	}
+	requestId := header.Get("x-request-id")
+	if requestId == "" {
+		requestId = utils.GenerateQid(requestIdLen)
+	}
+	_ = grpc.SetHeader(ctx, metadata.Pairs("x-request-id", requestId))
+	ctx, span := tracing.StartServer(
+		ctx,
+		header,
+		"gRPC "+method,
+		semconv.RPCSystemKey.String("grpc"),
+		semconv.RPCMethod(method),
+		attribute.String("rpc.request_id", requestId),
+	)
+	ctx = utils.ContextWithLogFields(ctx, "requestId", requestId)
+
+	return ctx, func(err error) {
+		duration := time.Since(start)
+		code := status.Code(err)
+		span.SetAttributes(semconv.RPCGRPCStatusCodeKey.Int(int(code)))
+		if err != nil && code != codes.Canceled {
+			span.SetStatus(otelcodes.Error, err.Error())
+		}
+		span.End()
+
+		metricGrpcRequests.Inc(method, code.String())
+		metricGrpcRequestDuration.Observe(duration.Seconds(), method)
+
+		client := ""
+		if p, ok := peer.FromContext(ctx); ok {
+			client = p.Addr.String()
+		}
+		kv := []any{
+			"method", method,
+			"code", code.String(),
+			"duration", duration,
+			"client", client,
+		}
+		if err != nil {
+			kv = append(kv, "err", status.Convert(err).Message())
+		}
+		utils.ContextLogger(ctx).Info("access", kv...)
+	}
+}
+
+// contextServerStream overrides the context of the stream.
+type contextServerStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *contextServerStream) Context() context.Context {
+	return s.ctx
+}
@@ -0,0 +1,211 @@
+package commands
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/bbars/assets/grpcapi"
+	"github.com/bbars/assets/service"
+	"github.com/bbars/assets/service/repository"
+	"github.com/bbars/assets/service/storage"
+	"github.com/bbars/assets/service/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+func newTestAssets(t *testing.T) *service.Assets {
+	migrations := fstest.MapFS{}
+	names, err := filepath.Glob(filepath.Join("..", repository.SqliteMigrationsDir, "*.sql"))
+	require.NoError(t, err)
+	for _, name := range names {
+		data, err := os.ReadFile(name)
+		require.NoError(t, err)
+		migrations[repository.SqliteMigrationsDir+"/"+filepath.Base(name)] = &fstest.MapFile{Data: data}
+	}
+
+	dir := t.TempDir()
+	db, err := sql.Open("sqlite3", filepath.Join(dir, "assets.db"))
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = db.Close() })
+	repo := repository.NewSqlite(db, migrations)
+	require.NoError(t, repo.Migrate(context.Background()))
+
+	return &service.Assets{
+		Storage: &storage.DirStorage{
+			Dir:       dir,
+			PathDepth: 2,
+			DirPerm:   0755,
+			FilePerm:  0644,
+		},
+		Repo: repo,
+		Config: service.AssetsConfig{
+			OriginalUrlPattern: regexp.MustCompile(`^http://127\.0\.0\.1`),
+		},
+	}
+}
+
+func newTestGrpcClient(t *testing.T) grpcapi.AssetsClient {
+	lis := bufconn.Listen(1024 * 1024)
+	server := newGrpcServer(newTestAssets(t), context.Background(), GrpcOptions{
+		ChunkSize:     4,
+		WatchInterval: defaultGrpcOptions.WatchInterval,
+	})
+	go func() { _ = server.Serve(lis) }()
+	t.Cleanup(server.Stop)
+
+	conn, err := grpc.Dial(
+		"bufconn",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return lis.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = conn.Close() })
+	return grpcapi.NewAssetsClient(conn)
+}
+
+func TestGrpcStoreAndGet(t *testing.T) {
+	ctx := context.Background()
+	c := newTestGrpcClient(t)
+
+	store, err := c.Store(ctx)
+	require.NoError(t, err)
+	require.NoError(t, store.Send(&grpcapi.StoreRequest{Payload: &grpcapi.StoreRequest_Meta{Meta: &grpcapi.StoreMeta{
+		ContentType:  "text/plain",
+		OriginalName: "hello.txt",
+	}}}))
+	for _, chunk := range []string{"hello", " ", "world"} {
+		require.NoError(t, store.Send(&grpcapi.StoreRequest{Payload: &grpcapi.StoreRequest_Chunk{Chunk: []byte(chunk)}}))
+	}
+	stored, err := store.CloseAndRecv()
+	require.NoError(t, err)
+	assert.Equal(t, int64(11), stored.Size)
+	assert.Equal(t, "done", stored.Status)
+
+	described, err := c.Describe(ctx, &grpcapi.DescribeRequest{AssetKey: stored.AssetKey})
+	require.NoError(t, err)
+	assert.Equal(t, stored.ContentHash, described.ContentHash)
+
+	tests := []struct {
+		name      string
+		rng       *grpcapi.Range
+		wantRange *grpcapi.Range
+		wantData  string
+	}{
+		{
+			name:     "full",
+			wantData: "hello world",
+		},
+		{
+			name:      "range",
+			rng:       &grpcapi.Range{From: 2, To: 9},
+			wantRange: &grpcapi.Range{From: 2, To: 9},
+			wantData:  "llo wor",
+		},
+		{
+			name:      "tail",
+			rng:       &grpcapi.Range{From: 0, To: -5},
+			wantRange: &grpcapi.Range{From: 6, To: 11},
+			wantData:  "world",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			get, err := c.Get(ctx, &grpcapi.GetRequest{AssetKey: stored.AssetKey, Range: tt.rng})
+			require.NoError(t, err)
+			head, err := get.Recv()
+			require.NoError(t, err)
+			assert.Equal(t, stored.AssetKey, head.Asset.AssetKey)
+			assert.Equal(t, tt.wantRange.GetFrom(), head.Range.GetFrom())
+			assert.Equal(t, tt.wantRange.GetTo(), head.Range.GetTo())
+			data := bytes.Buffer{}
+			for {
+				res, err := get.Recv()
+				if err == io.EOF {
+					break
+				}
+				require.NoError(t, err)
+				assert.LessOrEqual(t, len(res.Chunk), 4)
+				data.Write(res.Chunk)
+			}
+			assert.Equal(t, tt.wantData, data.String())
+		})
+	}
+
+	_, err = c.Describe(ctx, &grpcapi.DescribeRequest{AssetKey: "unknown"})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+}
+
+func TestGrpcStoreByOriginalUrl(t *testing.T) {
+	ctx := context.Background()
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("remote contents"))
+	}))
+	t.Cleanup(origin.Close)
+	c := newTestGrpcClient(t)
+
+	prep, err := c.StoreByOriginalUrl(ctx, &grpcapi.StoreByOriginalUrlRequest{OriginalUrl: origin.URL + "/r.txt"})
+	require.NoError(t, err)
+
+	watch, err := c.Watch(ctx, &grpcapi.WatchRequest{AssetKey: prep.AssetKey})
+	require.NoError(t, err)
+	var last *grpcapi.Asset
+	for {
+		asset, err := watch.Recv()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		last = asset
+	}
+	require.NotNil(t, last)
+	assert.Equal(t, "done", last.Status)
+	assert.Equal(t, int64(15), last.Size)
+
+	_, err = c.StoreByOriginalUrl(ctx, &grpcapi.StoreByOriginalUrlRequest{OriginalUrl: "https://example.com/", Wait: true})
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+}
+
+func TestGrpcStoreByOriginalUrlDeadline(t *testing.T) {
+	originRelease := make(chan struct{})
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("content-length", "4")
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		<-originRelease
+		_, _ = w.Write([]byte("slow"))
+	}))
+	t.Cleanup(origin.Close)
+	assets := newTestAssets(t)
+	ga := &grpcAssets{assets: assets, bgCtx: context.Background(), options: defaultGrpcOptions}
+
+	// the deadline releases the handler waiting for the fetch
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err := ga.StoreByOriginalUrl(ctx, &grpcapi.StoreByOriginalUrlRequest{OriginalUrl: origin.URL + "/slow", Wait: true})
+	assert.Equal(t, codes.DeadlineExceeded, status.Code(err))
+	assert.Less(t, time.Since(start), time.Second)
+
+	// but the fetch goes on
+	close(originRelease)
+	assert.Eventually(t, func() bool {
+		asset, err := assets.HeadByOriginalUrl(context.Background(), origin.URL+"/slow", nil)
+		return err == nil && asset.Status == types.AssetStatus_done && asset.Size == 4
+	}, 5*time.Second, 10*time.Millisecond)
+}
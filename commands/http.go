@@ -5,14 +5,15 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
-	"log"
 	"net"
 	"net/http"
+	"net/url"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/bbars/assets/service"
+	"github.com/bbars/assets/service/metrics"
 	"github.com/bbars/assets/service/types"
 	"github.com/bbars/assets/utils"
 	"github.com/pkg/errors"
@@ -48,6 +49,35 @@ func NewHttpCommand(initAssets InitAssets) *cli.Command {
 				Value:   "application/octet-stream",
 				EnvVars: []string{"ASSETS_HTTP_FALLBACK_MIMETYPE"},
 			},
+			&cli.StringFlag{
+				Name:    "metrics-path",
+				Usage:   "Path to expose metrics in Prometheus text format (empty value disables).",
+				Value:   "/metrics",
+				EnvVars: []string{"ASSETS_HTTP_METRICS_PATH"},
+			},
+			&cli.DurationFlag{
+				Name:    "shutdown-timeout",
+				Usage:   "Time to drain active requests and background fetches on shutdown.",
+				Value:   30 * time.Second,
+				EnvVars: []string{"ASSETS_HTTP_SHUTDOWN_TIMEOUT"},
+			},
+			&cli.BoolFlag{
+				Name:    "resume-fetches",
+				Usage:   "Resume fetches by original URL left unfinished on previous shutdown.",
+				Value:   true,
+				EnvVars: []string{"ASSETS_HTTP_RESUME_FETCHES"},
+			},
+			&cli.StringFlag{
+				Name:    "grpc-bind",
+				Usage:   "Address to bind gRPC server alongside HTTP one (empty value disables).",
+				EnvVars: []string{"ASSETS_HTTP_GRPC_BIND"},
+			},
+			&cli.DurationFlag{
+				Name:    "progress-interval",
+				Usage:   "How often fetch progress is checked for /fetchProgress stream.",
+				Value:   defaultWatchInterval,
+				EnvVars: []string{"ASSETS_HTTP_PROGRESS_INTERVAL"},
+			},
 			&cli.DurationFlag{
 				Name:    "cache-ttl",
 				Usage:   "Duration for Cache-Control and Expires response headers.",
@@ -59,22 +89,46 @@ func NewHttpCommand(initAssets InitAssets) *cli.Command {
 }
 
 type serveHttp struct {
-	assets *service.Assets
-	cliCtx *cli.Context
+	assets  *service.Assets
+	options HttpOptions
+}
+
+// HttpOptions configures HTTP API handler.
+type HttpOptions struct {
+	// FallbackMimetype - value for Content-Type header of assets without content type
+	FallbackMimetype string
+
+	// CacheTtl - duration for Cache-Control and Expires headers of assets (0 disables)
+	CacheTtl time.Duration
+
+	// MetricsPath - path to expose metrics (empty value disables)
+	MetricsPath string
+
+	// ProgressInterval - how often fetch progress is checked for /fetchProgress stream
+	ProgressInterval time.Duration
+}
+
+// NewHttpHandler returns HTTP API handler, e.g. to embed it into another server.
+func NewHttpHandler(assets *service.Assets, options HttpOptions) http.Handler {
+	if options.ProgressInterval <= 0 {
+		options.ProgressInterval = defaultWatchInterval
+	}
+	sh := &serveHttp{
+		assets:  assets,
+		options: options,
+	}
+	return sh.handler()
 }
 
 func (sh *serveHttp) Action(ctx *cli.Context) error {
 	var err error
 	bind := ctx.String("bind")
-	sh.cliCtx = ctx
-
-	hm := http.NewServeMux()
-
-	hm.HandleFunc("/describeByKey", sh.describeByKey)
-	hm.HandleFunc("/getByKey", sh.getByKey)
-	hm.HandleFunc("/getByOriginalUrl", sh.getByOriginalUrl)
-	hm.HandleFunc("/storeByOriginalUrl", sh.storeByOriginalUrl)
-	hm.HandleFunc("/store", sh.store)
+	sh.options = HttpOptions{
+		FallbackMimetype: ctx.String("fallback-mimetype"),
+		CacheTtl:         ctx.Duration("cache-ttl"),
+		MetricsPath:      ctx.String("metrics-path"),
+		ProgressInterval: ctx.Duration("progress-interval"),
+	}
 
 	lis, err := net.Listen("tcp", bind)
 	if err != nil {
@@ -82,68 +136,204 @@ func (sh *serveHttp) Action(ctx *cli.Context) error {
 	}
 
 	fmt.Println(lis.Addr().String())
+	logger := utils.ContextLogger(ctx.Context)
+	logger.Info("http server started", "addr", lis.Addr().String())
+
+	// Requests and background fetches must survive the interrupt signal to be drained gracefully,
+	// so they get a detached context, which is cancelled only when the drain timeout exceeds.
+	bgCtx, bgCancel := context.WithCancel(utils.ContextDetach(ctx.Context))
+	defer bgCancel()
+
+	if ctx.Bool("resume-fetches") {
+		resumeFetches(logger, sh.assets, bgCtx)
+	}
 
 	httpServer := &http.Server{
-		Handler: hm,
+		Handler: sh.handler(),
 		ConnContext: func(httpCtx context.Context, c net.Conn) context.Context {
 			// Save *current context* and feed it to Conn.
 			// Conn will wrap it with cancel that will fire when client disconnects.
 			// We are about to pop *current context* in some situations
 			// to bypass http request context, when we want to ignore client disconnects.
-			return utils.ContextPush(ctx.Context)
+			return utils.ContextPush(bgCtx)
 		},
 	}
 	closed := make(chan struct{})
 	go func() {
 		httpServerErr := httpServer.Serve(lis)
-		if httpServerErr != nil {
-			log.Println("error", "httpServerErr", httpServerErr)
+		if httpServerErr != nil && !errors.Is(httpServerErr, http.ErrServerClosed) {
+			logger.Error("http server failed", "err", httpServerErr)
 		}
 		close(closed)
 	}()
 
+	stops := []func(ctx context.Context) error{
+		func(ctx context.Context) (err error) {
+			err = httpServer.Shutdown(ctx)
+			if err != nil {
+				logger.Warn("http shutdown timed out, closing connections", "err", err)
+				err = httpServer.Close()
+			}
+			return
+		},
+	}
+
+	if grpcBind := ctx.String("grpc-bind"); grpcBind != "" {
+		grpcLis, grpcErr := net.Listen("tcp", grpcBind)
+		if grpcErr != nil {
+			return grpcErr
+		}
+		logger.Info("grpc server started", "addr", grpcLis.Addr().String())
+		grpcServer := newGrpcServer(sh.assets, bgCtx, defaultGrpcOptions)
+		go func() {
+			grpcServerErr := grpcServer.Serve(grpcLis)
+			if grpcServerErr != nil {
+				logger.Error("grpc server failed", "err", grpcServerErr)
+			}
+		}()
+		stops = append(stops, func(ctx context.Context) error {
+			return stopGrpc(ctx, logger, grpcServer)
+		})
+	}
+
 	select {
 	case <-ctx.Context.Done():
-		err = httpServer.Close()
+		err = shutdown(logger, sh.assets, bgCancel, ctx.Duration("shutdown-timeout"), stops...)
 	case <-closed:
 	}
 	return err
 }
 
+func (sh *serveHttp) handler() http.Handler {
+	hm := http.NewServeMux()
+
+	hm.HandleFunc("/describeByKey", sh.instrument("describeByKey", sh.describeByKey))
+	hm.HandleFunc("/getByKey", sh.instrument("getByKey", sh.getByKey))
+	hm.HandleFunc("/getByOriginalUrl", sh.instrument("getByOriginalUrl", sh.getByOriginalUrl))
+	hm.HandleFunc("/storeByOriginalUrl", sh.instrument("storeByOriginalUrl", sh.storeByOriginalUrl))
+	hm.HandleFunc("/store", sh.instrument("store", sh.store))
+	hm.HandleFunc("/deleteByKey", sh.instrument("deleteByKey", sh.deleteByKey))
+	hm.HandleFunc("/usage", sh.instrument("usage", sh.usage))
+	hm.HandleFunc("/fetchProgress", sh.instrument("fetchProgress", sh.fetchProgress))
+	hm.HandleFunc("/assets", sh.instrument("assets", sh.rest))
+	hm.HandleFunc("/assets/", sh.instrument("assets", sh.rest))
+	hm.HandleFunc("/healthz", sh.healthz)
+	hm.HandleFunc("/readyz", sh.instrument("readyz", sh.readyz))
+	hm.HandleFunc("/openapi.json", sh.openapi)
+	if sh.options.MetricsPath != "" {
+		hm.Handle(sh.options.MetricsPath, metrics.Default)
+	}
+	return hm
+}
+
 func (sh *serveHttp) describeByKey(w http.ResponseWriter, r *http.Request) {
 	q := r.URL.Query()
+	sh.describe(w, r, q.Get("assetKey"))
+}
+
+func (sh *serveHttp) describe(w http.ResponseWriter, r *http.Request, assetKey string) {
 	ctx := r.Context()
 	asset, err := sh.assets.DescribeByKey(
 		ctx,
-		q.Get("assetKey"),
+		assetKey,
 	)
-	sh.respondJson(w, asset, err)
+	sh.respondJson(w, r, asset, err)
 }
 
 func (sh *serveHttp) getByKey(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	sh.serveByKey(w, r, q.Get("assetKey"))
+}
+
+func (sh *serveHttp) serveByKey(w http.ResponseWriter, r *http.Request, assetKey string) {
 	if r.Header.Get("if-none-match") != "" {
 		w.WriteHeader(http.StatusNotModified)
 		return
 	}
-	q := r.URL.Query()
 	ctx := r.Context()
 	var err error
 	var rr *utils.Range
 	if headerRange := r.Header.Get("range"); headerRange != "" {
 		rr, err = utils.ParseHttpRangeHeader(headerRange)
 		if err != nil {
-			sh.respondJson(w, nil, err)
+			sh.respondJson(w, r, nil, err)
 			return
 		}
 	}
+	if r.Method == http.MethodHead {
+		asset, err := sh.assets.HeadByKey(
+			ctx,
+			assetKey,
+			rr,
+		)
+		sh.setVaryEncoding(w, r, asset)
+		sh.respondAsset(w, r, asset, nil, rr, err)
+		return
+	}
+	if rr == nil && r.Header.Get("accept-encoding") != "" {
+		// the stored compressed form is served as is if the client accepts it
+		asset, rc, encoding, size, err := sh.assets.GetEncodedByKey(
+			ctx,
+			assetKey,
+			acceptsEncoding(r.Header.Get("accept-encoding")),
+		)
+		if err == nil && encoding != "" {
+			w.Header().Set("content-encoding", encoding)
+			w.Header().Set("content-length", strconv.FormatInt(size, 10))
+		}
+		sh.setVaryEncoding(w, r, asset)
+		sh.respondAsset(w, r, asset, rc, nil, err)
+		return
+	}
 	asset, rc, err := sh.assets.GetByKey(
 		ctx,
-		q.Get("assetKey"),
+		assetKey,
 		rr,
 	)
+	sh.setVaryEncoding(w, r, asset)
 	sh.respondAsset(w, r, asset, rc, rr, err)
 }
 
+// setVaryEncoding sets Vary header if the asset is stored encoded,
+// since responses for it depend on Accept-Encoding of the request.
+func (sh *serveHttp) setVaryEncoding(w http.ResponseWriter, r *http.Request, asset *types.Asset) {
+	if asset == nil || asset.ContentHash == "" {
+		return
+	}
+	encoding, err := sh.assets.StoredEncoding(r.Context(), asset.ContentHash)
+	if err != nil {
+		utils.ContextLogger(r.Context()).Warn("find stored encoding failed", "err", err)
+		return
+	}
+	if encoding != "" {
+		w.Header().Add("vary", "accept-encoding")
+	}
+}
+
+// acceptsEncoding tells if the content coding is allowed by Accept-Encoding header value.
+func acceptsEncoding(header string) func(encoding string) bool {
+	return func(encoding string) bool {
+		accepted := false
+		for _, item := range strings.Split(header, ",") {
+			coding, params, _ := strings.Cut(strings.TrimSpace(item), ";")
+			coding = strings.ToLower(strings.TrimSpace(coding))
+			if coding != encoding && coding != "*" && !(coding == "x-gzip" && encoding == "gzip") {
+				continue
+			}
+			q := 1.0
+			if name, value, ok := strings.Cut(strings.TrimSpace(params), "="); ok && strings.TrimSpace(name) == "q" {
+				q, _ = strconv.ParseFloat(strings.TrimSpace(value), 64)
+			}
+			if coding != "*" {
+				// explicit coding overrides the wildcard
+				return q > 0
+			}
+			accepted = q > 0
+		}
+		return accepted
+	}
+}
+
 func (sh *serveHttp) getByOriginalUrl(w http.ResponseWriter, r *http.Request) {
 	if r.Header.Get("if-none-match") != "" {
 		w.WriteHeader(http.StatusNotModified)
@@ -156,10 +346,19 @@ func (sh *serveHttp) getByOriginalUrl(w http.ResponseWriter, r *http.Request) {
 	if headerRange := r.Header.Get("range"); headerRange != "" {
 		rr, err = utils.ParseHttpRangeHeader(headerRange)
 		if err != nil {
-			sh.respondJson(w, nil, err)
+			sh.respondJson(w, r, nil, err)
 			return
 		}
 	}
+	if r.Method == http.MethodHead {
+		asset, err := sh.assets.HeadByOriginalUrl(
+			ctx,
+			q.Get("originalUrl"),
+			rr,
+		)
+		sh.respondAsset(w, r, asset, nil, rr, err)
+		return
+	}
 	asset, rc, err := sh.assets.GetByOriginalUrl(
 		ctx,
 		q.Get("originalUrl"),
@@ -171,17 +370,21 @@ func (sh *serveHttp) getByOriginalUrl(w http.ResponseWriter, r *http.Request) {
 func (sh *serveHttp) storeByOriginalUrl(w http.ResponseWriter, r *http.Request) {
 	q := r.URL.Query()
 	wait := q.Get("wait") != ""
-	ctx := r.Context()
-	if !wait {
-		// Bypass http request context to ignore client disconnects
-		ctx = utils.ContextPop(ctx)
-	}
+	// The fetch outlives the request, so it runs in the server context ignoring client disconnects
+	ctx := service.ContextWithBackground(r.Context(), utils.ContextPop(r.Context()))
 	prepAsset, err := sh.assets.StoreByOriginalUrl(
 		ctx,
 		q.Get("originalUrl"),
+		q.Get("userId"),
 		wait,
 	)
-	sh.respondJson(w, prepAsset, err)
+	if wait && err == nil && prepAsset.Status != types.AssetStatus_done {
+		// too large to wait for, so point to the status instead
+		w.Header().Set("location", "/describeByKey?assetKey="+url.QueryEscape(prepAsset.AssetKey))
+		sh.writeJson(w, r, http.StatusAccepted, prepAsset, nil)
+		return
+	}
+	sh.respondJson(w, r, prepAsset, err)
 }
 
 func (sh *serveHttp) store(w http.ResponseWriter, r *http.Request) {
@@ -194,14 +397,14 @@ func (sh *serveHttp) store(w http.ResponseWriter, r *http.Request) {
 	case utils.ContextIsDebug(ctx):
 		data = strings.NewReader(q.Get("data"))
 	default:
-		sh.respondJson(w, nil, errors.New("invalid method"))
+		sh.respondJson(w, r, nil, service.NewError(service.ErrorCode_invalid, errors.New("invalid method")))
 		return
 	}
 	extra := &types.Asset{
 		Size:         r.ContentLength,
 		ContentType:  q.Get("contentType"),
 		OriginalName: q.Get("originalName"),
-		UserId:       "", // TODO
+		UserId:       q.Get("userId"),
 		OriginalUrl:  q.Get("originalUrl"),
 		StorageName:  "", // TODO
 		Info:         q.Get("info"),
@@ -211,30 +414,114 @@ func (sh *serveHttp) store(w http.ResponseWriter, r *http.Request) {
 		extra,
 		data,
 	)
-	sh.respondJson(w, asset, err)
+	sh.respondJson(w, r, asset, err)
 }
 
-func (sh *serveHttp) respondJson(w http.ResponseWriter, res any, err error) {
-	w.Header().Set("content-type", "application/json")
-	errStr := ""
+func (sh *serveHttp) deleteByKey(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	if r.Method != http.MethodPost && r.Method != http.MethodDelete && !utils.ContextIsDebug(r.Context()) {
+		sh.respondJson(w, r, nil, service.NewError(service.ErrorCode_invalid, errors.New("invalid method")))
+		return
+	}
+	sh.delete(w, r, q.Get("assetKey"))
+}
+
+func (sh *serveHttp) delete(w http.ResponseWriter, r *http.Request, assetKey string) {
+	ctx := r.Context()
+	asset, err := sh.assets.DeleteByKey(
+		ctx,
+		assetKey,
+	)
+	sh.respondJson(w, r, asset, err)
+}
+
+func (sh *serveHttp) usage(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	ctx := r.Context()
+	usage, err := sh.assets.Usage(
+		ctx,
+		q.Get("userId"),
+	)
+	sh.respondJson(w, r, usage, err)
+}
+
+// healthz is a liveness probe, so it doesn't check any dependency.
+func (sh *serveHttp) healthz(w http.ResponseWriter, r *http.Request) {
+	sh.respondJson(w, r, "ok", nil)
+}
+
+func (sh *serveHttp) readyz(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	readiness, err := sh.assets.Readiness(ctx)
 	if err != nil {
-		errStr = err.Error()
-		if errors.As(err, &errRangeError) {
-			w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
-		} else {
-			w.WriteHeader(http.StatusBadRequest)
+		sh.respondJson(w, r, nil, err)
+		return
+	}
+	status := http.StatusOK
+	if !readiness.Ready {
+		status = http.StatusServiceUnavailable
+	}
+	sh.writeJson(w, r, status, readiness, nil)
+}
+
+func (sh *serveHttp) respondJson(w http.ResponseWriter, r *http.Request, res any, err error) {
+	sh.writeJson(w, r, errorStatus(err), res, err)
+}
+
+// respondStatus responds without body, e.g. to HEAD requests.
+func (sh *serveHttp) respondStatus(w http.ResponseWriter, err error) {
+	w.WriteHeader(errorStatus(err))
+}
+
+func errorStatus(err error) int {
+	if err == nil {
+		return http.StatusOK
+	}
+	if errors.As(err, &errRangeError) {
+		return http.StatusRequestedRangeNotSatisfiable
+	}
+	switch service.ErrorCodeOf(err) {
+	case service.ErrorCode_notFound:
+		return http.StatusNotFound
+	case service.ErrorCode_forbidden:
+		return http.StatusForbidden
+	case service.ErrorCode_tooLarge:
+		return http.StatusRequestEntityTooLarge
+	case service.ErrorCode_conflict:
+		return http.StatusConflict
+	case service.ErrorCode_unavailable:
+		return http.StatusServiceUnavailable
+	case service.ErrorCode_invalid:
+		return http.StatusBadRequest
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+func (sh *serveHttp) writeJson(w http.ResponseWriter, r *http.Request, status int, res any, err error) {
+	w.Header().Set("content-type", "application/json")
+	if status != http.StatusOK {
+		w.WriteHeader(status)
+	}
+	if sw, ok := w.(*statusWriter); ok {
+		if asset, ok := res.(*types.Asset); ok && asset != nil {
+			sw.assetKey = asset.AssetKey
 		}
 	}
 	data := struct {
-		Res any    `json:"res"`
-		Err string `json:"err,omitempty"`
+		Res  any               `json:"res"`
+		Err  string            `json:"err,omitempty"`
+		Code service.ErrorCode `json:"code,omitempty"`
 	}{
 		Res: res,
-		Err: errStr,
+	}
+	if err != nil {
+		data.Err = err.Error()
+		data.Code = service.ErrorCodeOf(err)
 	}
 	respondErr := json.NewEncoder(w).Encode(data)
 	if respondErr != nil {
-		log.Println("error", "respondErr", respondErr)
+		utils.ContextLogger(r.Context()).Error("write json response failed", "err", respondErr)
 	}
 }
 
@@ -243,11 +530,14 @@ func (sh *serveHttp) respondAsset(w http.ResponseWriter, r *http.Request, asset
 		defer func() {
 			closeErr := closer.Close()
 			if closeErr != nil {
-				log.Println("error", "closeErr", closeErr)
+				utils.ContextLogger(r.Context()).Error("close asset reader failed", "err", closeErr)
 			}
 		}()
 	}
 	if asset != nil {
+		if sw, ok := w.(*statusWriter); ok {
+			sw.assetKey = asset.AssetKey
+		}
 		w.Header().Set("x-asset-btime", asset.Btime.Format(time.RFC3339Nano))
 		if asset.Mtime != nil {
 			w.Header().Set("x-asset-mtime", asset.Mtime.Format(time.RFC3339Nano))
@@ -266,43 +556,65 @@ func (sh *serveHttp) respondAsset(w http.ResponseWriter, r *http.Request, asset
 			return
 		}
 
-		sh.respondJson(w, nil, err)
+		if r.Method == http.MethodHead {
+			sh.respondStatus(w, err)
+			return
+		}
+		sh.respondJson(w, r, nil, err)
 		return
 	}
 	if asset.ContentType != "" {
 		w.Header().Set("content-type", asset.ContentType)
 	} else {
-		fallbackMimetype := sh.cliCtx.String("fallback-mimetype")
-		w.Header().Set("content-type", fallbackMimetype)
+		w.Header().Set("content-type", sh.options.FallbackMimetype)
 	}
 	if asset.OriginalName != "" {
 		w.Header().Set("content-disposition", fmt.Sprintf("inline; *filename='%s'", asset.OriginalName))
 	}
-	if asset.Size > 0 {
+	encoding := w.Header().Get("content-encoding")
+	if asset.Size > 0 && encoding == "" {
+		// ranges of the encoded form are not served
 		w.Header().Set("accept-ranges", "bytes")
 	}
-	cacheTtl := sh.cliCtx.Duration("cache-ttl")
+	cacheTtl := sh.options.CacheTtl
 	if cacheTtl > 0 {
 		w.Header().Set("cache-control", fmt.Sprintf("public, max-age=%d", uint64(cacheTtl/time.Second)))
 		w.Header().Set("expires", time.Now().Add(cacheTtl).UTC().Format(http.TimeFormat))
 		w.Header().Set("pragma", "cache")
-		if asset.ContentHash != "" {
-			w.Header().Set("etag", asset.ContentHash)
+	}
+	if asset.ContentHash != "" {
+		etag := asset.ContentHash
+		if encoding != "" {
+			// the encoded form is another representation, so it must not be mixed with the decoded one
+			etag += "-" + encoding
 		}
+		w.Header().Set("etag", etag)
 	}
+	kind := "full"
 	if rr == nil {
-		if asset.Size > 0 {
+		if encoding != "" {
+			// content-length of the encoded form is set by the caller
+			kind = "encoded"
+		} else if asset.Size > 0 {
 			w.Header().Set("content-length", strconv.FormatInt(asset.Size, 10))
 		}
 		w.WriteHeader(http.StatusOK)
 	} else {
+		kind = "range"
 		w.Header().Set("content-length", strconv.FormatInt(rr.Length(), 10))
 		w.Header().Set("content-range", rr.HttpHeader(asset.Size))
 		w.WriteHeader(http.StatusPartialContent)
 	}
 
-	_, writeErr := io.Copy(w, rc)
+	if rc == nil {
+		// HEAD request, contents are not opened
+		metricHttpAssetResponses.Inc("head")
+		return
+	}
+	written, writeErr := io.Copy(w, rc)
+	metricHttpAssetResponses.Inc(kind)
+	metricHttpServedBytes.Add(float64(written), kind)
 	if writeErr != nil {
-		log.Println("error", "writeErr", writeErr)
+		utils.ContextLogger(r.Context()).Warn("write asset response failed", "err", writeErr)
 	}
 }
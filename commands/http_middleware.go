@@ -0,0 +1,136 @@
+package commands
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/bbars/assets/service/metrics"
+	"github.com/bbars/assets/service/tracing"
+	"github.com/bbars/assets/utils"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	semconv "go.opentelemetry.io/otel/semconv/v1.17.0"
+)
+
+const requestIdLen = 16
+
+var (
+	metricHttpRequests = metrics.NewCounter(
+		"assets_http_requests_total",
+		"HTTP requests by handler and status code.",
+		"handler",
+		"code",
+	)
+	metricHttpRequestDuration = metrics.NewHistogram(
+		"assets_http_request_duration_seconds",
+		"HTTP request latencies by handler.",
+		nil,
+		"handler",
+	)
+	metricHttpResponseBytes = metrics.NewCounter(
+		"assets_http_response_bytes_total",
+		"Bytes written to HTTP responses by handler.",
+		"handler",
+	)
+	metricHttpAssetResponses = metrics.NewCounter(
+		"assets_http_asset_responses_total",
+		"Asset responses by kind (full, encoded, range or head).",
+		"kind",
+	)
+	metricHttpServedBytes = metrics.NewCounter(
+		"assets_http_served_bytes_total",
+		"Bytes of asset contents served by kind (full, encoded or range).",
+		"kind",
+	)
+)
+
+// instrument wraps the handler to collect metrics, trace the request, write access log
+// and attach a logger with request ID to the request context.
+func (sh *serveHttp) instrument(handler string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		requestId := r.Header.Get("x-request-id")
+		if requestId == "" {
+			requestId = utils.GenerateQid(requestIdLen)
+		}
+		w.Header().Set("x-request-id", requestId)
+		ctx, span := tracing.StartServer(
+			r.Context(),
+			r.Header,
+			"HTTP "+handler,
+			semconv.HTTPMethod(r.Method),
+			semconv.HTTPRoute(handler),
+			semconv.HTTPTarget(r.URL.RequestURI()),
+			attribute.String("http.request_id", requestId),
+		)
+		ctx = utils.ContextWithLogFields(ctx, "requestId", requestId)
+		r = r.WithContext(ctx)
+
+		sw := &statusWriter{
+			ResponseWriter: w,
+			assetKey:       r.URL.Query().Get("assetKey"),
+		}
+		defer func() {
+			duration := time.Since(start)
+			span.SetAttributes(semconv.HTTPStatusCode(sw.Status()))
+			if sw.Status() >= http.StatusInternalServerError {
+				span.SetStatus(codes.Error, http.StatusText(sw.Status()))
+			}
+			span.End()
+			metricHttpRequests.Inc(handler, strconv.Itoa(sw.Status()))
+			metricHttpRequestDuration.Observe(duration.Seconds(), handler)
+			metricHttpResponseBytes.Add(float64(sw.written), handler)
+
+			utils.ContextLogger(ctx).Info(
+				"access",
+				"method", r.Method,
+				"route", handler,
+				"assetKey", sw.assetKey,
+				"status", sw.Status(),
+				"bytes", sw.written,
+				"range", r.Header.Get("range"),
+				"duration", duration,
+				"client", r.RemoteAddr,
+			)
+		}()
+		next(sw, r)
+	}
+}
+
+// statusWriter remembers status code and number of bytes written to the response.
+type statusWriter struct {
+	http.ResponseWriter
+	status   int
+	written  int64
+	assetKey string
+}
+
+func (sw *statusWriter) WriteHeader(status int) {
+	if sw.status == 0 {
+		sw.status = status
+	}
+	sw.ResponseWriter.WriteHeader(status)
+}
+
+func (sw *statusWriter) Write(p []byte) (n int, err error) {
+	if sw.status == 0 {
+		sw.status = http.StatusOK
+	}
+	n, err = sw.ResponseWriter.Write(p)
+	sw.written += int64(n)
+	return
+}
+
+func (sw *statusWriter) Flush() {
+	if f, ok := sw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (sw *statusWriter) Status() int {
+	if sw.status == 0 {
+		return http.StatusOK
+	}
+	return sw.status
+}
@@ -0,0 +1,19 @@
+package commands
+
+import (
+	_ "embed"
+	"net/http"
+
+	"github.com/bbars/assets/utils"
+)
+
+//go:embed openapi.json
+var openapiJson []byte
+
+func (sh *serveHttp) openapi(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("content-type", "application/json")
+	_, err := w.Write(openapiJson)
+	if err != nil {
+		utils.ContextLogger(r.Context()).Error("write openapi response failed", "err", err)
+	}
+}
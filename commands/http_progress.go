@@ -0,0 +1,63 @@
+package commands
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/bbars/assets/service/types"
+	"github.com/bbars/assets/utils"
+)
+
+// fetchProgress streams the asset as Server-Sent Events every time its status or fetch progress changes,
+// the stream ends when the fetch is finished (done, failed or deleted).
+func (sh *serveHttp) fetchProgress(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	ctx := r.Context()
+	flusher, _ := w.(http.Flusher)
+	started := false
+	err := sh.assets.WatchByKey(ctx, q.Get("assetKey"), sh.options.ProgressInterval, func(asset *types.Asset) error {
+		if !started {
+			started = true
+			w.Header().Set("content-type", "text/event-stream")
+			w.Header().Set("cache-control", "no-cache")
+			w.Header().Set("x-accel-buffering", "no")
+			w.WriteHeader(http.StatusOK)
+		}
+		return writeEvent(w, flusher, "progress", asset)
+	})
+	if err == nil {
+		return
+	}
+	if !started {
+		sh.respondJson(w, r, nil, err)
+		return
+	}
+	if ctx.Err() != nil {
+		// client has gone
+		return
+	}
+	eventErr := writeEvent(w, flusher, "error", struct {
+		Err string `json:"err"`
+	}{
+		Err: err.Error(),
+	})
+	if eventErr != nil {
+		utils.ContextLogger(ctx).Warn("write progress event failed", "err", eventErr)
+	}
+}
+
+func writeEvent(w http.ResponseWriter, flusher http.Flusher, event string, data any) (err error) {
+	jsonData, err := json.Marshal(data)
+	if err != nil {
+		return
+	}
+	_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, jsonData)
+	if err != nil {
+		return
+	}
+	if flusher != nil {
+		flusher.Flush()
+	}
+	return
+}
@@ -0,0 +1,153 @@
+package commands
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bbars/assets/service/repository"
+	"github.com/bbars/assets/service/types"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type sseEvent struct {
+	event string
+	data  string
+}
+
+// readEvent reads the next Server-Sent Event, io.EOF means the stream is ended.
+func readEvent(r *bufio.Reader) (event sseEvent, err error) {
+	for {
+		var line string
+		line, err = r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimSuffix(line, "\n")
+		switch {
+		case line == "":
+			return
+		case strings.HasPrefix(line, "event: "):
+			event.event = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			event.data = strings.TrimPrefix(line, "data: ")
+		}
+	}
+}
+
+func (e sseEvent) asset(t *testing.T) *types.Asset {
+	asset := &types.Asset{}
+	require.NoError(t, json.Unmarshal([]byte(e.data), asset), "data: %s", e.data)
+	return asset
+}
+
+// failingRepo fails to get assets after the first ok calls.
+type failingRepo struct {
+	repository.Repository
+	ok int
+}
+
+func (r *failingRepo) GetByAssetKey(ctx context.Context, assetKey string) (asset *types.Asset, err error) {
+	if r.ok <= 0 {
+		err = errors.New("database is gone")
+		return
+	}
+	r.ok--
+	return r.Repository.GetByAssetKey(ctx, assetKey)
+}
+
+func TestFetchProgress(t *testing.T) {
+	ctx := context.Background()
+	assets := newTestAssets(t)
+	server := newTestHttpServer(t, assets, HttpOptions{ProgressInterval: 10 * time.Millisecond})
+	insertProcessing := func(t *testing.T) *types.Asset {
+		asset := &types.Asset{Btime: time.Now(), Status: types.AssetStatus_processing}
+		asset.GenerateAssetKey()
+		require.NoError(t, assets.Repo.Insert(ctx, asset))
+		return asset
+	}
+	openStream := func(t *testing.T, assetKey string) (res *http.Response, r *bufio.Reader) {
+		res, err := http.Get(server.URL + "/fetchProgress?assetKey=" + assetKey)
+		require.NoError(t, err)
+		t.Cleanup(func() { _ = res.Body.Close() })
+		return res, bufio.NewReader(res.Body)
+	}
+
+	t.Run("until done", func(t *testing.T) {
+		asset := insertProcessing(t)
+		res, r := openStream(t, asset.AssetKey)
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+		assert.Equal(t, "text/event-stream", res.Header.Get("content-type"))
+		assert.Equal(t, "no-cache", res.Header.Get("cache-control"))
+
+		event, err := readEvent(r)
+		require.NoError(t, err)
+		assert.Equal(t, "progress", event.event)
+		assert.Equal(t, types.AssetStatus_processing, event.asset(t).Status)
+
+		asset.Status = types.AssetStatus_done
+		asset.Size = 4
+		require.NoError(t, assets.Repo.Update(ctx, asset))
+		event, err = readEvent(r)
+		require.NoError(t, err)
+		assert.Equal(t, "progress", event.event)
+		assert.Equal(t, types.AssetStatus_done, event.asset(t).Status)
+		assert.Equal(t, int64(4), event.asset(t).Size)
+
+		_, err = readEvent(r)
+		assert.Equal(t, io.EOF, err, "stream ends when the fetch is done")
+	})
+
+	t.Run("already done", func(t *testing.T) {
+		asset, err := assets.Store(ctx, &types.Asset{}, strings.NewReader("data"))
+		require.NoError(t, err)
+		_, r := openStream(t, asset.AssetKey)
+		event, err := readEvent(r)
+		require.NoError(t, err)
+		assert.Equal(t, types.AssetStatus_done, event.asset(t).Status)
+		_, err = readEvent(r)
+		assert.Equal(t, io.EOF, err)
+	})
+
+	t.Run("unknown asset", func(t *testing.T) {
+		res, r := openStream(t, "unknown")
+		assert.Equal(t, http.StatusNotFound, res.StatusCode)
+		assert.Equal(t, "application/json", res.Header.Get("content-type"))
+		data, err := io.ReadAll(r)
+		require.NoError(t, err)
+		assert.NotContains(t, string(data), "event:")
+		envelope := struct {
+			Code string `json:"code"`
+		}{}
+		require.NoError(t, json.Unmarshal(data, &envelope))
+		assert.Equal(t, "not_found", envelope.Code)
+	})
+
+	t.Run("error after events", func(t *testing.T) {
+		asset := insertProcessing(t)
+		repo := assets.Repo
+		assets.Repo = &failingRepo{Repository: repo, ok: 1}
+		t.Cleanup(func() { assets.Repo = repo })
+		res, r := openStream(t, asset.AssetKey)
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+
+		event, err := readEvent(r)
+		require.NoError(t, err)
+		assert.Equal(t, "progress", event.event)
+		event, err = readEvent(r)
+		require.NoError(t, err)
+		assert.Equal(t, "error", event.event)
+		assert.Contains(t, event.data, `"err":`)
+		assert.Contains(t, event.data, "database is gone")
+
+		_, err = readEvent(r)
+		assert.Equal(t, io.EOF, err, "stream ends on error")
+	})
+}
@@ -0,0 +1,84 @@
+package commands
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/bbars/assets/service"
+	"github.com/bbars/assets/service/types"
+	"github.com/pkg/errors"
+)
+
+const restPrefix = "/assets"
+
+// rest routes path-based requests to the same handlers as RPC-style routes:
+//
+//	POST               /assets
+//	GET, HEAD, DELETE  /assets/{assetKey}
+//	GET, PUT           /assets/{assetKey}/meta
+//	GET, HEAD          /assets/{assetKey}/{originalName}
+func (sh *serveHttp) rest(w http.ResponseWriter, r *http.Request) {
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, restPrefix), "/")
+	var parts []string
+	if path != "" {
+		parts = strings.SplitN(path, "/", 2)
+	}
+
+	switch len(parts) {
+	case 0:
+		switch r.Method {
+		case http.MethodPost:
+			sh.store(w, r)
+			return
+		}
+	case 1:
+		assetKey := parts[0]
+		if sw, ok := w.(*statusWriter); ok {
+			sw.assetKey = assetKey
+		}
+		switch r.Method {
+		case http.MethodGet, http.MethodHead:
+			sh.serveByKey(w, r, assetKey)
+			return
+		case http.MethodDelete:
+			sh.delete(w, r, assetKey)
+			return
+		}
+	case 2:
+		assetKey := parts[0]
+		if sw, ok := w.(*statusWriter); ok {
+			sw.assetKey = assetKey
+		}
+		switch {
+		case parts[1] == "meta" && r.Method == http.MethodGet:
+			sh.describe(w, r, assetKey)
+			return
+		case parts[1] == "meta" && r.Method == http.MethodPut:
+			sh.updateMeta(w, r, assetKey)
+			return
+		case r.Method == http.MethodGet || r.Method == http.MethodHead:
+			// originalName is cosmetic: it makes browsers and CDNs derive the file name from the path
+			sh.serveByKey(w, r, assetKey)
+			return
+		}
+	}
+
+	sh.writeJson(w, r, http.StatusMethodNotAllowed, nil, service.NewError(service.ErrorCode_invalid, errors.New("invalid method or path")))
+}
+
+func (sh *serveHttp) updateMeta(w http.ResponseWriter, r *http.Request, assetKey string) {
+	ctx := r.Context()
+	meta := &types.AssetMeta{}
+	err := json.NewDecoder(r.Body).Decode(meta)
+	if err != nil {
+		sh.respondJson(w, r, nil, service.NewError(service.ErrorCode_invalid, errors.Wrap(err, "decode asset meta")))
+		return
+	}
+	asset, err := sh.assets.UpdateMetaByKey(
+		ctx,
+		assetKey,
+		meta,
+	)
+	sh.respondJson(w, r, asset, err)
+}
@@ -0,0 +1,339 @@
+package commands
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bbars/assets/service"
+	"github.com/bbars/assets/service/storage"
+	"github.com/bbars/assets/service/types"
+	"github.com/bbars/assets/utils"
+	"github.com/klauspost/compress/zstd"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAcceptsEncoding(t *testing.T) {
+	tests := []struct {
+		header   string
+		encoding string
+		want     bool
+	}{
+		{header: "gzip, deflate, br", encoding: "gzip", want: true},
+		{header: "gzip, deflate, br", encoding: "zstd", want: false},
+		{header: "zstd;q=0.5, gzip", encoding: "zstd", want: true},
+		{header: "ZSTD", encoding: "zstd", want: true},
+		{header: "zstd;q=0", encoding: "zstd", want: false},
+		{header: "x-gzip", encoding: "gzip", want: true},
+		{header: "*", encoding: "zstd", want: true},
+		{header: "*, zstd;q=0", encoding: "zstd", want: false},
+		{header: "identity", encoding: "gzip", want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.header+" "+tt.encoding, func(t *testing.T) {
+			assert.Equal(t, tt.want, acceptsEncoding(tt.header)(tt.encoding))
+		})
+	}
+}
+
+func TestServeEncoded(t *testing.T) {
+	assets := newTestAssets(t)
+	assets.Storage = &storage.CompressedStorage{
+		Dir:          assets.Storage.(*storage.DirStorage),
+		Codec:        storage.CompressionZstd,
+		FrameSize:    1024,
+		ContentTypes: storage.DefaultCompressedContentTypes,
+	}
+	text := strings.Repeat("compressible text of the asset\n", 200)
+	asset, err := assets.Store(context.Background(), &types.Asset{}, strings.NewReader(text))
+	require.NoError(t, err)
+	server := httptest.NewServer(NewHttpHandler(assets, HttpOptions{}))
+	t.Cleanup(server.Close)
+
+	tests := []struct {
+		name           string
+		header         http.Header
+		wantEncoding   string
+		wantStatusCode int
+		wantData       string
+	}{
+		{
+			name:           "accepted",
+			header:         http.Header{"Accept-Encoding": {"gzip, zstd"}},
+			wantEncoding:   storage.CompressionZstd,
+			wantStatusCode: http.StatusOK,
+			wantData:       text,
+		},
+		{
+			name:           "not accepted",
+			header:         http.Header{"Accept-Encoding": {"gzip"}},
+			wantStatusCode: http.StatusOK,
+			wantData:       text,
+		},
+		{
+			name:           "no accept-encoding",
+			header:         http.Header{},
+			wantStatusCode: http.StatusOK,
+			wantData:       text,
+		},
+		{
+			name:           "range",
+			header:         http.Header{"Accept-Encoding": {"zstd"}, "Range": {"bytes=1000-1099"}},
+			wantStatusCode: http.StatusPartialContent,
+			wantData:       text[1000:1100],
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodGet, server.URL+"/getByKey?assetKey="+asset.AssetKey, nil)
+			require.NoError(t, err)
+			req.Header = tt.header
+			// the transport must not decode the response itself
+			res, err := (&http.Transport{DisableCompression: true}).RoundTrip(req)
+			require.NoError(t, err)
+			defer res.Body.Close()
+			assert.Equal(t, tt.wantStatusCode, res.StatusCode)
+			assert.Equal(t, tt.wantEncoding, res.Header.Get("content-encoding"))
+			// the response depends on Accept-Encoding whatever form is served
+			assert.Equal(t, "accept-encoding", res.Header.Get("vary"))
+			if tt.wantEncoding != "" {
+				assert.Equal(t, asset.ContentHash+"-"+tt.wantEncoding, res.Header.Get("etag"))
+				assert.Empty(t, res.Header.Get("accept-ranges"))
+			} else {
+				assert.Equal(t, asset.ContentHash, res.Header.Get("etag"))
+				assert.Equal(t, "bytes", res.Header.Get("accept-ranges"))
+			}
+			body, err := io.ReadAll(res.Body)
+			require.NoError(t, err)
+			assert.Equal(t, strconv.Itoa(len(body)), res.Header.Get("content-length"))
+
+			if tt.wantEncoding != "" {
+				assert.Less(t, len(body), len(text))
+				zr, err := zstd.NewReader(bytes.NewReader(body))
+				require.NoError(t, err)
+				defer zr.Close()
+				body, err = io.ReadAll(zr)
+				require.NoError(t, err)
+			}
+			assert.Equal(t, tt.wantData, string(body))
+		})
+	}
+
+	// responses for a blob stored as is don't depend on Accept-Encoding
+	plainAsset, err := assets.Store(context.Background(), &types.Asset{}, strings.NewReader("short"))
+	require.NoError(t, err)
+	res, err := http.Get(server.URL + "/getByKey?assetKey=" + plainAsset.AssetKey)
+	require.NoError(t, err)
+	require.NoError(t, res.Body.Close())
+	assert.Empty(t, res.Header.Get("vary"))
+}
+
+// newTestHttpServer serves the assets with the server context pushed the way the http command does.
+func newTestHttpServer(t *testing.T, assets *service.Assets, options HttpOptions) *httptest.Server {
+	server := httptest.NewUnstartedServer(NewHttpHandler(assets, options))
+	server.Config.ConnContext = func(ctx context.Context, c net.Conn) context.Context {
+		return utils.ContextPush(context.Background())
+	}
+	server.Start()
+	t.Cleanup(server.Close)
+	return server
+}
+
+// storeByOriginalUrlHttp calls storeByOriginalUrl route and decodes the responded asset.
+func storeByOriginalUrlHttp(t *testing.T, client *http.Client, serverUrl string, originalUrl string, wait bool) (res *http.Response, asset *types.Asset) {
+	q := url.Values{"originalUrl": {originalUrl}}
+	if wait {
+		q.Set("wait", "1")
+	}
+	res, err := client.Get(serverUrl + "/storeByOriginalUrl?" + q.Encode())
+	require.NoError(t, err)
+	defer res.Body.Close()
+	envelope := struct {
+		Res *types.Asset `json:"res"`
+	}{}
+	require.NoError(t, json.NewDecoder(res.Body).Decode(&envelope))
+	return res, envelope.Res
+}
+
+func TestStoreByOriginalUrlQueued(t *testing.T) {
+	assets := newTestAssets(t)
+	assets.Config.FetchMaxConnections = 1
+	slowRelease := make(chan struct{})
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			w.Header().Set("content-length", "4")
+			w.WriteHeader(http.StatusOK)
+			w.(http.Flusher).Flush()
+			<-slowRelease
+		}
+		_, _ = io.WriteString(w, r.URL.Path[1:5])
+	}))
+	t.Cleanup(origin.Close)
+	server := newTestHttpServer(t, assets, HttpOptions{})
+	client := &http.Client{Timeout: 5 * time.Second}
+
+	_, slow := storeByOriginalUrlHttp(t, client, server.URL, origin.URL+"/slow", false)
+	require.NotNil(t, slow)
+
+	// the only connection to the host is taken by the slow fetch, so this one is queued
+	start := time.Now()
+	res, queued := storeByOriginalUrlHttp(t, client, server.URL, origin.URL+"/fast", false)
+	assert.Less(t, time.Since(start), time.Second, "queued fetch must not block the caller")
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	require.NotNil(t, queued)
+	assert.Equal(t, types.AssetStatus_processing, queued.Status)
+
+	close(slowRelease)
+	for _, asset := range []*types.Asset{slow, queued} {
+		assert.Eventually(t, func() bool {
+			asset, err := assets.DescribeByKey(context.Background(), asset.AssetKey)
+			return err == nil && asset.Status == types.AssetStatus_done && asset.Error == "" && asset.Size == 4
+		}, 5*time.Second, 10*time.Millisecond)
+	}
+}
+
+func TestStoreByOriginalUrlWait(t *testing.T) {
+	assets := newTestAssets(t)
+	assets.Config.MaxRemoteWaitSize = 10
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/known":
+			_, _ = io.WriteString(w, "small")
+		case "/large":
+			_, _ = io.WriteString(w, "larger than the limit")
+		case "/unknown":
+			// flushed before writing, so the size is unknown (chunked)
+			w.(http.Flusher).Flush()
+			_, _ = io.WriteString(w, "small")
+		}
+	}))
+	t.Cleanup(origin.Close)
+	server := newTestHttpServer(t, assets, HttpOptions{})
+	client := &http.Client{Timeout: 5 * time.Second}
+
+	tests := []struct {
+		path       string
+		wantStatus int
+		wantSize   int64
+	}{
+		{path: "/known", wantStatus: http.StatusOK, wantSize: 5},
+		{path: "/large", wantStatus: http.StatusAccepted, wantSize: 21},
+		{path: "/unknown", wantStatus: http.StatusAccepted, wantSize: 5},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			res, asset := storeByOriginalUrlHttp(t, client, server.URL, origin.URL+tt.path, true)
+			assert.Equal(t, tt.wantStatus, res.StatusCode)
+			require.NotNil(t, asset)
+			if tt.wantStatus == http.StatusOK {
+				assert.Equal(t, types.AssetStatus_done, asset.Status)
+				assert.Equal(t, tt.wantSize, asset.Size)
+				assert.Empty(t, res.Header.Get("location"))
+				return
+			}
+			assert.Equal(t, types.AssetStatus_processing, asset.Status)
+			assert.Equal(t, "/describeByKey?assetKey="+url.QueryEscape(asset.AssetKey), res.Header.Get("location"))
+			assert.Eventually(t, func() bool {
+				asset, err := assets.DescribeByKey(context.Background(), asset.AssetKey)
+				return err == nil && asset.Status == types.AssetStatus_done && asset.Size == tt.wantSize
+			}, 5*time.Second, 10*time.Millisecond)
+		})
+	}
+}
+
+func TestStoreByOriginalUrlClientGone(t *testing.T) {
+	assets := newTestAssets(t)
+	originRelease := make(chan struct{})
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("content-length", "4")
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		<-originRelease
+		_, _ = io.WriteString(w, "slow")
+	}))
+	t.Cleanup(origin.Close)
+	handled := make(chan struct{})
+	server := newTestHttpServer(t, assets, HttpOptions{})
+	handler := server.Config.Handler
+	server.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handler.ServeHTTP(w, r)
+		close(handled)
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	q := url.Values{"originalUrl": {origin.URL + "/slow"}, "wait": {"1"}}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, server.URL+"/storeByOriginalUrl?"+q.Encode(), nil)
+	require.NoError(t, err)
+	_, err = http.DefaultClient.Do(req)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+
+	// the disconnect releases the handler waiting for the fetch
+	select {
+	case <-handled:
+	case <-time.After(time.Second):
+		t.Fatal("handler is not released by the client disconnect")
+	}
+
+	// but the fetch goes on
+	close(originRelease)
+	assert.Eventually(t, func() bool {
+		asset, err := assets.HeadByOriginalUrl(context.Background(), origin.URL+"/slow", nil)
+		return err == nil && asset.Status == types.AssetStatus_done && asset.Error == "" && asset.Size == 4
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestGetByOriginalUrlFetch(t *testing.T) {
+	assets := newTestAssets(t)
+	large := strings.Repeat("remote contents\n", 100000)
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/missing":
+			w.WriteHeader(http.StatusNotFound)
+		case "/large":
+			_, _ = io.WriteString(w, large)
+		}
+	}))
+	t.Cleanup(origin.Close)
+	server := newTestHttpServer(t, assets, HttpOptions{})
+
+	t.Run("failed before the body", func(t *testing.T) {
+		asset, rc, err := assets.GetByOriginalUrl(context.Background(), origin.URL+"/missing", nil)
+		assert.Error(t, err)
+		assert.Nil(t, asset)
+		assert.Nil(t, rc)
+
+		res, err := http.Get(server.URL + "/getByOriginalUrl?originalUrl=" + url.QueryEscape(origin.URL+"/missing?again"))
+		require.NoError(t, err)
+		require.NoError(t, res.Body.Close())
+		assert.NotEqual(t, http.StatusOK, res.StatusCode)
+	})
+
+	t.Run("reader is gone", func(t *testing.T) {
+		asset, rc, err := assets.GetByOriginalUrl(context.Background(), origin.URL+"/large", nil)
+		require.NoError(t, err)
+		_, err = io.ReadFull(rc, make([]byte, 10))
+		require.NoError(t, err)
+		require.NoError(t, rc.Close())
+
+		// the fetch goes on without the reader
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		require.NoError(t, assets.Drain(ctx))
+		asset, err = assets.DescribeByKey(context.Background(), asset.AssetKey)
+		require.NoError(t, err)
+		assert.Equal(t, types.AssetStatus_done, asset.Status)
+		assert.Empty(t, asset.Error)
+		assert.Equal(t, int64(len(large)), asset.Size)
+	})
+}
@@ -26,8 +26,8 @@ type migrate struct {
 	cliCtx    *cli.Context
 }
 
-func (m *migrate) Action(_ *cli.Context) (err error) {
-	err = m.assetRepo.Migrate()
+func (m *migrate) Action(ctx *cli.Context) (err error) {
+	err = m.assetRepo.Migrate(ctx.Context)
 	if err != nil {
 		err = errors.Wrap(err, "unable to migrate db")
 		return
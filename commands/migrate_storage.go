@@ -0,0 +1,132 @@
+package commands
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+
+	"github.com/bbars/assets/service"
+	"github.com/bbars/assets/service/storage"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli/v2"
+)
+
+func NewMigrateStorageCommand(initAssets InitAssets) *cli.Command {
+	m := migrateStorage{
+		assets: nil,
+	}
+	return &cli.Command{
+		Name:   "migrate-storage",
+		Usage:  "Copy blobs of stored assets to another storage directory or layout",
+		Action: m.Action,
+		Before: func(ctx *cli.Context) (err error) {
+			m.assets, err = initAssets(ctx)
+			return
+		},
+		Flags: append([]cli.Flag{
+			&cli.StringFlag{
+				Name:    "target-dir",
+				Aliases: []string{"t"},
+				Usage:   "Directory of the target storage (the storage directory by default, to change path depth in place).",
+			},
+			&cli.UintFlag{
+				Name:  "target-path-depth",
+				Usage: "Directory tree depth of the target storage (the storage one by default).",
+			},
+			&cli.StringFlag{
+				Name:  "target-storage-name",
+				Usage: "Storage name to set to migrated assets (kept if not set).",
+			},
+			&cli.BoolFlag{
+				Name:  "remove-source",
+				Usage: "Remove blobs from the storage after they are copied.",
+			},
+		}, blobFlags...),
+	}
+}
+
+type migrateStorage struct {
+	assets *service.Assets
+}
+
+func (m *migrateStorage) Action(ctx *cli.Context) (err error) {
+	target, err := m.target(ctx)
+	if err != nil {
+		return
+	}
+	err = processBlobs(ctx, m.assets, func(processCtx context.Context, contentHash string) (changed bool, err error) {
+		return m.assets.MigrateBlob(
+			processCtx,
+			target,
+			ctx.String("target-storage-name"),
+			contentHash,
+			ctx.Bool("remove-source"),
+		)
+	})
+	return
+}
+
+// target builds the target storage, settings missing in flags are taken from the storage
+// (including compression, encryption and chunking, which are applied to copied blobs).
+func (m *migrateStorage) target(ctx *cli.Context) (target storage.Storage, err error) {
+	targetDir := &storage.DirStorage{
+		Dir:       ctx.String("target-dir"),
+		PathDepth: uint8(ctx.Uint("target-path-depth")),
+		DirPerm:   0755,
+		FilePerm:  0644,
+	}
+	target = targetDir
+	source, ok := m.assets.Storage.(*storage.DirStorage)
+	if compressed, isCompressed := m.assets.Storage.(*storage.CompressedStorage); isCompressed {
+		source, ok = compressed.Dir, true
+		targetCompressed := *compressed
+		targetCompressed.Dir = targetDir
+		target = &targetCompressed
+	}
+	if encrypted, isEncrypted := m.assets.Storage.(*storage.EncryptedStorage); isEncrypted {
+		source, ok = encrypted.Dir, true
+		targetEncrypted := *encrypted
+		targetEncrypted.Dir = targetDir
+		targetEncrypted.Plain = nil
+		target = &targetEncrypted
+	}
+	if chunked, isChunked := m.assets.Storage.(*storage.ChunkedStorage); isChunked {
+		source, ok = chunked.Dir, true
+		targetChunked := *chunked
+		targetChunked.Dir = targetDir
+		targetChunked.Plain = nil
+		target = &targetChunked
+	}
+	if ok {
+		if !ctx.IsSet("target-dir") {
+			targetDir.Dir = source.Dir
+		}
+		if !ctx.IsSet("target-path-depth") {
+			targetDir.PathDepth = source.PathDepth
+		}
+		targetDir.DirPerm = source.DirPerm
+		targetDir.FilePerm = source.FilePerm
+	}
+	if targetDir.Dir == "" {
+		err = errors.New("target-dir flag is required")
+		return
+	}
+	if ok && filepath.Clean(targetDir.Dir) == filepath.Clean(source.Dir) {
+		switch {
+		case targetDir.PathDepth == source.PathDepth:
+			err = errors.New("target storage is the same as the source one")
+			return
+		case targetDir.PathDepth > source.PathDepth:
+			// blobs would be found where they are, so nothing would be moved
+			err = errors.New("path depth can't be increased in place, migrate to another directory instead")
+			return
+		}
+	}
+
+	err = os.MkdirAll(targetDir.Dir, targetDir.DirPerm)
+	if err != nil {
+		err = errors.Wrap(err, "create target directory")
+		return
+	}
+	return
+}
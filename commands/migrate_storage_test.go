@@ -0,0 +1,105 @@
+package commands
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/bbars/assets/service"
+	"github.com/bbars/assets/service/storage"
+	"github.com/bbars/assets/service/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/urfave/cli/v2"
+)
+
+func TestMigrateStorage(t *testing.T) {
+	ctx := context.Background()
+	newDir := filepath.Join(t.TempDir(), "new")
+
+	tests := []struct {
+		name      string
+		args      []string
+		target    func(source *storage.DirStorage) *storage.DirStorage
+		wantName  string
+		wantError bool
+	}{
+		{
+			name: "to new directory",
+			args: []string{"-t", newDir, "--target-path-depth", "1", "--target-storage-name", "new", "--remove-source", "-j", "2"},
+			target: func(source *storage.DirStorage) *storage.DirStorage {
+				return &storage.DirStorage{Dir: newDir, PathDepth: 1}
+			},
+			wantName: "new",
+		},
+		{
+			name: "shallower in place",
+			args: []string{"--target-path-depth", "0", "--remove-source"},
+			target: func(source *storage.DirStorage) *storage.DirStorage {
+				return &storage.DirStorage{Dir: source.Dir, PathDepth: 0}
+			},
+			wantName: "old",
+		},
+		{
+			name:      "deeper in place",
+			args:      []string{"--target-path-depth", "3", "--remove-source"},
+			wantError: true,
+		},
+		{
+			name:      "same storage",
+			args:      []string{"--target-path-depth", "2"},
+			wantError: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assets := newTestAssets(t)
+			assets.Config.StorageName = "old"
+			source := assets.Storage.(*storage.DirStorage)
+			var keys, sourcePaths []string
+			for _, data := range []string{"first", "second", "second"} {
+				asset, err := assets.Store(ctx, &types.Asset{}, bytes.NewReader([]byte(data)))
+				require.NoError(t, err)
+				keys = append(keys, asset.AssetKey)
+				path, err := source.Path(asset.ContentHash)
+				require.NoError(t, err)
+				sourcePaths = append(sourcePaths, path)
+			}
+			run := func() error {
+				app := &cli.App{
+					Commands: []*cli.Command{
+						NewMigrateStorageCommand(func(ctx *cli.Context) (*service.Assets, error) { return assets, nil }),
+					},
+				}
+				return app.Run(append([]string{"assets", "migrate-storage"}, tt.args...))
+			}
+			if tt.wantError {
+				assert.Error(t, run())
+				return
+			}
+			require.NoError(t, run())
+			// resumed migration has nothing to copy
+			require.NoError(t, run())
+
+			target := tt.target(source)
+			for i, want := range []string{"first", "second", "second"} {
+				asset, err := assets.DescribeByKey(ctx, keys[i])
+				require.NoError(t, err)
+				assert.Equal(t, tt.wantName, asset.StorageName)
+
+				rc, err := target.OpenRead(ctx, asset.ContentHash, nil)
+				require.NoError(t, err)
+				data, err := io.ReadAll(rc)
+				require.NoError(t, rc.Close())
+				require.NoError(t, err)
+				assert.Equal(t, want, string(data))
+
+				_, err = os.Stat(sourcePaths[i])
+				assert.True(t, os.IsNotExist(err), "source blob is removed")
+			}
+		})
+	}
+}
@@ -0,0 +1,37 @@
+package commands
+
+import (
+	"github.com/bbars/assets/service"
+	"github.com/bbars/assets/service/storage"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli/v2"
+)
+
+func NewRekeyCommand(initAssets InitAssets) *cli.Command {
+	r := rekey{
+		assets: nil,
+	}
+	return &cli.Command{
+		Name:   "rekey",
+		Usage:  "Encrypt blobs of stored assets by the current key of the keyfile",
+		Action: r.Action,
+		Before: func(ctx *cli.Context) (err error) {
+			r.assets, err = initAssets(ctx)
+			return
+		},
+		Flags: blobFlags,
+	}
+}
+
+type rekey struct {
+	assets *service.Assets
+}
+
+func (r *rekey) Action(ctx *cli.Context) (err error) {
+	if _, ok := r.assets.Storage.(storage.Rekeyer); !ok {
+		err = errors.New("encryption-keyfile flag is required")
+		return
+	}
+	err = processBlobs(ctx, r.assets, r.assets.RekeyBlob)
+	return
+}
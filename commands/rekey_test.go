@@ -0,0 +1,73 @@
+package commands
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"io"
+	"testing"
+
+	"github.com/bbars/assets/service"
+	"github.com/bbars/assets/service/storage"
+	"github.com/bbars/assets/service/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/urfave/cli/v2"
+)
+
+func TestRekey(t *testing.T) {
+	ctx := context.Background()
+	key := func(b byte) string {
+		return base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{b}, 32))
+	}
+	run := func(assets *service.Assets) error {
+		app := &cli.App{
+			Commands: []*cli.Command{
+				NewRekeyCommand(func(ctx *cli.Context) (*service.Assets, error) { return assets, nil }),
+			},
+		}
+		return app.Run([]string{"assets", "rekey", "-j", "2"})
+	}
+
+	t.Run("without encryption", func(t *testing.T) {
+		assert.Error(t, run(newTestAssets(t)))
+	})
+
+	t.Run("rotated key", func(t *testing.T) {
+		assets := newTestAssets(t)
+		dir := assets.Storage.(*storage.DirStorage)
+		plainAsset, err := assets.Store(ctx, &types.Asset{}, bytes.NewReader([]byte("stored before encryption")))
+		require.NoError(t, err)
+
+		keyring, err := storage.ParseKeyring([]byte(`{"current":"k1","keys":{"k1":"` + key(1) + `"}}`))
+		require.NoError(t, err)
+		encrypted := &storage.EncryptedStorage{
+			Dir:       dir,
+			Keys:      keyring,
+			ChunkSize: 8,
+			Plain:     dir,
+		}
+		assets.Storage = encrypted
+		encryptedAsset, err := assets.Store(ctx, &types.Asset{}, bytes.NewReader([]byte("stored encrypted")))
+		require.NoError(t, err)
+
+		encrypted.Keys, err = storage.ParseKeyring([]byte(`{"current":"k2","keys":{"k1":"` + key(1) + `","k2":"` + key(2) + `"}}`))
+		require.NoError(t, err)
+		require.NoError(t, run(assets))
+
+		_, err = dir.Path(plainAsset.ContentHash)
+		assert.Error(t, err, "unencrypted blob is removed")
+
+		// blobs are readable by the current key only
+		encrypted.Keys, err = storage.ParseKeyring([]byte(`{"current":"k2","keys":{"k2":"` + key(2) + `"}}`))
+		require.NoError(t, err)
+		for want, asset := range map[string]*types.Asset{"stored before encryption": plainAsset, "stored encrypted": encryptedAsset} {
+			rc, err := encrypted.OpenRead(ctx, asset.ContentHash, nil)
+			require.NoError(t, err)
+			data, err := io.ReadAll(rc)
+			require.NoError(t, rc.Close())
+			require.NoError(t, err)
+			assert.Equal(t, want, string(data))
+		}
+	})
+}
@@ -0,0 +1,42 @@
+package commands
+
+import (
+	"github.com/bbars/assets/service"
+	"github.com/bbars/assets/utils"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli/v2"
+)
+
+func NewRestoreCommand(initAssets InitAssets) *cli.Command {
+	r := restore{
+		assets: nil,
+	}
+	return &cli.Command{
+		Name:      "restore",
+		Usage:     "Replace metadata and restore missing blobs from a backup",
+		ArgsUsage: "<backupDir>",
+		Action:    r.Action,
+		Before: func(ctx *cli.Context) (err error) {
+			r.assets, err = initAssets(ctx)
+			return
+		},
+	}
+}
+
+type restore struct {
+	assets *service.Assets
+}
+
+func (r *restore) Action(ctx *cli.Context) (err error) {
+	if ctx.NArg() != 1 {
+		err = errors.New("exactly one backup directory expected")
+		return
+	}
+
+	restored, err := r.assets.Restore(ctx.Context, ctx.Args().First())
+	if err != nil {
+		return
+	}
+	utils.ContextLogger(ctx.Context).Info("restore done", "restoredBlobs", restored)
+	return
+}
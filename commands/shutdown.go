@@ -0,0 +1,60 @@
+package commands
+
+import (
+	"context"
+	"time"
+
+	"github.com/bbars/assets/service"
+	"github.com/bbars/assets/utils"
+)
+
+// resumeFetches restarts fetches by original URL left unfinished on previous shutdown.
+func resumeFetches(logger *utils.Logger, assets *service.Assets, bgCtx context.Context) {
+	resumed, err := assets.ResumeFetches(bgCtx)
+	if err != nil {
+		logger.Error("resume unfinished fetches failed", "err", err)
+	} else if resumed > 0 {
+		logger.Info("resuming unfinished fetches", "count", resumed)
+	}
+}
+
+// shutdown stops servers and waits for active requests and background fetches.
+// Each stop function must give up when the timeout exceeds, in which case fetches are cancelled
+// (unfinished fetches are saved to be resumed on next start).
+func shutdown(logger *utils.Logger, assets *service.Assets, bgCancel context.CancelFunc, timeout time.Duration, stops ...func(ctx context.Context) error) (err error) {
+	logger.Info("shutting down", "drainTimeout", timeout)
+	drainCtx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	drainErrCh := make(chan error, 1)
+	go func() {
+		drainErrCh <- assets.Drain(drainCtx)
+	}()
+
+	stopErrCh := make(chan error, len(stops))
+	for _, stop := range stops {
+		go func(stop func(ctx context.Context) error) {
+			stopErrCh <- stop(drainCtx)
+		}(stop)
+	}
+	for range stops {
+		stopErr := <-stopErrCh
+		if stopErr != nil && err == nil {
+			err = stopErr
+		}
+	}
+
+	drainErr := <-drainErrCh
+	if drainErr != nil {
+		logger.Warn("drain timed out, cancelling background fetches", "err", drainErr)
+		bgCancel()
+		// let cancelled fetches save their state
+		saveCtx, saveCancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer saveCancel()
+		drainErr = assets.Drain(saveCtx)
+		if drainErr != nil {
+			logger.Error("cancelled fetches didn't finish", "err", drainErr)
+		}
+	}
+	return
+}
@@ -0,0 +1,45 @@
+package commands
+
+import (
+	"encoding/json"
+	"os"
+
+	"github.com/bbars/assets/service"
+	"github.com/bbars/assets/service/storage"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli/v2"
+)
+
+func NewStorageStatsCommand(initAssets InitAssets) *cli.Command {
+	s := storageStats{
+		assets:  nil,
+		jsonOut: json.NewEncoder(os.Stdout),
+	}
+	return &cli.Command{
+		Name:   "storage-stats",
+		Usage:  "Show size of chunked blobs, size of stored chunks and deduplication ratio",
+		Action: s.Action,
+		Before: func(ctx *cli.Context) (err error) {
+			s.assets, err = initAssets(ctx)
+			return
+		},
+	}
+}
+
+type storageStats struct {
+	assets  *service.Assets
+	jsonOut *json.Encoder
+}
+
+func (s *storageStats) Action(ctx *cli.Context) (err error) {
+	if _, ok := s.assets.Storage.(storage.StatsReporter); !ok {
+		err = errors.New("chunking flag is required")
+		return
+	}
+	stats, err := s.assets.StorageStats(ctx.Context)
+	if err != nil {
+		return
+	}
+	err = s.jsonOut.Encode(stats)
+	return
+}
@@ -0,0 +1,247 @@
+package commands
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path"
+	"path/filepath"
+	"sync"
+
+	"github.com/bbars/assets/service/repository"
+	"github.com/bbars/assets/service/types"
+	"github.com/bbars/assets/utils"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli/v2"
+)
+
+func NewStoreDirCommand(initAssets InitAssets) *cli.Command {
+	sd := storeDir{
+		storeFile: storeFile{
+			assets:  nil,
+			jsonOut: json.NewEncoder(os.Stdout),
+		},
+	}
+	return &cli.Command{
+		Name:   "storedir",
+		Usage:  "Store files of directories recursively",
+		Action: sd.Action,
+		Before: func(ctx *cli.Context) (err error) {
+			sd.assets, err = initAssets(ctx)
+			return
+		},
+		Flags: append([]cli.Flag{
+			&cli.StringFlag{
+				Name:    "user-id",
+				Aliases: []string{"user"},
+				Usage:   "value for asset's user_id field",
+			},
+			&cli.StringSliceFlag{
+				Name:  "include",
+				Usage: "Glob pattern of files to store, matched against relative path or base name (all files if not set).",
+			},
+			&cli.StringSliceFlag{
+				Name:  "exclude",
+				Usage: "Glob pattern of files and directories to skip, matched against relative path or base name.",
+			},
+			&cli.BoolFlag{
+				Name:  "follow-symlinks",
+				Usage: "Follow symbolic links to files and directories (otherwise they are skipped).",
+			},
+			&cli.StringFlag{
+				Name:  "manifest",
+				Usage: "File to write JSON object mapping paths of stored files to asset keys.",
+			},
+		}, batchFlags...),
+	}
+}
+
+type storeDir struct {
+	storeFile
+}
+
+// dirFile is a file found in the directory.
+type dirFile struct {
+	// path - path of the file to open (the directory joined with relative path)
+	path string
+
+	// relativePath - slash separated path relative to the directory
+	relativePath string
+}
+
+func (sd *storeDir) Action(ctx *cli.Context) (err error) {
+	if ctx.NArg() == 0 {
+		err = errors.New("no directories passed")
+		return
+	}
+	for _, pattern := range append(ctx.StringSlice("include"), ctx.StringSlice("exclude")...) {
+		_, err = path.Match(pattern, "")
+		if err != nil {
+			err = errors.Wrapf(err, "invalid glob pattern %+q", pattern)
+			return
+		}
+	}
+	userId := ctx.String("user-id")
+	manifest := make(map[string]string)
+	manifestMu := sync.Mutex{}
+
+	err = runBatch(ctx, sd.jsonOut, func(send func(item dirFile) bool) (err error) {
+		for _, dir := range ctx.Args().Slice() {
+			w := dirWalker{
+				include:        ctx.StringSlice("include"),
+				exclude:        ctx.StringSlice("exclude"),
+				followSymlinks: ctx.Bool("follow-symlinks"),
+				visited:        make(map[string]bool),
+				logger:         utils.ContextLogger(ctx.Context),
+				send:           send,
+			}
+			var ok bool
+			ok, err = w.walk(dir, "")
+			if err != nil {
+				err = errors.Wrapf(err, "walk directory %+q", dir)
+				return
+			}
+			if !ok {
+				return
+			}
+		}
+		return
+	}, func(c context.Context, file dirFile) (asset *types.Asset, err error) {
+		asset, err = sd.processOne(c, file, userId)
+		if err == nil {
+			manifestMu.Lock()
+			manifest[file.path] = asset.AssetKey
+			manifestMu.Unlock()
+		}
+		return
+	})
+
+	if ctx.String("manifest") != "" {
+		manifestErr := writeManifest(ctx.String("manifest"), manifest)
+		if manifestErr != nil && err == nil {
+			err = manifestErr
+		}
+	}
+	return
+}
+
+// processOne stores the file unless it is already stored by the user and not modified since then.
+func (sd *storeDir) processOne(ctx context.Context, file dirFile, userId string) (asset *types.Asset, err error) {
+	stat, err := os.Stat(file.path)
+	if err != nil {
+		utils.ContextLogger(ctx).Error("store file failed", "file", file.path, "err", err)
+		return
+	}
+	absolutePath, err := filepath.Abs(file.path)
+	if err != nil {
+		utils.ContextLogger(ctx).Error("store file failed", "file", file.path, "err", err)
+		return
+	}
+	asset, err = sd.assets.GetByFile(ctx, userId, absolutePath, stat.ModTime(), stat.Size())
+	if err == nil {
+		utils.ContextLogger(ctx).Debug("file is already stored", "file", file.path, "assetKey", asset.AssetKey)
+		asset.Dedup = true
+		return
+	} else if !errors.Is(err, repository.ErrNotFound) {
+		utils.ContextLogger(ctx).Error("store file failed", "file", file.path, "err", err)
+		return
+	}
+
+	return sd.storeFile.processOne(ctx, file.path, userId, map[string]any{
+		"relativePath": file.relativePath,
+	})
+}
+
+// dirWalker sends files of the directory tree matching the patterns.
+type dirWalker struct {
+	include        []string
+	exclude        []string
+	followSymlinks bool
+	visited        map[string]bool // real paths of walked directories to break symlink loops
+	logger         *utils.Logger
+	send           func(item dirFile) bool
+}
+
+// walk sends files of the directory recursively, ok is false if sending is interrupted.
+func (w *dirWalker) walk(dir string, relativeDir string) (ok bool, err error) {
+	realDir, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return
+	}
+	if w.visited[realDir] {
+		w.logger.Warn("directory is already walked, skipped", "dir", dir)
+		return true, nil
+	}
+	w.visited[realDir] = true
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		filePath := filepath.Join(dir, entry.Name())
+		relativePath := path.Join(relativeDir, entry.Name())
+		if matchGlobs(w.exclude, relativePath) {
+			continue
+		}
+
+		mode := entry.Type()
+		if mode&os.ModeSymlink != 0 {
+			if !w.followSymlinks {
+				w.logger.Debug("symlink skipped", "file", filePath)
+				continue
+			}
+			var stat os.FileInfo
+			stat, err = os.Stat(filePath)
+			if err != nil {
+				w.logger.Warn("broken symlink skipped", "file", filePath, "err", err)
+				err = nil
+				continue
+			}
+			mode = stat.Mode().Type()
+		}
+
+		switch {
+		case mode.IsDir():
+			ok, err = w.walk(filePath, relativePath)
+			if err != nil || !ok {
+				return
+			}
+		case mode.IsRegular():
+			if len(w.include) > 0 && !matchGlobs(w.include, relativePath) {
+				continue
+			}
+			if !w.send(dirFile{path: filePath, relativePath: relativePath}) {
+				return false, nil
+			}
+		}
+	}
+	return true, nil
+}
+
+// matchGlobs checks whether any of patterns matches the slash separated path or its base name.
+func matchGlobs(patterns []string, relativePath string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, relativePath); ok {
+			return true
+		}
+		if ok, _ := path.Match(pattern, path.Base(relativePath)); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func writeManifest(name string, manifest map[string]string) (err error) {
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		err = errors.Wrap(err, "encode manifest")
+		return
+	}
+	err = os.WriteFile(name, append(data, '\n'), 0644)
+	if err != nil {
+		err = errors.Wrap(err, "write manifest")
+		return
+	}
+	return
+}
@@ -0,0 +1,93 @@
+package commands
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/bbars/assets/service"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/urfave/cli/v2"
+)
+
+func TestStoreDir(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"a.txt":         "a",
+		"sub/b.jpg":     "b",
+		"sub/c.txt":     "c",
+		"skip/d.txt":    "d",
+		"sub/deep/e.md": "e",
+	}
+	for name, data := range files {
+		require.NoError(t, os.MkdirAll(filepath.Join(dir, filepath.Dir(name)), 0755))
+		require.NoError(t, os.WriteFile(filepath.Join(dir, name), []byte(data), 0644))
+	}
+	require.NoError(t, os.Symlink(filepath.Join(dir, "a.txt"), filepath.Join(dir, "z-link.txt")))
+
+	assets := newTestAssets(t)
+	run := func(args ...string) map[string]string {
+		manifestPath := filepath.Join(t.TempDir(), "manifest.json")
+		app := &cli.App{
+			Commands: []*cli.Command{
+				NewStoreDirCommand(func(ctx *cli.Context) (*service.Assets, error) { return assets, nil }),
+			},
+		}
+		args = append([]string{"assets", "storedir", "--manifest", manifestPath}, args...)
+		require.NoError(t, app.Run(append(args, dir)))
+		data, err := os.ReadFile(manifestPath)
+		require.NoError(t, err)
+		manifest := make(map[string]string)
+		require.NoError(t, json.Unmarshal(data, &manifest))
+		return manifest
+	}
+
+	manifest := run("--exclude", "skip", "--include", "*.txt", "--include", "sub/deep/*")
+	assert.ElementsMatch(t, []string{
+		filepath.Join(dir, "a.txt"),
+		filepath.Join(dir, "sub/c.txt"),
+		filepath.Join(dir, "sub/deep/e.md"),
+	}, mapKeys(manifest))
+
+	asset, err := assets.DescribeByKey(context.Background(), manifest[filepath.Join(dir, "sub/c.txt")])
+	require.NoError(t, err)
+	info := map[string]map[string]any{}
+	require.NoError(t, json.Unmarshal([]byte(asset.Info), &info))
+	assert.Equal(t, "sub/c.txt", info["file"]["relativePath"])
+
+	// unchanged files are skipped, symlinks are followed on demand
+	again := run("-j", "2", "--follow-symlinks")
+	assert.Len(t, again, len(files)+1)
+	for name, assetKey := range manifest {
+		assert.Equal(t, assetKey, again[name], name)
+	}
+
+	// mtime is matched regardless of the time zone it is saved in
+	stat, err := os.Stat(filepath.Join(dir, "sub/c.txt"))
+	require.NoError(t, err)
+	for _, loc := range []*time.Location{time.UTC, time.FixedZone("UTC+3", 3*60*60), time.FixedZone("UTC-5", -5*60*60)} {
+		asset, err = assets.GetByFile(context.Background(), "", filepath.Join(dir, "sub/c.txt"), stat.ModTime().In(loc), stat.Size())
+		require.NoError(t, err, loc.String())
+		assert.Equal(t, manifest[filepath.Join(dir, "sub/c.txt")], asset.AssetKey, loc.String())
+	}
+	_, err = assets.GetByFile(context.Background(), "", filepath.Join(dir, "sub/c.txt"), stat.ModTime().Add(time.Nanosecond), stat.Size())
+	assert.Equal(t, service.ErrorCode_notFound, service.ErrorCodeOf(err))
+
+	// modified file is stored again
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "a.txt"), []byte("aa"), 0644))
+	modified := run()
+	assert.NotEqual(t, manifest[filepath.Join(dir, "a.txt")], modified[filepath.Join(dir, "a.txt")])
+	assert.Equal(t, manifest[filepath.Join(dir, "sub/c.txt")], modified[filepath.Join(dir, "sub/c.txt")])
+}
+
+func mapKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	return keys
+}
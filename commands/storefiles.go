@@ -1,15 +1,14 @@
 package commands
 
 import (
-	"bufio"
 	"context"
 	"encoding/json"
-	"log"
 	"os"
 	"path/filepath"
 
 	"github.com/bbars/assets/service"
 	"github.com/bbars/assets/service/types"
+	"github.com/bbars/assets/utils"
 	"github.com/urfave/cli/v2"
 )
 
@@ -27,7 +26,13 @@ func NewStoreFilesCommand(initAssets InitAssets) *cli.Command {
 			sf.assets, err = initAssets(ctx)
 			return
 		},
-		Flags: []cli.Flag{},
+		Flags: append([]cli.Flag{
+			&cli.StringFlag{
+				Name:    "user-id",
+				Aliases: []string{"user"},
+				Usage:   "value for asset's user_id field",
+			},
+		}, batchFlags...),
 	}
 }
 
@@ -37,92 +42,62 @@ type storeFile struct {
 }
 
 func (sf *storeFile) Action(ctx *cli.Context) (err error) {
-	var scanner *bufio.Scanner
-
-	args := ctx.Args()
-	filePaths := make([]string, 0, args.Len())
-	for i := 0; i < args.Len(); i++ {
-		filePath := args.Get(i)
-		if filePath == "-" {
-			scanner = bufio.NewScanner(os.Stdin)
-			continue
-		}
-		filePaths = append(filePaths, filePath)
-	}
-
-	for _, filePath := range filePaths {
-		sf.processOne(ctx.Context, filePath)
-	}
+	userId := ctx.String("user-id")
+	return runBatch(ctx, sf.jsonOut, feedArgs(ctx, os.Stdin), func(c context.Context, filePath string) (*types.Asset, error) {
+		return sf.processOne(c, filePath, userId, nil)
+	})
+}
 
-	if scanner != nil {
-		for scanner.Scan() {
-			sf.processOne(ctx.Context, scanner.Text())
-		}
-		err = scanner.Err()
+// processOne stores the file, its path, mtime and size (with extra fields of fileInfo)
+// are saved in asset's info as {"file": {...}}.
+func (sf storeFile) processOne(ctx context.Context, filePath string, userId string, fileInfo map[string]any) (asset *types.Asset, err error) {
+	logger := utils.ContextLogger(ctx).With("file", filePath)
+	defer func() {
 		if err != nil {
-			return
+			logger.Error("store file failed", "err", err)
 		}
-	}
-
-	return
-}
-
-func (sf storeFile) processOne(ctx context.Context, filePath string) {
+	}()
 	f, err := os.Open(filePath)
 	if err != nil {
-		log.Println("error", err)
 		return
 	}
 	defer func() {
-		err = f.Close()
-		if err != nil {
-			log.Println("error", err)
-			return
+		closeErr := f.Close()
+		if closeErr != nil && err == nil {
+			err = closeErr
 		}
 	}()
 	extra := types.NewAsset()
-	defer func() {
-		err = extra.Close()
-		if err != nil {
-			log.Println("error", err)
-			return
-		}
-	}()
+	defer extra.Close()
 	stat, err := f.Stat()
 	if err != nil {
-		log.Println("error", err)
 		return
 	}
 
 	fileAssetInfo := make(map[string]map[string]any)
 	fileAssetInfo["file"] = make(map[string]any)
+	for key, value := range fileInfo {
+		fileAssetInfo["file"][key] = value
+	}
 	fileAssetInfo["file"]["absolutePath"], err = filepath.Abs(filePath)
 	if err != nil {
-		log.Println("error", err)
 		return
 	}
 	fileAssetInfo["file"]["mtime"] = stat.ModTime()
+	fileAssetInfo["file"]["size"] = stat.Size()
 	extraInfoJson, err := json.Marshal(fileAssetInfo)
 	if err != nil {
-		log.Println("error", err)
 		return
 	}
 	extra.Info = string(extraInfoJson)
 
 	extra.OriginalName = filepath.Base(filePath)
+	extra.UserId = userId
 	extra.Size = stat.Size()
-	asset, err := sf.assets.Store(
+	asset, err = sf.assets.Store(
 		ctx,
 		extra,
 		f,
 	)
-	if err != nil {
-		log.Println("error", err)
-	}
-	if asset != nil {
-		jsonErr := sf.jsonOut.Encode(asset)
-		if jsonErr != nil {
-			log.Println("error", "jsonErr", jsonErr)
-		}
-	}
+	return
 }
@@ -2,11 +2,11 @@ package commands
 
 import (
 	"encoding/json"
-	"log"
 	"os"
 
 	"github.com/bbars/assets/service"
 	"github.com/bbars/assets/service/types"
+	"github.com/bbars/assets/utils"
 	"github.com/urfave/cli/v2"
 )
 
@@ -39,6 +39,11 @@ func NewStorePipeCommand(initAssets InitAssets) *cli.Command {
 				Aliases: []string{"url"},
 				Usage:   "value for asset's original_url field",
 			},
+			&cli.StringFlag{
+				Name:    "user-id",
+				Aliases: []string{"user"},
+				Usage:   "value for asset's user_id field",
+			},
 			&cli.StringFlag{
 				Name:  "info",
 				Usage: "value for asset's info field",
@@ -60,11 +65,12 @@ func (sp *storePipe) Action(ctx *cli.Context) (err error) {
 		}
 	}()
 
+	logger := utils.ContextLogger(ctx.Context)
 	extra := types.NewAsset()
 	defer func() {
 		err = extra.Close()
 		if err != nil {
-			log.Println("error", err)
+			logger.Error("release asset failed", "err", err)
 			return
 		}
 	}()
@@ -73,18 +79,19 @@ func (sp *storePipe) Action(ctx *cli.Context) (err error) {
 	extra.OriginalName = ctx.String("original-name")
 	extra.OriginalUrl = ctx.String("original-url")
 	extra.ContentType = ctx.String("content-type")
+	extra.UserId = ctx.String("user-id")
 	asset, err := sp.assets.Store(
 		ctx.Context,
 		extra,
 		os.Stdin,
 	)
 	if err != nil {
-		log.Println("error", err)
+		logger.Error("store pipe failed", "err", err)
 	}
 	if asset != nil {
 		jsonErr := sp.jsonOut.Encode(asset)
 		if jsonErr != nil {
-			log.Println("error", "jsonErr", jsonErr)
+			logger.Error("write json failed", "err", jsonErr)
 		}
 	}
 	return
@@ -1,13 +1,13 @@
 package commands
 
 import (
-	"bufio"
 	"context"
 	"encoding/json"
-	"log"
 	"os"
 
 	"github.com/bbars/assets/service"
+	"github.com/bbars/assets/service/types"
+	"github.com/bbars/assets/utils"
 	"github.com/urfave/cli/v2"
 )
 
@@ -23,9 +23,26 @@ func NewStoreUrlsCommand(initAssets InitAssets) *cli.Command {
 		Action:  su.Action,
 		Before: func(ctx *cli.Context) (err error) {
 			su.assets, err = initAssets(ctx)
+			if err != nil {
+				return
+			}
+			if ctx.Bool("wait") {
+				su.assets.Config.MaxRemoteWaitSize = 0
+			}
 			return
 		},
-		Flags: []cli.Flag{},
+		Flags: append([]cli.Flag{
+			&cli.StringFlag{
+				Name:    "user-id",
+				Aliases: []string{"user"},
+				Usage:   "value for asset's user_id field",
+			},
+			&cli.BoolFlag{
+				Name:  "wait",
+				Usage: "Wait for every fetch before writing its asset (otherwise --max-remote-wait-size applies).",
+				Value: true,
+			},
+		}, batchFlags...),
 	}
 }
 
@@ -35,49 +52,29 @@ type storeUrl struct {
 }
 
 func (su *storeUrl) Action(ctx *cli.Context) (err error) {
-	var scanner *bufio.Scanner
-
-	args := ctx.Args()
-	originalUrls := make([]string, 0, args.Len())
-	for i := 0; i < args.Len(); i++ {
-		url := args.Get(i)
-		if url == "-" {
-			scanner = bufio.NewScanner(os.Stdin)
-			continue
+	userId := ctx.String("user-id")
+	// assets not waited for are written being processed, the process must not exit before they are fetched
+	defer func() {
+		drainErr := su.assets.Drain(ctx.Context)
+		if drainErr != nil && err == nil {
+			err = drainErr
 		}
-		originalUrls = append(originalUrls, url)
-	}
-
-	for _, originalUrl := range originalUrls {
-		su.processOne(ctx.Context, originalUrl)
-	}
-
-	if scanner != nil {
-		for scanner.Scan() {
-			su.processOne(ctx.Context, scanner.Text())
-		}
-		err = scanner.Err()
-		if err != nil {
-			return
-		}
-	}
-
+	}()
+	err = runBatch(ctx, su.jsonOut, feedArgs(ctx, os.Stdin), func(c context.Context, originalUrl string) (*types.Asset, error) {
+		return su.processOne(c, originalUrl, userId)
+	})
 	return
 }
 
-func (su storeUrl) processOne(ctx context.Context, originalUrl string) {
-	asset, err := su.assets.StoreByOriginalUrl(
-		ctx, // TODO wrap? handle Done?
+func (su storeUrl) processOne(ctx context.Context, originalUrl string, userId string) (asset *types.Asset, err error) {
+	asset, err = su.assets.StoreByOriginalUrl(
+		ctx,
 		originalUrl,
+		userId,
 		true,
 	)
 	if err != nil {
-		log.Println("error", err)
-	}
-	if asset != nil {
-		jsonErr := su.jsonOut.Encode(asset)
-		if jsonErr != nil {
-			log.Println("error", "jsonErr", jsonErr)
-		}
+		utils.ContextLogger(ctx).Error("store url failed", "originalUrl", originalUrl, "err", err)
 	}
+	return
 }
@@ -0,0 +1,59 @@
+package commands
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/bbars/assets/service"
+	"github.com/bbars/assets/service/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/urfave/cli/v2"
+)
+
+func TestStoreUrls(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("remote contents"))
+	}))
+	t.Cleanup(origin.Close)
+
+	tests := []struct {
+		name         string
+		args         []string
+		wantWaitSize int64
+	}{
+		{
+			name:         "wait by default",
+			wantWaitSize: 0,
+		},
+		{
+			name:         "no wait",
+			args:         []string{"--wait=false"},
+			wantWaitSize: 5,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assets := newTestAssets(t)
+			assets.Config.MaxRemoteWaitSize = 5
+			app := &cli.App{
+				Commands: []*cli.Command{
+					NewStoreUrlsCommand(func(ctx *cli.Context) (*service.Assets, error) { return assets, nil }),
+				},
+			}
+			originalUrl := origin.URL + "/r.txt"
+			args := append([]string{"assets", "storeurls"}, tt.args...)
+			require.NoError(t, app.Run(append(args, originalUrl)))
+			assert.Equal(t, tt.wantWaitSize, assets.Config.MaxRemoteWaitSize)
+
+			// the fetch is finished before the command exits either way
+			asset, err := assets.Repo.GetByOriginalUrl(context.Background(), originalUrl, true)
+			require.NoError(t, err)
+			assert.Equal(t, types.AssetStatus_done, asset.Status)
+			assert.Empty(t, asset.Error)
+			assert.Equal(t, int64(len("remote contents")), asset.Size)
+		})
+	}
+}
@@ -0,0 +1,94 @@
+package commands
+
+import (
+	"encoding/json"
+	"os"
+
+	"github.com/bbars/assets/service"
+	"github.com/bbars/assets/service/types"
+	"github.com/bbars/assets/utils"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli/v2"
+)
+
+func NewUsageCommand(initAssets InitAssets) *cli.Command {
+	u := usage{
+		assets:  nil,
+		jsonOut: json.NewEncoder(os.Stdout),
+	}
+	return &cli.Command{
+		Name:      "usage",
+		Usage:     "Show storage usage and quotas of users",
+		ArgsUsage: "<userId>...",
+		Action:    u.Action,
+		Before: func(ctx *cli.Context) (err error) {
+			u.assets, err = initAssets(ctx)
+			return
+		},
+		Flags: []cli.Flag{
+			&cli.Int64Flag{
+				Name:  "set-max-size",
+				Usage: "Override size quota of the users (0 means no limit, negative value resets to default).",
+			},
+			&cli.Int64Flag{
+				Name:  "set-max-count",
+				Usage: "Override asset count quota of the users (0 means no limit, negative value resets to default).",
+			},
+		},
+	}
+}
+
+type usage struct {
+	assets  *service.Assets
+	jsonOut *json.Encoder
+}
+
+func (u *usage) Action(ctx *cli.Context) (err error) {
+	args := ctx.Args()
+	if args.Len() == 0 {
+		err = errors.New("at least one userId expected")
+		return
+	}
+
+	for _, userId := range args.Slice() {
+		logger := utils.ContextLogger(ctx.Context).With("userId", userId)
+		userUsage, processErr := u.processOne(ctx, userId)
+		if processErr != nil {
+			logger.Error("process usage failed", "err", processErr)
+			continue
+		}
+		jsonErr := u.jsonOut.Encode(userUsage)
+		if jsonErr != nil {
+			logger.Error("write json failed", "err", jsonErr)
+		}
+	}
+
+	return
+}
+
+func (u *usage) processOne(ctx *cli.Context, userId string) (userUsage *types.Usage, err error) {
+	if ctx.IsSet("set-max-size") {
+		userUsage, err = u.assets.SetUserMaxSize(ctx.Context, userId, quotaFlagValue(ctx, "set-max-size"))
+		if err != nil {
+			return
+		}
+	}
+	if ctx.IsSet("set-max-count") {
+		userUsage, err = u.assets.SetUserMaxCount(ctx.Context, userId, quotaFlagValue(ctx, "set-max-count"))
+		if err != nil {
+			return
+		}
+	}
+	if userUsage == nil {
+		userUsage, err = u.assets.Usage(ctx.Context, userId)
+	}
+	return
+}
+
+func quotaFlagValue(ctx *cli.Context, name string) *int64 {
+	v := ctx.Int64(name)
+	if v < 0 {
+		return nil
+	}
+	return &v
+}
@@ -0,0 +1,84 @@
+package commands
+
+import (
+	"context"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/bbars/assets/service"
+	"github.com/bbars/assets/service/storage"
+	"github.com/bbars/assets/service/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUserSizeQuota(t *testing.T) {
+	ctx := context.Background()
+	assets := newTestAssets(t)
+	assets.Config.UserMaxSize = 10
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(r.URL.Path[1:]))
+	}))
+	t.Cleanup(origin.Close)
+
+	_, err := assets.Store(ctx, &types.Asset{UserId: "u1"}, strings.NewReader("0123456"))
+	require.NoError(t, err)
+
+	// content owned by the user doesn't grow the usage, so it fits even if larger than the remaining quota
+	asset, err := assets.Store(ctx, &types.Asset{UserId: "u1", Size: 7}, strings.NewReader("0123456"))
+	require.NoError(t, err)
+	assert.True(t, asset.Dedup)
+	asset, err = assets.StoreByOriginalUrl(ctx, origin.URL+"/0123456", "u1", true)
+	require.NoError(t, err)
+	assert.Empty(t, asset.Error)
+	assert.False(t, asset.Deleted)
+
+	// new content doesn't, and its blob is not left in the storage
+	_, err = assets.Store(ctx, &types.Asset{UserId: "u1", Size: 7}, strings.NewReader("abcdefg"))
+	assert.Equal(t, service.ErrorCode_forbidden, service.ErrorCodeOf(err), "err: %v", err)
+	_, err = assets.StoreByOriginalUrl(ctx, origin.URL+"/abcdefg", "u1", true)
+	assert.Equal(t, service.ErrorCode_forbidden, service.ErrorCodeOf(err), "err: %v", err)
+	assert.Equal(t, 1, countBlobFiles(t, assets))
+
+	// content larger than any the user may own is rejected while streaming
+	_, err = assets.Store(ctx, &types.Asset{UserId: "u1"}, strings.NewReader(strings.Repeat("x", 1000)))
+	assert.Equal(t, service.ErrorCode_forbidden, service.ErrorCodeOf(err), "err: %v", err)
+	_, err = assets.StoreByOriginalUrl(ctx, origin.URL+"/"+strings.Repeat("y", 1000), "u1", true)
+	assert.Equal(t, service.ErrorCode_forbidden, service.ErrorCodeOf(err), "err: %v", err)
+	assert.Equal(t, 1, countBlobFiles(t, assets))
+
+	// the blob owned by another user is kept
+	_, err = assets.Store(ctx, &types.Asset{UserId: "u2"}, strings.NewReader("ABCDEFG"))
+	require.NoError(t, err)
+	_, err = assets.Store(ctx, &types.Asset{UserId: "u1"}, strings.NewReader("ABCDEFG"))
+	assert.Equal(t, service.ErrorCode_forbidden, service.ErrorCodeOf(err), "err: %v", err)
+	assert.Equal(t, 2, countBlobFiles(t, assets))
+
+	usage, err := assets.Usage(ctx, "u1")
+	require.NoError(t, err)
+	assert.Equal(t, int64(7), usage.Size)
+	assert.Equal(t, int64(3), usage.Count)
+
+	// the user at the limit still stores owned content
+	_, err = assets.Store(ctx, &types.Asset{UserId: "u1"}, strings.NewReader("012"))
+	require.NoError(t, err)
+	_, err = assets.Store(ctx, &types.Asset{UserId: "u1"}, strings.NewReader("0123456"))
+	assert.NoError(t, err)
+}
+
+// countBlobFiles counts files within the directory tree of the storage (temp files and the database are in the root).
+func countBlobFiles(t *testing.T, assets *service.Assets) (count int) {
+	root := assets.Storage.(*storage.DirStorage).Dir
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err == nil && !d.IsDir() && filepath.Dir(path) != root {
+			count++
+		}
+		return err
+	})
+	require.NoError(t, err)
+	return
+}
@@ -0,0 +1,354 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.2.0
+// - protoc             (unknown)
+// source: assets.proto
+
+package grpcapi
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.32.0 or later.
+const _ = grpc.SupportPackageIsVersion7
+
+// AssetsClient is the client API for Assets service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type AssetsClient interface {
+	// Describe returns asset metadata.
+	Describe(ctx context.Context, in *DescribeRequest, opts ...grpc.CallOption) (*Asset, error)
+	// Get streams asset contents: the first message carries metadata,
+	// the following ones carry chunks of the contents.
+	Get(ctx context.Context, in *GetRequest, opts ...grpc.CallOption) (Assets_GetClient, error)
+	// Store saves the contents streamed by the client: the first message
+	// must carry metadata, the following ones carry chunks of the contents.
+	Store(ctx context.Context, opts ...grpc.CallOption) (Assets_StoreClient, error)
+	// StoreByOriginalUrl starts fetching the asset by original URL.
+	StoreByOriginalUrl(ctx context.Context, in *StoreByOriginalUrlRequest, opts ...grpc.CallOption) (*Asset, error)
+	// Watch streams the asset every time its status changes
+	// until fetching is finished (done, failed or deleted).
+	Watch(ctx context.Context, in *WatchRequest, opts ...grpc.CallOption) (Assets_WatchClient, error)
+}
+
+type assetsClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewAssetsClient(cc grpc.ClientConnInterface) AssetsClient {
+	return &assetsClient{cc}
+}
+
+func (c *assetsClient) Describe(ctx context.Context, in *DescribeRequest, opts ...grpc.CallOption) (*Asset, error) {
+	out := new(Asset)
+	err := c.cc.Invoke(ctx, "/assets.v1.Assets/Describe", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *assetsClient) Get(ctx context.Context, in *GetRequest, opts ...grpc.CallOption) (Assets_GetClient, error) {
+	stream, err := c.cc.NewStream(ctx, &Assets_ServiceDesc.Streams[0], "/assets.v1.Assets/Get", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &assetsGetClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type Assets_GetClient interface {
+	Recv() (*GetResponse, error)
+	grpc.ClientStream
+}
+
+type assetsGetClient struct {
+	grpc.ClientStream
+}
+
+func (x *assetsGetClient) Recv() (*GetResponse, error) {
+	m := new(GetResponse)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *assetsClient) Store(ctx context.Context, opts ...grpc.CallOption) (Assets_StoreClient, error) {
+	stream, err := c.cc.NewStream(ctx, &Assets_ServiceDesc.Streams[1], "/assets.v1.Assets/Store", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &assetsStoreClient{stream}
+	return x, nil
+}
+
+type Assets_StoreClient interface {
+	Send(*StoreRequest) error
+	CloseAndRecv() (*Asset, error)
+	grpc.ClientStream
+}
+
+type assetsStoreClient struct {
+	grpc.ClientStream
+}
+
+func (x *assetsStoreClient) Send(m *StoreRequest) error {
+	return x.ClientStream.SendMsg(m)
+}
+
+func (x *assetsStoreClient) CloseAndRecv() (*Asset, error) {
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	m := new(Asset)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *assetsClient) StoreByOriginalUrl(ctx context.Context, in *StoreByOriginalUrlRequest, opts ...grpc.CallOption) (*Asset, error) {
+	out := new(Asset)
+	err := c.cc.Invoke(ctx, "/assets.v1.Assets/StoreByOriginalUrl", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *assetsClient) Watch(ctx context.Context, in *WatchRequest, opts ...grpc.CallOption) (Assets_WatchClient, error) {
+	stream, err := c.cc.NewStream(ctx, &Assets_ServiceDesc.Streams[2], "/assets.v1.Assets/Watch", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &assetsWatchClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type Assets_WatchClient interface {
+	Recv() (*Asset, error)
+	grpc.ClientStream
+}
+
+type assetsWatchClient struct {
+	grpc.ClientStream
+}
+
+func (x *assetsWatchClient) Recv() (*Asset, error) {
+	m := new(Asset)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// AssetsServer is the server API for Assets service.
+// All implementations must embed UnimplementedAssetsServer
+// for forward compatibility
+type AssetsServer interface {
+	// Describe returns asset metadata.
+	Describe(context.Context, *DescribeRequest) (*Asset, error)
+	// Get streams asset contents: the first message carries metadata,
+	// the following ones carry chunks of the contents.
+	Get(*GetRequest, Assets_GetServer) error
+	// Store saves the contents streamed by the client: the first message
+	// must carry metadata, the following ones carry chunks of the contents.
+	Store(Assets_StoreServer) error
+	// StoreByOriginalUrl starts fetching the asset by original URL.
+	StoreByOriginalUrl(context.Context, *StoreByOriginalUrlRequest) (*Asset, error)
+	// Watch streams the asset every time its status changes
+	// until fetching is finished (done, failed or deleted).
+	Watch(*WatchRequest, Assets_WatchServer) error
+	mustEmbedUnimplementedAssetsServer()
+}
+
+// UnimplementedAssetsServer must be embedded to have forward compatible implementations.
+type UnimplementedAssetsServer struct {
+}
+
+func (UnimplementedAssetsServer) Describe(context.Context, *DescribeRequest) (*Asset, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Describe not implemented")
+}
+func (UnimplementedAssetsServer) Get(*GetRequest, Assets_GetServer) error {
+	return status.Errorf(codes.Unimplemented, "method Get not implemented")
+}
+func (UnimplementedAssetsServer) Store(Assets_StoreServer) error {
+	return status.Errorf(codes.Unimplemented, "method Store not implemented")
+}
+func (UnimplementedAssetsServer) StoreByOriginalUrl(context.Context, *StoreByOriginalUrlRequest) (*Asset, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method StoreByOriginalUrl not implemented")
+}
+func (UnimplementedAssetsServer) Watch(*WatchRequest, Assets_WatchServer) error {
+	return status.Errorf(codes.Unimplemented, "method Watch not implemented")
+}
+func (UnimplementedAssetsServer) mustEmbedUnimplementedAssetsServer() {}
+
+// UnsafeAssetsServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to AssetsServer will
+// result in compilation errors.
+type UnsafeAssetsServer interface {
+	mustEmbedUnimplementedAssetsServer()
+}
+
+func RegisterAssetsServer(s grpc.ServiceRegistrar, srv AssetsServer) {
+	s.RegisterService(&Assets_ServiceDesc, srv)
+}
+
+func _Assets_Describe_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(DescribeRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AssetsServer).Describe(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/assets.v1.Assets/Describe",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AssetsServer).Describe(ctx, req.(*DescribeRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Assets_Get_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(GetRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(AssetsServer).Get(m, &assetsGetServer{stream})
+}
+
+type Assets_GetServer interface {
+	Send(*GetResponse) error
+	grpc.ServerStream
+}
+
+type assetsGetServer struct {
+	grpc.ServerStream
+}
+
+func (x *assetsGetServer) Send(m *GetResponse) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func _Assets_Store_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(AssetsServer).Store(&assetsStoreServer{stream})
+}
+
+type Assets_StoreServer interface {
+	SendAndClose(*Asset) error
+	Recv() (*StoreRequest, error)
+	grpc.ServerStream
+}
+
+type assetsStoreServer struct {
+	grpc.ServerStream
+}
+
+func (x *assetsStoreServer) SendAndClose(m *Asset) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func (x *assetsStoreServer) Recv() (*StoreRequest, error) {
+	m := new(StoreRequest)
+	if err := x.ServerStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func _Assets_StoreByOriginalUrl_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(StoreByOriginalUrlRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AssetsServer).StoreByOriginalUrl(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/assets.v1.Assets/StoreByOriginalUrl",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AssetsServer).StoreByOriginalUrl(ctx, req.(*StoreByOriginalUrlRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Assets_Watch_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(WatchRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(AssetsServer).Watch(m, &assetsWatchServer{stream})
+}
+
+type Assets_WatchServer interface {
+	Send(*Asset) error
+	grpc.ServerStream
+}
+
+type assetsWatchServer struct {
+	grpc.ServerStream
+}
+
+func (x *assetsWatchServer) Send(m *Asset) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+// Assets_ServiceDesc is the grpc.ServiceDesc for Assets service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var Assets_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "assets.v1.Assets",
+	HandlerType: (*AssetsServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Describe",
+			Handler:    _Assets_Describe_Handler,
+		},
+		{
+			MethodName: "StoreByOriginalUrl",
+			Handler:    _Assets_StoreByOriginalUrl_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "Get",
+			Handler:       _Assets_Get_Handler,
+			ServerStreams: true,
+		},
+		{
+			StreamName:    "Store",
+			Handler:       _Assets_Store_Handler,
+			ClientStreams: true,
+		},
+		{
+			StreamName:    "Watch",
+			Handler:       _Assets_Watch_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "assets.proto",
+}
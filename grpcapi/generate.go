@@ -0,0 +1,5 @@
+// Package grpcapi contains gRPC API of the assets service generated from assets.proto.
+package grpcapi
+
+// Requires buf, protoc-gen-go and protoc-gen-go-grpc in PATH.
+//go:generate buf generate
@@ -4,7 +4,6 @@ import (
 	"context"
 	"database/sql"
 	"embed"
-	"log"
 	"os"
 	"regexp"
 	"strings"
@@ -13,6 +12,7 @@ import (
 	"github.com/bbars/assets/service"
 	"github.com/bbars/assets/service/repository"
 	"github.com/bbars/assets/service/storage"
+	"github.com/bbars/assets/service/tracing"
 	"github.com/bbars/assets/utils"
 	"github.com/pkg/errors"
 	"github.com/urfave/cli/v2"
@@ -22,7 +22,8 @@ import (
 var migrations embed.FS
 
 var (
-	app *cli.App
+	app             *cli.App
+	shutdownTracing func(ctx context.Context) error
 )
 
 func init() {
@@ -55,6 +56,69 @@ func init() {
 				Value:   0655,
 				EnvVars: []string{"ASSETS_FILE_PERM"},
 			},
+			&cli.BoolFlag{
+				Name:    "chunking",
+				Usage:   "Split blobs into content-defined chunks stored once, so similar blobs share them (see storage-stats command).",
+				EnvVars: []string{"ASSETS_CHUNKING"},
+			},
+			&cli.Int64Flag{
+				Name:    "chunk-min-size",
+				Usage:   "Minimal size of chunks.",
+				Value:   16 * 1024, // 16KiB
+				EnvVars: []string{"ASSETS_CHUNK_MIN_SIZE"},
+			},
+			&cli.Int64Flag{
+				Name:    "chunk-avg-size",
+				Usage:   "Average size of chunks, a power of two.",
+				Value:   64 * 1024, // 64KiB
+				EnvVars: []string{"ASSETS_CHUNK_AVG_SIZE"},
+			},
+			&cli.Int64Flag{
+				Name:    "chunk-max-size",
+				Usage:   "Maximal size of chunks.",
+				Value:   256 * 1024, // 256KiB
+				EnvVars: []string{"ASSETS_CHUNK_MAX_SIZE"},
+			},
+			&cli.StringFlag{
+				Name:    "compression",
+				Usage:   "Compression of blobs at rest: none, zstd or gzip.",
+				Value:   storage.CompressionNone,
+				EnvVars: []string{"ASSETS_COMPRESSION"},
+			},
+			&cli.StringSliceFlag{
+				Name:    "compression-types",
+				Usage:   "Content types to compress, sniffed from blob contents ('text/*' matches all text types).",
+				Value:   cli.NewStringSlice(storage.DefaultCompressedContentTypes...),
+				EnvVars: []string{"ASSETS_COMPRESSION_TYPES"},
+			},
+			&cli.Int64Flag{
+				Name:    "compression-min-size",
+				Usage:   "Blobs smaller than this are not compressed.",
+				Value:   1024,
+				EnvVars: []string{"ASSETS_COMPRESSION_MIN_SIZE"},
+			},
+			&cli.Int64Flag{
+				Name:    "compression-frame-size",
+				Usage:   "Size of blob parts compressed independently, so ranges are read without decompressing the whole blob.",
+				Value:   256 * 1024, // 256KiB
+				EnvVars: []string{"ASSETS_COMPRESSION_FRAME_SIZE"},
+			},
+			&cli.StringFlag{
+				Name:    "encryption-keyfile",
+				Usage:   "JSON file with keys to encrypt blobs at rest (see rekey command). Blobs are stored unencrypted if not set.",
+				EnvVars: []string{"ASSETS_ENCRYPTION_KEYFILE"},
+			},
+			&cli.Int64Flag{
+				Name:    "encryption-chunk-size",
+				Usage:   "Size of blob parts encrypted independently, so ranges are read without decrypting the whole blob.",
+				Value:   64 * 1024, // 64KiB
+				EnvVars: []string{"ASSETS_ENCRYPTION_CHUNK_SIZE"},
+			},
+			&cli.StringFlag{
+				Name:    "storage-name",
+				Usage:   "Storage name saved to new assets (see migrate-storage command).",
+				EnvVars: []string{"ASSETS_STORAGE_NAME"},
+			},
 			&cli.Uint64Flag{
 				Name:    "max-remote-size",
 				Usage:   "Size limit for resources fetched by URL.",
@@ -63,10 +127,9 @@ func init() {
 			},
 			&cli.Uint64Flag{
 				Name:    "max-remote-wait-size",
-				Usage:   "Size limit to wait for resources fetched by URL.",
+				Usage:   "Size limit to wait for resources fetched by URL (0 means no limit).",
 				Value:   10 * 1024 * 1024, // 10MiB
 				EnvVars: []string{"ASSETS_MAX_REMOTE_WAIT_SIZE"},
-				Hidden:  true, // TODO add support
 			},
 			&cli.Uint64Flag{
 				Name:    "max-size",
@@ -74,6 +137,24 @@ func init() {
 				Value:   0, // no limit
 				EnvVars: []string{"ASSETS_MAX_SIZE"},
 			},
+			&cli.Uint64Flag{
+				Name:    "user-max-size",
+				Usage:   "Default size quota of a user (distinct blobs are counted once per user).",
+				Value:   0, // no limit
+				EnvVars: []string{"ASSETS_USER_MAX_SIZE"},
+			},
+			&cli.Uint64Flag{
+				Name:    "user-max-count",
+				Usage:   "Default asset count quota of a user.",
+				Value:   0, // no limit
+				EnvVars: []string{"ASSETS_USER_MAX_COUNT"},
+			},
+			&cli.Uint64Flag{
+				Name:    "min-free-space",
+				Usage:   "Free space threshold of the storage to consider the service ready.",
+				Value:   100 * 1024 * 1024, // 100MiB
+				EnvVars: []string{"ASSETS_MIN_FREE_SPACE"},
+			},
 			&cli.StringFlag{
 				Name:     "original-url-pattern",
 				Usage:    "RegExp pattern to check URLs before fetch. Example: '^https?://.'.",
@@ -86,6 +167,52 @@ func init() {
 				Value:   "AssetsClient",
 				EnvVars: []string{"ASSETS_HTTP_USER_AGENT"},
 			},
+			&cli.StringFlag{
+				Name:    "fetch-policy",
+				Usage:   "JSON file with policies of fetching remote resources per host: headers, credentials, proxy, timeouts, redirects, TLS and schemes.",
+				EnvVars: []string{"ASSETS_FETCH_POLICY"},
+			},
+			&cli.Float64Flag{
+				Name:    "fetch-rate-limit",
+				Usage:   "Max fetches per second from each remote host, excess fetches wait (0 means no limit).",
+				Value:   0, // no limit
+				EnvVars: []string{"ASSETS_FETCH_RATE_LIMIT"},
+			},
+			&cli.IntFlag{
+				Name:    "fetch-rate-burst",
+				Usage:   "Max fetches from each remote host started at once within the rate limit.",
+				Value:   1,
+				EnvVars: []string{"ASSETS_FETCH_RATE_BURST"},
+			},
+			&cli.IntFlag{
+				Name:    "fetch-max-connections",
+				Usage:   "Max concurrent fetches from each remote host, excess fetches wait (0 means no limit).",
+				Value:   0, // no limit
+				EnvVars: []string{"ASSETS_FETCH_MAX_CONNECTIONS"},
+			},
+			&cli.StringFlag{
+				Name:    "log-format",
+				Usage:   "Log format: logfmt or json.",
+				Value:   string(utils.LogFormatLogfmt),
+				EnvVars: []string{"ASSETS_LOG_FORMAT"},
+			},
+			&cli.StringFlag{
+				Name:    "log-level",
+				Usage:   "Minimal level of log records: debug, info, warn or error.",
+				Value:   utils.LogLevelInfo.String(),
+				EnvVars: []string{"ASSETS_LOG_LEVEL"},
+			},
+			&cli.StringFlag{
+				Name:    "trace-exporter",
+				Usage:   "Exporter of tracing spans: none, stdout or otlp (configured with OTEL_EXPORTER_OTLP_* environment variables).",
+				Value:   tracing.ExporterNone,
+				EnvVars: []string{"ASSETS_TRACE_EXPORTER"},
+			},
+			&cli.StringFlag{
+				Name:    "trace-file",
+				Usage:   "File to write spans by stdout exporter instead of stdout.",
+				EnvVars: []string{"ASSETS_TRACE_FILE"},
+			},
 			&cli.StringFlag{
 				Name:     "dsn",
 				Usage:    "Data source name (only sqlite3 is supported for now). Example: 'sqlite3:./storage/assets.db?mode=rwc&_journal=TRUNCATE'.",
@@ -93,17 +220,75 @@ func init() {
 				EnvVars:  []string{"ASSETS_DSN"},
 			},
 		},
+		Before: func(ctx *cli.Context) (err error) {
+			err = initLogger(ctx)
+			if err != nil {
+				return
+			}
+			err = initTracing(ctx)
+			return
+		},
+		After: func(ctx *cli.Context) (err error) {
+			if shutdownTracing != nil {
+				err = shutdownTracing(context.Background())
+			}
+			return
+		},
 		Commands: []*cli.Command{
 			commands.NewMigrateCommand(initAssetRepo),
+			commands.NewMigrateStorageCommand(initAssets),
+			commands.NewRekeyCommand(initAssets),
+			commands.NewStorageStatsCommand(initAssets),
 			commands.NewHttpCommand(initAssets),
+			commands.NewGrpcCommand(initAssets),
 			commands.NewStoreUrlsCommand(initAssets),
 			commands.NewStoreFilesCommand(initAssets),
+			commands.NewStoreDirCommand(initAssets),
 			commands.NewStorePipeCommand(initAssets),
+			commands.NewExportCommand(initAssets),
+			commands.NewBackupCommand(initAssets),
+			commands.NewRestoreCommand(initAssets),
+			commands.NewGetCommand(initAssets),
+			commands.NewDescribeCommand(initAssets),
+			commands.NewUsageCommand(initAssets),
 		},
 	}
 	app.Setup()
 }
 
+func initLogger(ctx *cli.Context) (err error) {
+	logFormat, err := utils.ParseLogFormat(ctx.String("log-format"))
+	if err != nil {
+		err = errors.Wrap(err, "invalid value for log-format flag")
+		return
+	}
+	logLevel, err := utils.ParseLogLevel(ctx.String("log-level"))
+	if err != nil {
+		err = errors.Wrap(err, "invalid value for log-level flag")
+		return
+	}
+	if utils.ContextIsDebug(ctx.Context) {
+		logLevel = utils.LogLevelDebug
+	}
+	logger := utils.NewLogger(os.Stderr, logFormat, logLevel)
+	ctx.Context = utils.ContextSetLogger(ctx.Context, logger)
+	return
+}
+
+func initTracing(ctx *cli.Context) (err error) {
+	shutdownTracing, err = tracing.Init(
+		ctx.Context,
+		ctx.String("trace-exporter"),
+		ctx.String("trace-file"),
+		"assets",
+	)
+	if err != nil {
+		err = errors.Wrap(err, "init tracing")
+		return
+	}
+	return
+}
+
 func initAssetRepo(ctx *cli.Context) (assetRepo repository.Repository, err error) {
 	drvDsn := strings.SplitN(ctx.String("dsn"), ":", 2)
 	if len(drvDsn) == 1 {
@@ -132,12 +317,28 @@ func initAssets(ctx *cli.Context) (assets *service.Assets, err error) {
 		err = errors.Wrap(err, "invalid regexp passed for original-url-pattern flag")
 		return
 	}
+	var fetchPolicies service.FetchPolicies
+	if ctx.String("fetch-policy") != "" {
+		fetchPolicies, err = service.LoadFetchPolicies(ctx.String("fetch-policy"))
+		if err != nil {
+			err = errors.Wrap(err, "invalid value for fetch-policy flag")
+			return
+		}
+	}
 	assetsConf := service.AssetsConfig{
-		MaxRemoteSize:      ctx.Int64("max-remote-size"),
-		MaxRemoteWaitSize:  ctx.Int64("max-remote-wait-size"),
-		MaxSize:            ctx.Int64("max-size"),
-		OriginalUrlPattern: originalUrlPattern,
-		HttpUserAgent:      ctx.String("http-user-agent"),
+		MaxRemoteSize:       ctx.Int64("max-remote-size"),
+		MaxRemoteWaitSize:   ctx.Int64("max-remote-wait-size"),
+		MaxSize:             ctx.Int64("max-size"),
+		OriginalUrlPattern:  originalUrlPattern,
+		HttpUserAgent:       ctx.String("http-user-agent"),
+		FetchPolicies:       fetchPolicies,
+		FetchRateLimit:      ctx.Float64("fetch-rate-limit"),
+		FetchRateBurst:      ctx.Int("fetch-rate-burst"),
+		FetchMaxConnections: ctx.Int("fetch-max-connections"),
+		UserMaxSize:         ctx.Int64("user-max-size"),
+		UserMaxCount:        ctx.Int64("user-max-count"),
+		MinFreeSpace:        ctx.Int64("min-free-space"),
+		StorageName:         ctx.String("storage-name"),
 	}
 
 	dirStorage := &storage.DirStorage{
@@ -147,6 +348,68 @@ func initAssets(ctx *cli.Context) (assets *service.Assets, err error) {
 		FilePerm:  os.FileMode(ctx.Uint("file-perm")),
 	}
 
+	// compressed blobs remain readable when compression is disabled
+	compressedStorage := &storage.CompressedStorage{
+		Dir:          dirStorage,
+		Codec:        ctx.String("compression"),
+		FrameSize:    ctx.Int64("compression-frame-size"),
+		MinSize:      ctx.Int64("compression-min-size"),
+		ContentTypes: ctx.StringSlice("compression-types"),
+	}
+	err = compressedStorage.Validate()
+	if err != nil {
+		err = errors.Wrap(err, "invalid value for compression flag")
+		return
+	}
+	var assetStorage storage.Storage = compressedStorage
+
+	if ctx.String("encryption-keyfile") != "" {
+		if compressedStorage.Codec != storage.CompressionNone {
+			err = errors.New("compression and encryption can not be enabled both")
+			return
+		}
+		var keyring *storage.Keyring
+		keyring, err = storage.LoadKeyring(ctx.String("encryption-keyfile"))
+		if err != nil {
+			err = errors.Wrap(err, "invalid value for encryption-keyfile flag")
+			return
+		}
+		// blobs stored before encryption was enabled remain readable until they are rekeyed
+		encryptedStorage := &storage.EncryptedStorage{
+			Dir:       dirStorage,
+			Keys:      keyring,
+			ChunkSize: ctx.Int64("encryption-chunk-size"),
+			Plain:     compressedStorage,
+		}
+		err = encryptedStorage.Validate()
+		if err != nil {
+			err = errors.Wrap(err, "invalid value for encryption-chunk-size flag")
+			return
+		}
+		assetStorage = encryptedStorage
+	}
+
+	if ctx.Bool("chunking") {
+		if assetStorage != compressedStorage || compressedStorage.Codec != storage.CompressionNone {
+			err = errors.New("chunking can not be enabled along with compression or encryption")
+			return
+		}
+		// blobs stored before chunking was enabled remain readable
+		chunkedStorage := &storage.ChunkedStorage{
+			Dir:     dirStorage,
+			MinSize: ctx.Int64("chunk-min-size"),
+			AvgSize: ctx.Int64("chunk-avg-size"),
+			MaxSize: ctx.Int64("chunk-max-size"),
+			Plain:   compressedStorage,
+		}
+		err = chunkedStorage.Validate()
+		if err != nil {
+			err = errors.Wrap(err, "invalid value for chunk size flags")
+			return
+		}
+		assetStorage = chunkedStorage
+	}
+
 	repo, err := initAssetRepo(ctx)
 	if err != nil {
 		err = errors.Wrap(err, "unable to init asset repo")
@@ -154,7 +417,7 @@ func initAssets(ctx *cli.Context) (assets *service.Assets, err error) {
 	}
 
 	assets = &service.Assets{
-		Storage:    dirStorage,
+		Storage:    assetStorage,
 		Repo:       repo,
 		Config:     assetsConf,
 		HttpClient: nil,
@@ -170,6 +433,7 @@ func main() {
 
 	err := app.RunContext(ctx, os.Args)
 	if err != nil {
-		log.Fatal(err)
+		utils.ContextLogger(ctx).Error("exit", "err", err)
+		os.Exit(1)
 	}
 }
@@ -0,0 +1,9 @@
+CREATE TABLE IF NOT EXISTS user_usage (
+      user_id varchar(32) not null primary key
+    , size bigint not null default 0
+    , count bigint not null default 0
+    , max_size bigint null default null
+    , max_count bigint null default null
+    , mtime timestamp null default null
+);
+CREATE INDEX IF NOT EXISTS asset_user_id ON asset (user_id, content_hash);
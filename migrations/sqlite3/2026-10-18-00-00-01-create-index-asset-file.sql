@@ -0,0 +1,4 @@
+CREATE INDEX IF NOT EXISTS asset_file_path ON asset (
+      COALESCE(user_id, '')
+    , json_extract(CASE WHEN json_valid(info) THEN info ELSE '{}' END, '$.file.absolutePath')
+);
@@ -4,19 +4,23 @@ import (
 	"context"
 	"fmt"
 	"io"
-	"log"
 	"net/http"
 	"net/url"
 	"path/filepath"
 	"regexp"
 	"runtime/debug"
+	"strconv"
+	"sync"
 	"time"
 
 	"github.com/bbars/assets/service/repository"
 	"github.com/bbars/assets/service/storage"
+	"github.com/bbars/assets/service/tracing"
 	"github.com/bbars/assets/service/types"
 	"github.com/bbars/assets/utils"
 	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel/attribute"
+	semconv "go.opentelemetry.io/otel/semconv/v1.17.0"
 )
 
 type Assets struct {
@@ -24,27 +28,37 @@ type Assets struct {
 	Repo    repository.Repository
 	Config  AssetsConfig
 
-	HttpClient                *http.Client
-	contentDispositionMatcher *regexp.Regexp
+	HttpClient         *http.Client
+	fetches            sync.WaitGroup
+	draining           int32
+	progress           sync.Map // asset key => *fetchProgress
+	fetchLimiters      map[string]*hostLimiter
+	fetchLimitersMu    sync.Mutex
+	fetchLimitersSwept time.Time
 }
 
-//goland:noinspection GoUnusedParameter
 func (a *Assets) DescribeByKey(ctx context.Context, assetKey string) (asset *types.Asset, err error) {
-	defer RecoverService(&err)
+	ctx, span := tracing.Start(ctx, "Assets.DescribeByKey", attribute.String("asset.key", assetKey))
+	defer tracing.End(span, &err)
+	defer RecoverService(ctx, &err)
 
-	asset, err = a.Repo.GetByAssetKey(assetKey)
+	asset, err = a.Repo.GetByAssetKey(ctx, assetKey)
 	if err != nil {
 		err = errors.Wrapf(err, "query asset by asset_key=%+q", assetKey)
 		return
 	}
+	if asset.Status == types.AssetStatus_processing {
+		asset.Progress = a.progressOf(assetKey)
+	}
 	return
 }
 
-//goland:noinspection GoUnusedParameter
 func (a *Assets) GetByKey(ctx context.Context, assetKey string, rng *utils.Range) (asset *types.Asset, rc io.ReadCloser, err error) {
-	defer RecoverService(&err)
+	ctx, span := tracing.Start(ctx, "Assets.GetByKey", attribute.String("asset.key", assetKey))
+	defer tracing.End(span, &err)
+	defer RecoverService(ctx, &err)
 
-	asset, err = a.Repo.GetByAssetKey(assetKey)
+	asset, err = a.Repo.GetByAssetKey(ctx, assetKey)
 	if err != nil {
 		err = errors.Wrapf(err, "query asset by asset_key=%+q", assetKey)
 		return
@@ -54,10 +68,64 @@ func (a *Assets) GetByKey(ctx context.Context, assetKey string, rng *utils.Range
 	return
 }
 
+// GetEncodedByKey opens the stored encoded (e.g. compressed) form of the asset if accept allows its encoding,
+// otherwise the asset contents are opened as by GetByKey and encoding is empty.
+func (a *Assets) GetEncodedByKey(ctx context.Context, assetKey string, accept func(encoding string) bool) (asset *types.Asset, rc io.ReadCloser, encoding string, size int64, err error) {
+	ctx, span := tracing.Start(ctx, "Assets.GetEncodedByKey", attribute.String("asset.key", assetKey))
+	defer tracing.End(span, &err)
+	defer RecoverService(ctx, &err)
+
+	asset, err = a.Repo.GetByAssetKey(ctx, assetKey)
+	if err != nil {
+		err = errors.Wrapf(err, "query asset by asset_key=%+q", assetKey)
+		return
+	}
+
+	if er, ok := a.Storage.(storage.EncodedReader); ok {
+		err = a.checkReadable(asset, nil)
+		if err != nil {
+			return
+		}
+		rc, encoding, size, err = er.OpenEncoded(ctx, asset.ContentHash)
+		if err != nil {
+			err = errors.Wrapf(err, "open encoded asset content_hash=%+q", asset.ContentHash)
+			return
+		}
+		if encoding != "" && accept(encoding) {
+			span.SetAttributes(attribute.String("asset.encoding", encoding))
+			return
+		}
+		if rc != nil {
+			_ = rc.Close()
+		}
+		rc, encoding, size = nil, "", 0
+	}
+
+	rc, err = a.readAsset(ctx, asset, nil)
+	size = asset.Size
+	return
+}
+
+// StoredEncoding returns encoding of the stored form of the blob (see GetEncodedByKey), empty if it is stored as is.
+func (a *Assets) StoredEncoding(ctx context.Context, contentHash string) (encoding string, err error) {
+	er, ok := a.Storage.(storage.EncodedReader)
+	if !ok {
+		return
+	}
+	encoding, err = er.Encoding(ctx, contentHash)
+	if err != nil {
+		err = errors.Wrapf(err, "find encoding of content_hash=%+q", contentHash)
+		return
+	}
+	return
+}
+
 func (a *Assets) GetByOriginalUrl(ctx context.Context, originalUrl string, rng *utils.Range) (asset *types.Asset, rc io.ReadCloser, err error) {
-	defer RecoverService(&err)
+	ctx, span := tracing.Start(ctx, "Assets.GetByOriginalUrl", attribute.String("asset.original_url", originalUrl))
+	defer tracing.End(span, &err)
+	defer RecoverService(ctx, &err)
 
-	asset, err = a.getByOriginalUrlOrNil(originalUrl)
+	asset, err = a.getByOriginalUrlOrNil(ctx, originalUrl)
 	if err != nil {
 		err = errors.Wrap(err, "find existing asset")
 		return
@@ -75,21 +143,122 @@ func (a *Assets) GetByOriginalUrl(ctx context.Context, originalUrl string, rng *
 		return
 	}
 
+	// closing rc closes the pipe, so the fetch goes on without streaming to the gone reader
 	r, w := io.Pipe()
-	rc = io.NopCloser(r)
-	assetCh := make(chan *types.Asset)
-	go func() {
-		asset, err = a.storeByOriginalUrl(ctx, originalUrl, assetCh, w)
-	}()
+	assetCh := make(chan *types.Asset, 1)
+	done := make(chan struct{})
+	var bgErr error
+	a.goFetch(func() {
+		_, bgErr = a.storeByOriginalUrl(ctx, &types.Asset{OriginalUrl: originalUrl}, assetCh, w)
+		close(done)
+		if bgErr != nil {
+			utils.ContextLogger(ctx).Error("background fetch failed", "originalUrl", originalUrl, "err", bgErr)
+		}
+	})
 	asset = <-assetCh
+	if asset == nil {
+		// nil means the fetch failed before the response body
+		_ = r.Close()
+		<-done
+		err = bgErr
+		if err == nil {
+			err = errors.New("fetch finished without asset")
+		}
+		return
+	}
+	rc = r
+	return
+}
+
+// HeadByKey does the same checks as GetByKey without opening the asset contents.
+func (a *Assets) HeadByKey(ctx context.Context, assetKey string, rng *utils.Range) (asset *types.Asset, err error) {
+	ctx, span := tracing.Start(ctx, "Assets.HeadByKey", attribute.String("asset.key", assetKey))
+	defer tracing.End(span, &err)
+	defer RecoverService(ctx, &err)
+
+	asset, err = a.Repo.GetByAssetKey(ctx, assetKey)
+	if err != nil {
+		err = errors.Wrapf(err, "query asset by asset_key=%+q", assetKey)
+		return
+	}
+
+	err = a.checkReadable(asset, rng)
+	return
+}
+
+// ListByUserId lists stored assets of the user (not deleted and done), oldest first.
+func (a *Assets) ListByUserId(ctx context.Context, userId string) (assets []*types.Asset, err error) {
+	ctx, span := tracing.Start(ctx, "Assets.ListByUserId", attribute.String("user.id", userId))
+	defer tracing.End(span, &err)
+	defer RecoverService(ctx, &err)
+
+	assets, err = a.Repo.ListByUserId(ctx, userId)
+	if err != nil {
+		err = errors.Wrapf(err, "query assets of user_id=%+q", userId)
+		return
+	}
+	return
+}
+
+// GetByFile finds the asset stored by the user from the local file (see storedir command)
+// unless the file has changed since then.
+func (a *Assets) GetByFile(ctx context.Context, userId string, absolutePath string, mtime time.Time, size int64) (asset *types.Asset, err error) {
+	ctx, span := tracing.Start(ctx, "Assets.GetByFile", attribute.String("file.path", absolutePath))
+	defer tracing.End(span, &err)
+	defer RecoverService(ctx, &err)
+
+	asset, err = a.Repo.GetByFile(ctx, userId, absolutePath, mtime, size)
+	if err != nil {
+		err = errors.Wrapf(err, "query asset by file %+q", absolutePath)
+		return
+	}
+	return
+}
+
+// HeadByOriginalUrl does the same checks as GetByOriginalUrl without opening the asset contents.
+// Unlike GetByOriginalUrl, it never starts fetching of an unknown URL.
+func (a *Assets) HeadByOriginalUrl(ctx context.Context, originalUrl string, rng *utils.Range) (asset *types.Asset, err error) {
+	ctx, span := tracing.Start(ctx, "Assets.HeadByOriginalUrl", attribute.String("asset.original_url", originalUrl))
+	defer tracing.End(span, &err)
+	defer RecoverService(ctx, &err)
+
+	asset, err = a.getByOriginalUrlOrNil(ctx, originalUrl)
+	if err != nil {
+		err = errors.Wrap(err, "find existing asset")
+		return
+	} else if asset == nil {
+		err = errors.Wrapf(repository.ErrNotFound, "query asset by original_url=%+q", originalUrl)
+		return
+	}
+
+	err = a.checkReadable(asset, rng)
 	return
 }
 
-//goland:noinspection GoUnusedParameter
 func (a *Assets) readAsset(ctx context.Context, asset *types.Asset, rng *utils.Range) (rc io.ReadCloser, err error) {
+	err = a.checkReadable(asset, rng)
+	if err != nil {
+		return
+	}
+
+	rc, err = a.Storage.OpenRead(ctx, asset.ContentHash, rng)
+	if err != nil {
+		err = errors.Wrapf(err, "open asset content_hash=%+q", asset.ContentHash)
+		return
+	}
+	return
+}
+
+// checkReadable ensures the asset contents are available and normalizes the range.
+func (a *Assets) checkReadable(asset *types.Asset, rng *utils.Range) (err error) {
+	if asset.Deleted {
+		err = NewError(ErrorCode_notFound, errors.Errorf("asset asset_key=%+q is deleted", asset.AssetKey))
+		return
+	}
+
 	if asset.Status == types.AssetStatus_pending || asset.Status == types.AssetStatus_processing {
 		if asset.OriginalUrl == "" {
-			err = errors.Errorf("found asset is not done yet, status=%s", asset.Status)
+			err = NewError(ErrorCode_conflict, errors.Errorf("found asset is not done yet, status=%s", asset.Status))
 		} else {
 			err = &SeeUrlError{
 				Url: asset.OriginalUrl,
@@ -100,7 +269,7 @@ func (a *Assets) readAsset(ctx context.Context, asset *types.Asset, rng *utils.R
 	}
 
 	if asset.Error != "" {
-		err = errors.Errorf("open asset content_hash=%+q: %s", asset.ContentHash, asset.Error)
+		err = NewError(ErrorCode_unavailable, errors.Errorf("open asset content_hash=%+q: %s", asset.ContentHash, asset.Error))
 		return
 	}
 
@@ -111,24 +280,26 @@ func (a *Assets) readAsset(ctx context.Context, asset *types.Asset, rng *utils.R
 			return
 		}
 	}
-
-	rc, err = a.Storage.OpenRead(asset.ContentHash, rng)
-	if err != nil {
-		err = errors.Wrapf(err, "open asset content_hash=%+q", asset.ContentHash)
-		return
-	}
 	return
 }
 
-//goland:noinspection GoUnusedParameter
 func (a *Assets) Store(ctx context.Context, extra *types.Asset, data io.Reader) (asset *types.Asset, err error) {
-	defer RecoverService(&err)
+	ctx, span := tracing.Start(ctx, "Assets.Store", attribute.String("user.id", extra.UserId))
+	defer tracing.End(span, &err)
+	defer RecoverService(ctx, &err)
+
+	err = a.checkUserQuota(ctx, extra.UserId, 1)
+	if err != nil {
+		err = errors.Wrap(err, "check user quota")
+		return
+	}
 
-	_, contentHash, size, err := a.Storage.Write(data, a.Config.MaxSize)
+	exists, contentHash, size, err := a.writeByUser(ctx, extra.UserId, data, a.Config.MaxSize)
 	if err != nil {
 		err = errors.Wrap(err, "write asset")
 		return
 	}
+	observeStorageWrite(exists, size)
 
 	asset = &types.Asset{
 		AssetKey:     utils.GenerateQid(types.AssetKeyLen),
@@ -139,32 +310,104 @@ func (a *Assets) Store(ctx context.Context, extra *types.Asset, data io.Reader)
 		ContentHash:  contentHash,
 		ContentType:  extra.ContentType,
 		OriginalName: extra.OriginalName,
-		UserId:       "",
+		UserId:       extra.UserId,
 		OriginalUrl:  extra.OriginalUrl,
 		Deleted:      false,
-		StorageName:  "",
+		StorageName:  a.Config.StorageName,
 		Status:       types.AssetStatus_done,
+		Dedup:        exists,
 		Info:         extra.Info,
 		Error:        "",
 	}
-	err = a.Repo.Insert(asset)
+	err = a.Repo.Insert(ctx, asset)
 	if err != nil {
 		err = errors.Wrap(err, "save done asset")
 		return
 	}
+	err = a.verifyUserQuota(ctx, asset)
+	if err != nil {
+		asset = nil
+		return
+	}
+	return
+}
+
+func (a *Assets) DeleteByKey(ctx context.Context, assetKey string) (asset *types.Asset, err error) {
+	ctx, span := tracing.Start(ctx, "Assets.DeleteByKey", attribute.String("asset.key", assetKey))
+	defer tracing.End(span, &err)
+	defer RecoverService(ctx, &err)
+
+	asset, err = a.Repo.GetByAssetKey(ctx, assetKey)
+	if err != nil {
+		err = errors.Wrapf(err, "query asset by asset_key=%+q", assetKey)
+		return
+	}
+	if asset.Deleted {
+		return
+	}
+
+	now := time.Now()
+	asset.Deleted = true
+	asset.Dtime = &now
+	err = a.Repo.Update(ctx, asset)
+	if err != nil {
+		err = errors.Wrap(err, "save deleted asset")
+		return
+	}
 	return
 }
 
-func (a *Assets) StoreByOriginalUrl(ctx context.Context, originalUrl string, wait bool) (asset *types.Asset, err error) {
-	defer RecoverService(&err)
+// UpdateMetaByKey modifies mutable metadata of the asset, the contents stay untouched.
+func (a *Assets) UpdateMetaByKey(ctx context.Context, assetKey string, meta *types.AssetMeta) (asset *types.Asset, err error) {
+	ctx, span := tracing.Start(ctx, "Assets.UpdateMetaByKey", attribute.String("asset.key", assetKey))
+	defer tracing.End(span, &err)
+	defer RecoverService(ctx, &err)
+
+	asset, err = a.Repo.GetByAssetKey(ctx, assetKey)
+	if err != nil {
+		err = errors.Wrapf(err, "query asset by asset_key=%+q", assetKey)
+		return
+	}
+	if asset.Deleted {
+		err = NewError(ErrorCode_notFound, errors.Errorf("asset asset_key=%+q is deleted", asset.AssetKey))
+		return
+	}
 
-	asset, err = a.getByOriginalUrlOrNil(originalUrl)
+	if meta.ContentType != nil {
+		asset.ContentType = *meta.ContentType
+	}
+	if meta.OriginalName != nil {
+		asset.OriginalName = *meta.OriginalName
+	}
+	if meta.Info != nil {
+		asset.Info = *meta.Info
+	}
+	now := time.Now()
+	asset.Mtime = &now
+	err = a.Repo.Update(ctx, asset)
+	if err != nil {
+		err = errors.Wrap(err, "save asset meta")
+		return
+	}
+	return
+}
+
+// StoreByOriginalUrl starts fetching of the original URL unless it's already stored.
+// With wait it returns the fetched asset if the remote object size is known and
+// doesn't exceed Config.MaxRemoteWaitSize, otherwise the asset is returned being processed.
+func (a *Assets) StoreByOriginalUrl(ctx context.Context, originalUrl string, userId string, wait bool) (asset *types.Asset, err error) {
+	ctx, span := tracing.Start(ctx, "Assets.StoreByOriginalUrl", attribute.String("asset.original_url", originalUrl))
+	defer tracing.End(span, &err)
+	defer RecoverService(ctx, &err)
+
+	asset, err = a.getByOriginalUrlOrNil(ctx, originalUrl)
 	if err != nil {
 		err = errors.Wrap(err, "find existing asset")
 		return
 	}
 	if asset != nil {
 		if asset.Error == "" {
+			asset.Dedup = true
 			return
 		} else {
 			// another try to fetch
@@ -178,52 +421,97 @@ func (a *Assets) StoreByOriginalUrl(ctx context.Context, originalUrl string, wai
 		return
 	}
 
-	//ctxStore, cancel := context.WithCancel(ctx)
-	//defer cancel()
-	prepAssetCh := make(chan *types.Asset)
+	err = a.checkUserQuota(ctx, userId, 1)
+	if err != nil {
+		err = errors.Wrap(err, "check user quota")
+		return
+	}
+
+	// the fetch may outlive the caller even with wait (see AssetsConfig.MaxRemoteWaitSize)
+	fetchCtx := backgroundOf(ctx)
+	prepAssetCh := make(chan *types.Asset, 1)
 	done := make(chan struct{})
-	go func() {
-		asset, err = a.storeByOriginalUrl(ctx, originalUrl, prepAssetCh, nil)
+	var bgAsset *types.Asset
+	var bgErr error
+	a.goFetch(func() {
+		bgAsset, bgErr = a.storeByOriginalUrl(fetchCtx, &types.Asset{OriginalUrl: originalUrl, UserId: userId}, prepAssetCh, nil)
 		close(done)
-		log.Printf("background asset done with asset_key=%+q", asset.AssetKey)
-		if err != nil {
-			log.Printf("background error: %s\n", err.Error())
+		logger := utils.ContextLogger(fetchCtx).With("assetKey", bgAsset.AssetKey, "originalUrl", originalUrl)
+		if bgErr != nil {
+			logger.Error("background fetch failed", "err", bgErr)
+		} else {
+			logger.Info("background fetch done", "size", bgAsset.Size)
 		}
-	}()
+	})
 
 	select {
 	case <-ctx.Done():
-		err = errors.New("cancelled")
+		err = errors.Wrap(ctx.Err(), "wait for processing asset")
+		return
 	case asset = <-prepAssetCh:
 	}
-	if wait {
-		<-done
+	if asset == nil || (wait && a.canWait(asset.Size)) {
+		// nil means the fetch failed before the response body, so wait for the error
+		select {
+		case <-ctx.Done():
+			err = errors.Wrap(ctx.Err(), "wait for fetch")
+			return
+		case <-done:
+		}
+		asset, err = bgAsset, bgErr
 	}
 	return
 }
 
+// bestEffortWriter writes to w until it fails (e.g. the reader of the pipe is gone), the rest is discarded.
+type bestEffortWriter struct {
+	w      io.Writer
+	failed bool
+}
+
+func (bw *bestEffortWriter) Write(p []byte) (n int, err error) {
+	if !bw.failed {
+		_, err = bw.w.Write(p)
+		bw.failed = err != nil
+	}
+	return len(p), nil
+}
+
+// canWait reports whether the fetch of the remote object of the size is short enough to wait for it.
+func (a *Assets) canWait(size int64) bool {
+	if a.Config.MaxRemoteWaitSize <= 0 {
+		return true
+	}
+	return 0 <= size && size <= a.Config.MaxRemoteWaitSize
+}
+
 func (a *Assets) checkOriginalUrl(originalUrl string) (err error) {
 	if originalUrl == "" {
-		err = errors.New("value of originalUrl can't be empty")
+		err = NewError(ErrorCode_invalid, errors.New("value of originalUrl can't be empty"))
 		return
 	}
 	if a.Config.OriginalUrlPattern == nil {
-		err = errors.New("not allowed, because OriginalUrlPattern is nil")
+		err = NewError(ErrorCode_forbidden, errors.New("not allowed, because OriginalUrlPattern is nil"))
 		return
 	}
 	if !a.Config.OriginalUrlPattern.Match([]byte(originalUrl)) {
-		err = errors.New("not allowed, because originalUrl doesn't match OriginalUrlPattern")
+		err = NewError(ErrorCode_forbidden, errors.New("not allowed, because originalUrl doesn't match OriginalUrlPattern"))
 		return
 	}
 	return
 }
 
-func (a *Assets) getByOriginalUrlOrNil(originalUrl string) (asset *types.Asset, err error) {
+func (a *Assets) getByOriginalUrlOrNil(ctx context.Context, originalUrl string) (asset *types.Asset, err error) {
+	if originalUrl == "" {
+		// assets stored directly have empty original_url
+		err = NewError(ErrorCode_invalid, errors.New("value of originalUrl can't be empty"))
+		return
+	}
 	// find an asset without error first
-	asset, err = a.Repo.GetByOriginalUrl(originalUrl, false)
+	asset, err = a.Repo.GetByOriginalUrl(ctx, originalUrl, false)
 	if err != nil && errors.Is(err, repository.ErrNotFound) {
 		// if nothing found, then allow error and try again
-		asset, err = a.Repo.GetByOriginalUrl(originalUrl, true)
+		asset, err = a.Repo.GetByOriginalUrl(ctx, originalUrl, true)
 		if err != nil && errors.Is(err, repository.ErrNotFound) {
 			err = nil
 		}
@@ -235,55 +523,124 @@ func (a *Assets) getByOriginalUrlOrNil(originalUrl string) (asset *types.Asset,
 	return
 }
 
-func (a *Assets) storeByOriginalUrl(ctx context.Context, originalUrl string, prepAssetCh chan<- *types.Asset, wc io.WriteCloser) (asset *types.Asset, err error) {
-	defer RecoverService(&err)
+// storeByOriginalUrl fetches the asset.OriginalUrl into the storage.
+// A new asset is created unless asset.AssetKey is set, in which case the existing one is fetched again.
+func (a *Assets) storeByOriginalUrl(ctx context.Context, asset *types.Asset, prepAssetCh chan<- *types.Asset, pw *io.PipeWriter) (fetched *types.Asset, err error) {
+	ctx, span := tracing.Start(ctx, "Assets.fetch", attribute.String("asset.original_url", asset.OriginalUrl))
+	defer tracing.End(span, &err)
+	defer RecoverService(ctx, &err)
+
+	fetched = asset
 
 	defer func() {
-		close(prepAssetCh)
+		if prepAssetCh != nil {
+			close(prepAssetCh)
+		}
+		if pw != nil {
+			// the reader gets the error of the fetch, unless the contents are streamed already
+			_ = pw.CloseWithError(err)
+		}
 	}()
 
-	asset = &types.Asset{
-		AssetKey:    "",
-		Btime:       time.Now(),
-		OriginalUrl: originalUrl,
-		Status:      types.AssetStatus_processing,
+	originalUrl := asset.OriginalUrl
+	asset.Status = types.AssetStatus_processing
+	asset.Error = ""
+	asset.StorageName = a.Config.StorageName
+	if asset.AssetKey == "" {
+		asset.Btime = time.Now()
+		asset.GenerateAssetKey()
+		span.SetAttributes(attribute.String("asset.key", asset.AssetKey))
+		err = a.Repo.Insert(ctx, asset)
+	} else {
+		err = a.Repo.Update(ctx, asset)
 	}
-	asset.GenerateAssetKey()
-
-	err = a.Repo.Insert(asset)
 	if err != nil {
 		err = errors.Wrap(err, "save processing asset")
 		return
 	}
 	defer func() {
 		asset.Status = types.AssetStatus_done
-		if err != nil {
+		if err != nil && ctx.Err() != nil && a.isDraining() {
+			// interrupted by shutdown, so leave it to be resumed on next start
+			asset.Status = types.AssetStatus_pending
+		} else if err != nil {
 			asset.Error = fmt.Sprintf("%s", err.Error())
 		}
-		updErr := a.Repo.Update(asset)
+		// the fetch may be cancelled, but its result must be saved anyway
+		saveCtx := utils.ContextDetach(ctx)
+		updErr := a.Repo.Update(saveCtx, asset)
+		a.untrackProgress(asset.AssetKey)
 		if updErr != nil && err == nil {
 			err = errors.Wrap(updErr, "save done asset")
 		}
+		if err == nil {
+			err = a.verifyUserQuota(saveCtx, asset)
+		}
 	}()
 
 	httpCtx, cancel := context.WithCancel(ctx)
 	defer func() {
 		cancel()
 	}()
+	// redirect targets must be allowed the same way as the original URL
+	httpCtx = withRedirectCheck(httpCtx, a.checkOriginalUrl)
 	request, err := http.NewRequestWithContext(httpCtx, http.MethodGet, originalUrl, nil)
 	if err != nil {
 		err = errors.Wrapf(err, "prepare request to pull remote object %+q", originalUrl)
 		return
 	}
 	request.Header.Set("user-agent", a.Config.HttpUserAgent)
-	response, err := a.getHttpClient().Do(request)
+	policy := a.Config.FetchPolicies.Match(request.URL.Hostname())
+	if policy != nil {
+		err = policy.Prepare(request)
+		if err != nil {
+			err = errors.Wrapf(err, "apply fetch policy to %+q", originalUrl)
+			return
+		}
+	}
+	prepAssetSent := false
+	sendPrepAsset := func() {
+		if prepAssetCh == nil || prepAssetSent {
+			return
+		}
+		prepAssetSent = true
+		assetCopy := &types.Asset{}
+		*assetCopy = *asset
+		prepAssetCh <- assetCopy
+	}
+	release, err := a.acquireFetch(ctx, request.URL.Host, policy, func() {
+		// the caller must not wait for the queue, the size is unknown until the response
+		asset.Size = -1
+		sendPrepAsset()
+	})
+	if err != nil {
+		return
+	}
+	defer release()
+	response, err := a.doFetchRequest(request, policy)
 	if err != nil {
+		metricFetches.Inc("failure", "")
 		err = errors.Wrapf(err, "fetch remote object %+q", originalUrl)
 		return
 	}
+	defer func() {
+		result := "success"
+		if err != nil {
+			result = "failure"
+		}
+		metricFetches.Inc(result, strconv.Itoa(response.StatusCode))
+	}()
+
+	utils.ContextLogger(ctx).Debug(
+		"fetch response",
+		"assetKey", asset.AssetKey,
+		"originalUrl", originalUrl,
+		"status", response.StatusCode,
+		"contentLength", response.ContentLength,
+	)
 
 	if 200 > response.StatusCode || response.StatusCode >= 300 {
-		err = errors.Errorf("http status %s", response.Status)
+		err = NewError(ErrorCode_unavailable, errors.Errorf("http status %s", response.Status))
 		return
 	}
 
@@ -291,63 +648,72 @@ func (a *Assets) storeByOriginalUrl(ctx context.Context, originalUrl string, pre
 
 	asset.OriginalName = a.extractOriginalName(response.Header.Get("content-disposition"), originalUrl)
 
+	// unknown content length (-1) is allowed, limits are enforced while streaming then
 	contentLength := response.ContentLength
-	if a.Config.MaxRemoteSize > 0 {
-		if contentLength < 0 {
-			err = errors.Errorf("remote size is unknown while the limit is enabled (max-remote-size=%d)", a.Config.MaxRemoteSize)
-			return
-		}
-		if contentLength > a.Config.MaxRemoteSize {
-			err = errors.Errorf("remote size %d exceeds limit max-remote-size=%d", contentLength, a.Config.MaxRemoteSize)
-			return
-		}
+	if a.Config.MaxRemoteSize > 0 && contentLength > a.Config.MaxRemoteSize {
+		err = errors.Wrapf(storage.ErrTooLarge, "remote size %d exceeds limit max-remote-size=%d", contentLength, a.Config.MaxRemoteSize)
+		return
+	}
+	if a.Config.MaxSize > 0 && contentLength > a.Config.MaxSize {
+		err = errors.Wrapf(storage.ErrTooLarge, "remote size %d exceeds limit max-size=%d", contentLength, a.Config.MaxSize)
+		return
 	}
 	asset.Size = contentLength
+	maxSize := minLimit(a.Config.MaxRemoteSize, a.Config.MaxSize)
 
-	if a.Config.MaxSize > 0 {
-		if contentLength < 0 {
-			err = errors.Errorf("remote size is unknown while the limit is enabled (max-size=%d)", a.Config.MaxSize)
-			return
-		}
-		if contentLength > a.Config.MaxSize {
-			err = errors.Errorf("remote size %d exceeds limit max-size=%d", contentLength, a.Config.MaxSize)
-			return
-		}
-	}
+	sendPrepAsset()
 
-	if prepAssetCh != nil {
-		assetCopy := &types.Asset{}
-		*assetCopy = *asset
-		prepAssetCh <- assetCopy
-	}
+	body := a.trackProgress(asset.AssetKey, contentLength, response.Body)
 
+	var exists bool
 	var contentHash string
 	var size int64
-	if wc == nil {
-		_, contentHash, size, err = a.Storage.Write(response.Body, a.Config.MaxSize)
+	if pw == nil {
+		exists, contentHash, size, err = a.writeByUser(ctx, asset.UserId, body, maxSize)
 	} else {
-		defer func() {
-			closeErr := wc.Close()
-			if closeErr != nil && err == nil {
-				err = errors.Wrap(closeErr, "close writer")
-				return
-			}
-		}()
-		tee := io.TeeReader(response.Body, wc)
-
-		_, contentHash, size, err = a.Storage.Write(tee, a.Config.MaxSize)
+		tee := io.TeeReader(body, &bestEffortWriter{w: pw})
+		exists, contentHash, size, err = a.writeByUser(ctx, asset.UserId, tee, maxSize)
+		// the reader gets the contents before the asset is saved
+		_ = pw.CloseWithError(err)
 	}
 
 	asset.ContentHash = contentHash
 	asset.Size = size
+	asset.Dedup = exists
 	if err != nil {
 		err = errors.Wrapf(err, "storage write for asset asset_key=%+q", asset.AssetKey)
 		return
 	}
+	observeStorageWrite(exists, size)
 
 	return
 }
 
+// doFetchRequest sends the request within a client span propagating the trace context to the remote side.
+// The request is sent by the client of the policy if any.
+func (a *Assets) doFetchRequest(request *http.Request, policy *FetchPolicy) (response *http.Response, err error) {
+	ctx, span := tracing.StartClient(
+		request.Context(),
+		"HTTP "+request.Method,
+		semconv.HTTPMethod(request.Method),
+		semconv.HTTPURL(request.URL.String()),
+	)
+	defer tracing.End(span, &err)
+
+	request = request.WithContext(ctx)
+	tracing.Inject(ctx, request.Header)
+	if policy != nil {
+		response, err = policy.Do(request)
+	} else {
+		response, err = a.getRedirectCheckingClient().Do(request)
+	}
+	if err != nil {
+		return
+	}
+	span.SetAttributes(semconv.HTTPStatusCode(response.StatusCode))
+	return
+}
+
 func (a *Assets) getHttpClient() *http.Client {
 	if a.HttpClient == nil {
 		return http.DefaultClient
@@ -355,14 +721,32 @@ func (a *Assets) getHttpClient() *http.Client {
 	return a.HttpClient
 }
 
-func (a *Assets) extractOriginalName(contentDisposition string, originalUrl string) string {
-	// TODO optimize
-	if a.contentDispositionMatcher == nil {
-		a.contentDispositionMatcher = regexp.MustCompile(
-			`\*?filename="([^"]+)|\*?filename='([^']+)|\*?filename=([^;]+)`,
-		)
+// getRedirectCheckingClient returns copy of the client checking redirect targets (see withRedirectCheck).
+func (a *Assets) getRedirectCheckingClient() *http.Client {
+	client := *a.getHttpClient()
+	checkRedirect := client.CheckRedirect
+	client.CheckRedirect = func(request *http.Request, via []*http.Request) error {
+		err := checkRedirectTarget(request)
+		if err != nil {
+			return err
+		}
+		if checkRedirect != nil {
+			return checkRedirect(request, via)
+		}
+		if len(via) >= defaultMaxRedirects {
+			return errors.Errorf("stopped after %d redirects", defaultMaxRedirects)
+		}
+		return nil
 	}
-	m := a.contentDispositionMatcher.FindStringSubmatch(contentDisposition)
+	return &client
+}
+
+var contentDispositionMatcher = regexp.MustCompile(
+	`\*?filename="([^"]+)|\*?filename='([^']+)|\*?filename=([^;]+)`,
+)
+
+func (a *Assets) extractOriginalName(contentDisposition string, originalUrl string) string {
+	m := contentDispositionMatcher.FindStringSubmatch(contentDisposition)
 	for _, s := range m {
 		if s != "" {
 			return s
@@ -376,14 +760,14 @@ func (a *Assets) extractOriginalName(contentDisposition string, originalUrl stri
 	return ""
 }
 
-func RecoverService(err *error) {
+func RecoverService(ctx context.Context, err *error) {
 	if r := recover(); r != nil {
-		log.Printf(
-			"RECOVERED PANIC: %v\n%s\n",
-			r,
-			string(debug.Stack()),
+		utils.ContextLogger(ctx).Error(
+			"recovered panic",
+			"panic", fmt.Sprint(r),
+			"stack", string(debug.Stack()),
 		)
-		*err = fmt.Errorf("internal error: %+v", r)
+		*err = NewError(ErrorCode_internal, fmt.Errorf("internal error: %+v", r))
 	}
 }
 
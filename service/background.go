@@ -0,0 +1,25 @@
+package service
+
+import (
+	"context"
+
+	"github.com/bbars/assets/utils"
+)
+
+type backgroundKey struct{}
+
+// ContextWithBackground sets the context for work which outlives the request (like a fetch by URL),
+// so it is not cancelled by the client, but it is cancelled by bgCtx (on shutdown).
+func ContextWithBackground(ctx context.Context, bgCtx context.Context) context.Context {
+	return context.WithValue(ctx, backgroundKey{}, bgCtx)
+}
+
+// backgroundOf returns the context for work which outlives the request, keeping values of the request.
+// It is the request context itself if no background is set.
+func backgroundOf(ctx context.Context) context.Context {
+	bgCtx, ok := ctx.Value(backgroundKey{}).(context.Context)
+	if !ok {
+		return ctx
+	}
+	return utils.ContextRebase(ctx, bgCtx)
+}
@@ -0,0 +1,272 @@
+package service
+
+import (
+	"archive/tar"
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/bbars/assets/service/tracing"
+	"github.com/bbars/assets/utils"
+	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+const (
+	BackupDbName       = "assets.db"
+	BackupBlobsName    = "blobs.tar"
+	BackupManifestName = "manifest.json"
+)
+
+// BackupManifest describes a backup made by Assets.Backup.
+type BackupManifest struct {
+	// Created - time of the metadata snapshot
+	Created time.Time `json:"created"`
+
+	// Base - absolute path of the backup this one is incremental to (blobs missing here are there)
+	Base string `json:"base,omitempty"`
+
+	// Blobs - sizes of all blobs referenced by the snapshot by content hash
+	Blobs map[string]int64 `json:"blobs"`
+
+	// Archived - number of blobs archived by this backup
+	Archived int `json:"archived"`
+
+	// ArchivedSize - total size of blobs archived by this backup
+	ArchivedSize int64 `json:"archivedSize"`
+}
+
+// Backup writes to the directory the snapshot of metadata, tar archive of blobs named by content hash
+// and the manifest. If baseDir is set, blobs listed in its manifest are not archived again.
+func (a *Assets) Backup(ctx context.Context, dir string, baseDir string) (manifest *BackupManifest, err error) {
+	ctx, span := tracing.Start(ctx, "Assets.Backup", attribute.String("backup.dir", dir))
+	defer tracing.End(span, &err)
+	defer RecoverService(ctx, &err)
+
+	var base *BackupManifest
+	if baseDir != "" {
+		base, err = ReadBackupManifest(baseDir)
+		if err != nil {
+			err = errors.Wrap(err, "read base backup")
+			return
+		}
+		baseDir, err = filepath.Abs(baseDir)
+		if err != nil {
+			return
+		}
+	}
+
+	err = os.MkdirAll(dir, 0755)
+	if err != nil {
+		err = errors.Wrap(err, "create backup directory")
+		return
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		err = errors.Wrap(err, "read backup directory")
+		return
+	}
+	if len(entries) > 0 {
+		err = NewError(ErrorCode_conflict, errors.Errorf("backup directory %+q is not empty", dir))
+		return
+	}
+
+	manifest = &BackupManifest{
+		Created: time.Now(),
+		Base:    baseDir,
+	}
+	manifest.Blobs, err = a.Repo.Backup(ctx, filepath.Join(dir, BackupDbName))
+	if err != nil {
+		err = errors.Wrap(err, "backup metadata")
+		return
+	}
+
+	contentHashes := make([]string, 0, len(manifest.Blobs))
+	for contentHash := range manifest.Blobs {
+		if base != nil {
+			if _, ok := base.Blobs[contentHash]; ok {
+				continue
+			}
+		}
+		contentHashes = append(contentHashes, contentHash)
+	}
+	sort.Strings(contentHashes)
+	err = a.archiveBlobs(ctx, filepath.Join(dir, BackupBlobsName), contentHashes, manifest)
+	if err != nil {
+		err = errors.Wrap(err, "backup blobs")
+		return
+	}
+
+	// the manifest is written last to mark the backup complete
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		err = errors.Wrap(err, "encode manifest")
+		return
+	}
+	err = os.WriteFile(filepath.Join(dir, BackupManifestName), data, 0644)
+	if err != nil {
+		err = errors.Wrap(err, "write manifest")
+		return
+	}
+	return
+}
+
+func (a *Assets) archiveBlobs(ctx context.Context, path string, contentHashes []string, manifest *BackupManifest) (err error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return
+	}
+	defer func() {
+		closeErr := f.Close()
+		if closeErr != nil && err == nil {
+			err = closeErr
+		}
+	}()
+
+	tw := tar.NewWriter(f)
+	for _, contentHash := range contentHashes {
+		err = a.archiveBlob(ctx, tw, contentHash, manifest.Blobs[contentHash])
+		if err != nil {
+			err = errors.Wrapf(err, "archive blob %s", contentHash)
+			return
+		}
+		manifest.Archived++
+		manifest.ArchivedSize += manifest.Blobs[contentHash]
+	}
+	err = tw.Close()
+	return
+}
+
+func (a *Assets) archiveBlob(ctx context.Context, tw *tar.Writer, contentHash string, size int64) (err error) {
+	rc, err := a.Storage.OpenRead(ctx, contentHash, nil)
+	if err != nil {
+		return
+	}
+	defer rc.Close()
+
+	err = tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     contentHash,
+		Size:     size,
+		Mode:     0644,
+		ModTime:  time.Now(),
+	})
+	if err != nil {
+		return
+	}
+	// fails if the blob size differs from the asset one
+	_, err = io.Copy(tw, rc)
+	return
+}
+
+// Restore replaces metadata with the snapshot of the backup and writes to the storage blobs
+// missing there, looking for them in the backup and its base ones.
+// The count of restored blobs is returned.
+func (a *Assets) Restore(ctx context.Context, dir string) (restored int, err error) {
+	ctx, span := tracing.Start(ctx, "Assets.Restore", attribute.String("backup.dir", dir))
+	defer tracing.End(span, &err)
+	defer RecoverService(ctx, &err)
+
+	manifest, err := ReadBackupManifest(dir)
+	if err != nil {
+		return
+	}
+
+	missing := make(map[string]bool)
+	for contentHash := range manifest.Blobs {
+		var exists bool
+		exists, err = a.Storage.Check(ctx, contentHash)
+		if err != nil {
+			err = errors.Wrapf(err, "check blob %s", contentHash)
+			return
+		}
+		if !exists {
+			missing[contentHash] = true
+		}
+	}
+
+	// blobs are restored before metadata, so the assets are readable as soon as they appear
+	for backupDir := dir; backupDir != "" && len(missing) > 0; {
+		var n int
+		n, err = a.extractBlobs(ctx, filepath.Join(backupDir, BackupBlobsName), missing)
+		restored += n
+		if err != nil {
+			err = errors.Wrapf(err, "restore blobs from %+q", backupDir)
+			return
+		}
+		utils.ContextLogger(ctx).Debug("blobs restored", "backup", backupDir, "count", n, "missing", len(missing))
+
+		var backup *BackupManifest
+		backup, err = ReadBackupManifest(backupDir)
+		if err != nil {
+			return
+		}
+		backupDir = backup.Base
+	}
+	if len(missing) > 0 {
+		err = errors.Errorf("%d blobs are not found in the backup and its base ones", len(missing))
+		return
+	}
+
+	err = a.Repo.Restore(ctx, filepath.Join(dir, BackupDbName))
+	if err != nil {
+		err = errors.Wrap(err, "restore metadata")
+		return
+	}
+	return
+}
+
+// extractBlobs writes missing blobs found in the archive to the storage, found ones are removed from missing.
+func (a *Assets) extractBlobs(ctx context.Context, path string, missing map[string]bool) (restored int, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	tr := tar.NewReader(f)
+	for {
+		var header *tar.Header
+		header, err = tr.Next()
+		if err == io.EOF {
+			err = nil
+			return
+		} else if err != nil {
+			return
+		}
+		if !missing[header.Name] {
+			continue
+		}
+		var contentHash string
+		_, contentHash, _, err = a.Storage.Write(ctx, tr, 0)
+		if err != nil {
+			err = errors.Wrapf(err, "write blob %s", header.Name)
+			return
+		}
+		if contentHash != header.Name {
+			err = errors.Errorf("blob %s is corrupted, its content hash is %s", header.Name, contentHash)
+			return
+		}
+		delete(missing, header.Name)
+		restored++
+	}
+}
+
+func ReadBackupManifest(dir string) (manifest *BackupManifest, err error) {
+	data, err := os.ReadFile(filepath.Join(dir, BackupManifestName))
+	if err != nil {
+		err = errors.Wrap(err, "read backup manifest")
+		return
+	}
+	manifest = &BackupManifest{}
+	err = json.Unmarshal(data, manifest)
+	if err != nil {
+		err = errors.Wrapf(err, "decode backup manifest of %+q", dir)
+		return
+	}
+	return
+}
@@ -5,9 +5,17 @@ import (
 )
 
 type AssetsConfig struct {
-	MaxRemoteSize      int64
-	MaxRemoteWaitSize  int64
-	MaxSize            int64
-	OriginalUrlPattern *regexp.Regexp
-	HttpUserAgent      string
+	MaxRemoteSize       int64
+	MaxRemoteWaitSize   int64
+	MaxSize             int64
+	OriginalUrlPattern  *regexp.Regexp
+	HttpUserAgent       string
+	FetchPolicies       FetchPolicies
+	FetchRateLimit      float64
+	FetchRateBurst      int
+	FetchMaxConnections int
+	UserMaxSize         int64
+	UserMaxCount        int64
+	MinFreeSpace        int64
+	StorageName         string
 }
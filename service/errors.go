@@ -0,0 +1,72 @@
+package service
+
+import (
+	"context"
+
+	"github.com/bbars/assets/service/repository"
+	"github.com/bbars/assets/service/storage"
+	"github.com/bbars/assets/utils"
+	"github.com/pkg/errors"
+)
+
+// ErrorCode - stable machine-readable class of a service error
+type ErrorCode string
+
+const (
+	ErrorCode_invalid     = ErrorCode("invalid")
+	ErrorCode_notFound    = ErrorCode("not_found")
+	ErrorCode_forbidden   = ErrorCode("forbidden")
+	ErrorCode_tooLarge    = ErrorCode("too_large")
+	ErrorCode_conflict    = ErrorCode("conflict")
+	ErrorCode_unavailable = ErrorCode("unavailable")
+	ErrorCode_internal    = ErrorCode("internal")
+)
+
+// Error assigns the code to the wrapped error.
+type Error struct {
+	Code ErrorCode
+	Err  error
+}
+
+var _ error = &Error{}
+
+func NewError(code ErrorCode, err error) error {
+	return &Error{
+		Code: code,
+		Err:  err,
+	}
+}
+
+func (err *Error) Error() string {
+	return err.Err.Error()
+}
+
+func (err *Error) Unwrap() error {
+	return err.Err
+}
+
+// ErrorCodeOf classifies the error: the outermost *Error wins,
+// well-known sentinel errors are recognized, anything else is internal.
+func ErrorCodeOf(err error) ErrorCode {
+	if err == nil {
+		return ""
+	}
+	serviceErr := &Error{}
+	rangeErr := &utils.RangeError{}
+	switch {
+	case errors.As(err, &serviceErr):
+		return serviceErr.Code
+	case errors.As(err, &rangeErr):
+		return ErrorCode_invalid
+	case errors.Is(err, repository.ErrNotFound):
+		return ErrorCode_notFound
+	case errors.Is(err, storage.ErrTooLarge):
+		return ErrorCode_tooLarge
+	case errors.Is(err, ErrQuotaExceeded):
+		return ErrorCode_forbidden
+	case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		return ErrorCode_unavailable
+	default:
+		return ErrorCode_internal
+	}
+}
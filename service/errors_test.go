@@ -0,0 +1,71 @@
+package service
+
+import (
+	"context"
+	"testing"
+
+	"github.com/bbars/assets/service/repository"
+	"github.com/bbars/assets/service/storage"
+	"github.com/bbars/assets/utils"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestErrorCodeOf(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want ErrorCode
+	}{
+		{
+			name: "nil",
+			err:  nil,
+			want: "",
+		},
+		{
+			name: "unknown",
+			err:  errors.New("disk failure"),
+			want: ErrorCode_internal,
+		},
+		{
+			name: "wrapped service error",
+			err:  errors.Wrap(NewError(ErrorCode_forbidden, errors.New("nope")), "check"),
+			want: ErrorCode_forbidden,
+		},
+		{
+			name: "outermost service error wins",
+			err:  NewError(ErrorCode_conflict, NewError(ErrorCode_notFound, errors.New("nope"))),
+			want: ErrorCode_conflict,
+		},
+		{
+			name: "repository not found",
+			err:  errors.Wrap(repository.ErrNotFound, "query asset"),
+			want: ErrorCode_notFound,
+		},
+		{
+			name: "storage too large",
+			err:  errors.Wrap(errors.Wrap(storage.ErrTooLarge, "written size"), "write asset"),
+			want: ErrorCode_tooLarge,
+		},
+		{
+			name: "quota exceeded",
+			err:  errors.Wrap(ErrQuotaExceeded, "check user quota"),
+			want: ErrorCode_forbidden,
+		},
+		{
+			name: "range",
+			err:  errors.Wrap(&utils.RangeError{}, "read asset range"),
+			want: ErrorCode_invalid,
+		},
+		{
+			name: "cancelled",
+			err:  errors.Wrap(context.Canceled, "fetch"),
+			want: ErrorCode_unavailable,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, ErrorCodeOf(tt.err))
+		})
+	}
+}
@@ -0,0 +1,219 @@
+package service
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// fetchLimitersSweepInterval - how often idle host limiters are evicted.
+const fetchLimitersSweepInterval = time.Minute
+
+// hostLimiter throttles fetches from a single host.
+type hostLimiter struct {
+	bucket *tokenBucket  // nil if rate is not limited
+	slots  chan struct{} // nil if connections are not limited
+	users  int           // fetches holding or waiting for the limiter, guarded by Assets.fetchLimitersMu
+}
+
+// noHostLimiter is shared by hosts without limits, it is not stored.
+var noHostLimiter = &hostLimiter{}
+
+// acquireFetch waits until fetching from the host is allowed by the limits,
+// release must be called when the fetch is finished.
+// queued (if not nil) is called once before waiting, so the caller is not blocked by the queue.
+func (a *Assets) acquireFetch(ctx context.Context, host string, policy *FetchPolicy, queued func()) (release func(), err error) {
+	limiter := a.hostLimiter(host, policy)
+	if limiter == noHostLimiter {
+		release = func() {}
+		return
+	}
+	release = func() { a.releaseHostLimiter(host, limiter) }
+	queuedOnce := sync.Once{}
+	queue := func(ctx context.Context, reason string, wait func(ctx context.Context) error) error {
+		if queued != nil {
+			queuedOnce.Do(queued)
+		}
+		return throttle(ctx, reason, wait)
+	}
+
+	if limiter.slots != nil {
+		select {
+		case limiter.slots <- struct{}{}:
+		default:
+			err = queue(ctx, "connections", func(ctx context.Context) error {
+				select {
+				case limiter.slots <- struct{}{}:
+					return nil
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+			})
+			if err != nil {
+				release()
+				release = func() {}
+				err = errors.Wrapf(err, "wait for connection slot to %+q", host)
+				return
+			}
+		}
+		releaseHost := release
+		release = func() {
+			<-limiter.slots
+			releaseHost()
+		}
+	}
+
+	if limiter.bucket != nil {
+		delay := limiter.bucket.reserve(time.Now())
+		if delay > 0 {
+			err = queue(ctx, "rate", func(ctx context.Context) error {
+				timer := time.NewTimer(delay)
+				defer timer.Stop()
+				select {
+				case <-timer.C:
+					return nil
+				case <-ctx.Done():
+					limiter.bucket.cancel()
+					return ctx.Err()
+				}
+			})
+			if err != nil {
+				release()
+				release = func() {}
+				err = errors.Wrapf(err, "wait for rate limit of %+q", host)
+				return
+			}
+		}
+	}
+	return
+}
+
+func throttle(ctx context.Context, reason string, wait func(ctx context.Context) error) error {
+	start := time.Now()
+	metricFetchesThrottled.Inc(reason)
+	metricFetchesQueued.Inc(reason)
+	defer metricFetchesQueued.Dec(reason)
+	err := wait(ctx)
+	metricFetchThrottleWait.Observe(time.Since(start).Seconds(), reason)
+	return err
+}
+
+// hostLimiter returns the limiter of the host and takes it till releaseHostLimiter.
+// Limiters of hosts without limits are not stored, idle ones are evicted.
+func (a *Assets) hostLimiter(host string, policy *FetchPolicy) *hostLimiter {
+	rate, burst, maxConnections := a.Config.FetchRateLimit, a.Config.FetchRateBurst, a.Config.FetchMaxConnections
+	if policy != nil {
+		if policy.RateLimit != nil {
+			rate = *policy.RateLimit
+		}
+		if policy.RateBurst != nil {
+			burst = *policy.RateBurst
+		}
+		if policy.MaxConnections != nil {
+			maxConnections = *policy.MaxConnections
+		}
+	}
+	if rate <= 0 && maxConnections <= 0 {
+		return noHostLimiter
+	}
+
+	a.fetchLimitersMu.Lock()
+	defer a.fetchLimitersMu.Unlock()
+	now := time.Now()
+	if now.Sub(a.fetchLimitersSwept) >= fetchLimitersSweepInterval {
+		a.sweepHostLimiters(now)
+	}
+	limiter, ok := a.fetchLimiters[host]
+	if !ok {
+		limiter = &hostLimiter{}
+		if rate > 0 {
+			limiter.bucket = newTokenBucket(rate, burst)
+		}
+		if maxConnections > 0 {
+			limiter.slots = make(chan struct{}, maxConnections)
+		}
+		if a.fetchLimiters == nil {
+			a.fetchLimiters = make(map[string]*hostLimiter)
+		}
+		a.fetchLimiters[host] = limiter
+	}
+	limiter.users++
+	return limiter
+}
+
+// releaseHostLimiter releases the limiter taken by hostLimiter.
+// The limiter is evicted at once if it has no rate limit to keep.
+func (a *Assets) releaseHostLimiter(host string, limiter *hostLimiter) {
+	a.fetchLimitersMu.Lock()
+	defer a.fetchLimitersMu.Unlock()
+	limiter.users--
+	if limiter.users == 0 && limiter.bucket == nil && a.fetchLimiters[host] == limiter {
+		delete(a.fetchLimiters, host)
+	}
+}
+
+// sweepHostLimiters evicts limiters not used by fetches and with the rate limit bucket refilled,
+// since such limiters are equal to new ones. fetchLimitersMu must be held.
+func (a *Assets) sweepHostLimiters(now time.Time) {
+	a.fetchLimitersSwept = now
+	for host, limiter := range a.fetchLimiters {
+		if limiter.users == 0 && (limiter.bucket == nil || limiter.bucket.full(now)) {
+			delete(a.fetchLimiters, host)
+		}
+	}
+}
+
+// tokenBucket allows rate events per second with bursts up to burst events.
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	if burst < 1 {
+		burst = 1
+	}
+	return &tokenBucket{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+// reserve takes a token and returns time to wait until it is available.
+func (b *tokenBucket) reserve(now time.Time) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if now.After(b.last) {
+		b.tokens += now.Sub(b.last).Seconds() * b.rate
+		if b.tokens > b.burst {
+			b.tokens = b.burst
+		}
+		b.last = now
+	}
+	b.tokens--
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// full reports whether the bucket is refilled completely by now.
+func (b *tokenBucket) full(now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.tokens+now.Sub(b.last).Seconds()*b.rate >= b.burst
+}
+
+// cancel returns the token reserved but not used.
+func (b *tokenBucket) cancel() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.tokens++
+}
@@ -0,0 +1,134 @@
+package service
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTokenBucketReserve(t *testing.T) {
+	start := time.Now()
+	b := newTokenBucket(2, 2)
+	b.last = start
+
+	tests := []struct {
+		name  string
+		after time.Duration
+		want  time.Duration
+	}{
+		{
+			name: "burst 1",
+			want: 0,
+		},
+		{
+			name: "burst 2",
+			want: 0,
+		},
+		{
+			name: "exhausted",
+			want: 500 * time.Millisecond,
+		},
+		{
+			name:  "refilled",
+			after: time.Second,
+			want:  0,
+		},
+		{
+			name:  "exhausted after refill",
+			after: time.Second,
+			want:  500 * time.Millisecond,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, b.reserve(start.Add(tt.after)))
+		})
+	}
+}
+
+func TestAcquireFetch(t *testing.T) {
+	maxConnections := 1
+	a := &Assets{
+		Config: AssetsConfig{
+			FetchMaxConnections: 2,
+		},
+	}
+	policy := &FetchPolicy{
+		MaxConnections: &maxConnections,
+	}
+
+	queued := 0
+	release, err := a.acquireFetch(context.Background(), "a.example.com", policy, func() { queued++ })
+	require.NoError(t, err)
+	assert.Equal(t, 0, queued)
+
+	// the slot of the policy is taken, so the fetch waits
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err = a.acquireFetch(ctx, "a.example.com", policy, func() { queued++ })
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Equal(t, ErrorCode_unavailable, ErrorCodeOf(err))
+	assert.Equal(t, 1, queued)
+
+	// other hosts are limited separately by the global limit
+	for i := 0; i < 2; i++ {
+		_, err = a.acquireFetch(context.Background(), "b.example.com", nil, func() { queued++ })
+		require.NoError(t, err)
+	}
+	assert.Equal(t, 1, queued, "fetches within limits are not queued")
+
+	acquired := make(chan struct{})
+	go func() {
+		release, err := a.acquireFetch(context.Background(), "a.example.com", policy, nil)
+		if err == nil {
+			release()
+		}
+		close(acquired)
+	}()
+	release()
+	select {
+	case <-acquired:
+	case <-time.After(time.Second):
+		t.Fatal("queued fetch was not released")
+	}
+}
+
+func TestHostLimiterEviction(t *testing.T) {
+	rate := 1000.0
+	a := &Assets{
+		Config: AssetsConfig{
+			FetchMaxConnections: 1,
+		},
+	}
+	rated := &FetchPolicy{
+		RateLimit: &rate,
+	}
+	unlimited := 0
+	noLimits := &FetchPolicy{
+		MaxConnections: &unlimited,
+	}
+
+	release, err := a.acquireFetch(context.Background(), "none.example.com", noLimits, nil)
+	require.NoError(t, err)
+	assert.Empty(t, a.fetchLimiters, "limiter without limits is not stored")
+	release()
+
+	release, err = a.acquireFetch(context.Background(), "slots.example.com", nil, nil)
+	require.NoError(t, err)
+	assert.Contains(t, a.fetchLimiters, "slots.example.com")
+	release()
+	assert.NotContains(t, a.fetchLimiters, "slots.example.com", "released connections limiter is evicted")
+
+	release, err = a.acquireFetch(context.Background(), "rate.example.com", rated, nil)
+	require.NoError(t, err)
+	release()
+	assert.Contains(t, a.fetchLimiters, "rate.example.com", "rate limiter is kept till the bucket is refilled")
+
+	a.sweepHostLimiters(time.Now().Add(-time.Hour))
+	assert.Contains(t, a.fetchLimiters, "rate.example.com")
+	a.sweepHostLimiters(time.Now().Add(time.Second))
+	assert.NotContains(t, a.fetchLimiters, "rate.example.com")
+}
@@ -0,0 +1,326 @@
+package service
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// FetchPolicy configures requests to remote hosts fetched by original URL.
+type FetchPolicy struct {
+	// Host - RegExp pattern of URL host name the policy applies to
+	Host string `json:"host"`
+
+	// Headers - extra request headers
+	Headers map[string]string `json:"headers"`
+
+	// BasicAuth - credentials for basic authorization
+	BasicAuth *FetchBasicAuth `json:"basicAuth"`
+
+	// BearerToken - token for bearer authorization
+	BearerToken string `json:"bearerToken"`
+
+	// Proxy - URL of the proxy server (proxy from environment is used if empty)
+	Proxy string `json:"proxy"`
+
+	// ConnectTimeout - time limit to establish connection (including TLS handshake)
+	ConnectTimeout Duration `json:"connectTimeout"`
+
+	// ReadTimeout - time limit to wait for response headers and for each portion of the body
+	ReadTimeout Duration `json:"readTimeout"`
+
+	// TotalTimeout - time limit of the whole fetch including redirects and reading the body
+	TotalTimeout Duration `json:"totalTimeout"`
+
+	// MaxRedirects - max number of redirects to follow (10 if not set)
+	MaxRedirects *int `json:"maxRedirects"`
+
+	// TlsInsecureSkipVerify - don't verify certificates of the remote host
+	TlsInsecureSkipVerify bool `json:"tlsInsecureSkipVerify"`
+
+	// TlsCaFile - PEM file with extra root certificates
+	TlsCaFile string `json:"tlsCaFile"`
+
+	// Schemes - allowed URL schemes, including redirect targets (http and https if empty)
+	Schemes []string `json:"schemes"`
+
+	// RateLimit - max fetches per second from each matched host (AssetsConfig.FetchRateLimit if not set, 0 means no limit)
+	RateLimit *float64 `json:"rateLimit"`
+
+	// RateBurst - max fetches started at once within the rate limit (AssetsConfig.FetchRateBurst if not set)
+	RateBurst *int `json:"rateBurst"`
+
+	// MaxConnections - max concurrent fetches from each matched host (AssetsConfig.FetchMaxConnections if not set, 0 means no limit)
+	MaxConnections *int `json:"maxConnections"`
+
+	hostPattern *regexp.Regexp
+	client      *http.Client
+}
+
+type FetchBasicAuth struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// Duration is time.Duration read from JSON strings like "1m30s".
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(data []byte) (err error) {
+	var s string
+	err = json.Unmarshal(data, &s)
+	if err != nil {
+		return
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return
+	}
+	*d = Duration(v)
+	return
+}
+
+// FetchPolicies - list of policies, the first one matching URL host is applied.
+type FetchPolicies []*FetchPolicy
+
+const defaultMaxRedirects = 10
+
+// LoadFetchPolicies reads JSON file with array of policies.
+func LoadFetchPolicies(name string) (policies FetchPolicies, err error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		err = errors.Wrap(err, "read fetch policy file")
+		return
+	}
+	policies, err = ParseFetchPolicies(data)
+	if err != nil {
+		err = errors.Wrapf(err, "parse fetch policy file %+q", name)
+		return
+	}
+	return
+}
+
+func ParseFetchPolicies(data []byte) (policies FetchPolicies, err error) {
+	err = json.Unmarshal(data, &policies)
+	if err != nil {
+		return
+	}
+	for i, policy := range policies {
+		err = policy.init()
+		if err != nil {
+			err = errors.Wrapf(err, "policy #%d", i)
+			return
+		}
+	}
+	return
+}
+
+// Match returns policy for the host name, nil if there is no such one.
+func (policies FetchPolicies) Match(host string) *FetchPolicy {
+	for _, policy := range policies {
+		if policy.hostPattern.MatchString(host) {
+			return policy
+		}
+	}
+	return nil
+}
+
+func (policy *FetchPolicy) init() (err error) {
+	policy.hostPattern, err = regexp.Compile(policy.Host)
+	if err != nil {
+		err = errors.Wrap(err, "invalid host pattern")
+		return
+	}
+	if len(policy.Schemes) == 0 {
+		policy.Schemes = []string{"http", "https"}
+	}
+	for i, scheme := range policy.Schemes {
+		policy.Schemes[i] = strings.ToLower(scheme)
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if policy.Proxy != "" {
+		var proxyUrl *url.URL
+		proxyUrl, err = url.Parse(policy.Proxy)
+		if err != nil {
+			err = errors.Wrap(err, "invalid proxy")
+			return
+		}
+		transport.Proxy = http.ProxyURL(proxyUrl)
+	}
+	if policy.ConnectTimeout > 0 {
+		dialer := &net.Dialer{
+			Timeout:   time.Duration(policy.ConnectTimeout),
+			KeepAlive: 30 * time.Second,
+		}
+		transport.DialContext = dialer.DialContext
+		transport.TLSHandshakeTimeout = time.Duration(policy.ConnectTimeout)
+	}
+	transport.ResponseHeaderTimeout = time.Duration(policy.ReadTimeout)
+	if policy.TlsInsecureSkipVerify || policy.TlsCaFile != "" {
+		transport.TLSClientConfig = &tls.Config{
+			InsecureSkipVerify: policy.TlsInsecureSkipVerify,
+		}
+	}
+	if policy.TlsCaFile != "" {
+		var pool *x509.CertPool
+		pool, err = x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		var pem []byte
+		pem, err = os.ReadFile(policy.TlsCaFile)
+		if err != nil {
+			err = errors.Wrap(err, "read tls CA file")
+			return
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			err = errors.Errorf("no certificates found in tls CA file %+q", policy.TlsCaFile)
+			return
+		}
+		transport.TLSClientConfig.RootCAs = pool
+	}
+
+	policy.client = &http.Client{
+		Transport:     transport,
+		CheckRedirect: policy.checkRedirect,
+		Timeout:       time.Duration(policy.TotalTimeout),
+	}
+	return
+}
+
+// Prepare checks the request URL and sets headers and credentials of the policy.
+func (policy *FetchPolicy) Prepare(request *http.Request) (err error) {
+	err = policy.checkScheme(request.URL)
+	if err != nil {
+		return
+	}
+	for key, value := range policy.Headers {
+		request.Header.Set(key, value)
+	}
+	if policy.BasicAuth != nil {
+		request.SetBasicAuth(policy.BasicAuth.Username, policy.BasicAuth.Password)
+	}
+	if policy.BearerToken != "" {
+		request.Header.Set("authorization", "Bearer "+policy.BearerToken)
+	}
+	return
+}
+
+// Do sends the request prepared with Prepare, response body is limited with ReadTimeout.
+func (policy *FetchPolicy) Do(request *http.Request) (response *http.Response, err error) {
+	response, err = policy.client.Do(request)
+	if err != nil {
+		return
+	}
+	if policy.ReadTimeout > 0 {
+		response.Body = newIdleTimeoutReader(response.Body, time.Duration(policy.ReadTimeout))
+	}
+	return
+}
+
+func (policy *FetchPolicy) checkScheme(u *url.URL) error {
+	for _, scheme := range policy.Schemes {
+		if u.Scheme == scheme {
+			return nil
+		}
+	}
+	return NewError(ErrorCode_forbidden, errors.Errorf("scheme %+q is not allowed by fetch policy", u.Scheme))
+}
+
+func (policy *FetchPolicy) checkRedirect(request *http.Request, via []*http.Request) error {
+	maxRedirects := defaultMaxRedirects
+	if policy.MaxRedirects != nil {
+		maxRedirects = *policy.MaxRedirects
+	}
+	if len(via) > maxRedirects {
+		return NewError(ErrorCode_forbidden, errors.Errorf("stopped after %d redirects", maxRedirects))
+	}
+	err := policy.checkScheme(request.URL)
+	if err != nil {
+		return err
+	}
+	err = checkRedirectTarget(request)
+	if err != nil {
+		return err
+	}
+	if request.URL.Hostname() != via[0].URL.Hostname() {
+		// headers of the original request are copied to the redirected one,
+		// but secrets of the policy are for the matched host only
+		for key := range policy.Headers {
+			request.Header.Del(key)
+		}
+		if policy.BasicAuth != nil || policy.BearerToken != "" {
+			request.Header.Del("authorization")
+		}
+	}
+	return nil
+}
+
+// redirectCheckKey - context key of the function checking URLs of redirect targets.
+type redirectCheckKey struct{}
+
+// withRedirectCheck returns the context making requests with it check redirect targets by the function
+// (e.g. against AssetsConfig.OriginalUrlPattern).
+func withRedirectCheck(ctx context.Context, check func(targetUrl string) error) context.Context {
+	return context.WithValue(ctx, redirectCheckKey{}, check)
+}
+
+// checkRedirectTarget checks URL of the redirected request by the function of its context, if any.
+func checkRedirectTarget(request *http.Request) error {
+	check, ok := request.Context().Value(redirectCheckKey{}).(func(targetUrl string) error)
+	if !ok {
+		return nil
+	}
+	err := check(request.URL.String())
+	if err != nil {
+		return errors.Wrapf(err, "redirect to %+q", request.URL.Redacted())
+	}
+	return nil
+}
+
+// idleTimeoutReader closes the body when no data is read within the timeout.
+type idleTimeoutReader struct {
+	rc       io.ReadCloser
+	timeout  time.Duration
+	timer    *time.Timer
+	timedOut int32
+}
+
+func newIdleTimeoutReader(rc io.ReadCloser, timeout time.Duration) *idleTimeoutReader {
+	r := &idleTimeoutReader{
+		rc:      rc,
+		timeout: timeout,
+	}
+	r.timer = time.AfterFunc(timeout, func() {
+		atomic.StoreInt32(&r.timedOut, 1)
+		_ = rc.Close()
+	})
+	return r
+}
+
+func (r *idleTimeoutReader) Read(p []byte) (n int, err error) {
+	n, err = r.rc.Read(p)
+	if err != nil && err != io.EOF && atomic.LoadInt32(&r.timedOut) == 1 {
+		err = NewError(ErrorCode_unavailable, errors.Errorf("no data received within read timeout %s", r.timeout))
+		return
+	}
+	r.timer.Reset(r.timeout)
+	return
+}
+
+func (r *idleTimeoutReader) Close() error {
+	r.timer.Stop()
+	return r.rc.Close()
+}
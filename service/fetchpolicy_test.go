@@ -0,0 +1,180 @@
+package service
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseFetchPolicies(t *testing.T) {
+	tests := []struct {
+		name      string
+		data      string
+		wantErr   bool
+		host      string
+		wantMatch int // index of matched policy, -1 if none
+	}{
+		{
+			name:      "first match wins",
+			data:      `[{"host": "^a\\.example\\.com$", "readTimeout": "5s"}, {"host": "example\\.com$"}]`,
+			host:      "a.example.com",
+			wantMatch: 0,
+		},
+		{
+			name:      "fallback policy",
+			data:      `[{"host": "^a\\.example\\.com$"}, {"host": "example\\.com$"}]`,
+			host:      "b.example.com",
+			wantMatch: 1,
+		},
+		{
+			name:      "no match",
+			data:      `[{"host": "^a\\.example\\.com$"}]`,
+			host:      "example.org",
+			wantMatch: -1,
+		},
+		{
+			name:    "invalid host pattern",
+			data:    `[{"host": "("}]`,
+			wantErr: true,
+		},
+		{
+			name:    "invalid duration",
+			data:    `[{"host": "", "totalTimeout": "forever"}]`,
+			wantErr: true,
+		},
+		{
+			name:    "missing CA file",
+			data:    `[{"host": "", "tlsCaFile": "/nonexistent/ca.pem"}]`,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			policies, err := ParseFetchPolicies([]byte(tt.data))
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			policy := policies.Match(tt.host)
+			if tt.wantMatch < 0 {
+				assert.Nil(t, policy)
+			} else {
+				assert.Same(t, policies[tt.wantMatch], policy)
+			}
+		})
+	}
+}
+
+func TestFetchPolicyDo(t *testing.T) {
+	var origin *httptest.Server
+	origin = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/cross-host":
+			http.Redirect(w, r, strings.Replace(origin.URL, "127.0.0.1", "localhost", 1)+"/echo", http.StatusFound)
+		case "/echo":
+			_, _ = io.WriteString(w, r.Header.Get("x-api-key")+" "+r.Header.Get("authorization"))
+		case "/redirect":
+			http.Redirect(w, r, "/echo", http.StatusFound)
+		case "/ftp":
+			http.Redirect(w, r, "ftp://example.com/", http.StatusFound)
+		case "/stall":
+			_, _ = io.WriteString(w, "partial")
+			w.(http.Flusher).Flush()
+			time.Sleep(200 * time.Millisecond)
+		}
+	}))
+	t.Cleanup(origin.Close)
+
+	policies, err := ParseFetchPolicies([]byte(`[{
+		"host": "",
+		"headers": {"x-api-key": "key"},
+		"bearerToken": "token",
+		"readTimeout": "50ms",
+		"maxRedirects": 1
+	}]`))
+	require.NoError(t, err)
+
+	allowed := regexp.MustCompile(`^http://127\.0\.0\.1:`)
+	tests := []struct {
+		name          string
+		path          string
+		redirectCheck func(targetUrl string) error
+		wantErr       ErrorCode
+		wantData      string
+	}{
+		{
+			name:     "headers",
+			path:     "/echo",
+			wantData: "key Bearer token",
+		},
+		{
+			name:     "redirect",
+			path:     "/redirect",
+			wantData: "key Bearer token",
+		},
+		{
+			name:     "cross-host redirect drops secrets",
+			path:     "/cross-host",
+			wantData: " ",
+		},
+		{
+			name: "redirect target not allowed",
+			path: "/cross-host",
+			redirectCheck: func(targetUrl string) error {
+				if !allowed.MatchString(targetUrl) {
+					return NewError(ErrorCode_forbidden, errors.New("not allowed"))
+				}
+				return nil
+			},
+			wantErr: ErrorCode_forbidden,
+		},
+		{
+			name:    "scheme of redirect target",
+			path:    "/ftp",
+			wantErr: ErrorCode_forbidden,
+		},
+		{
+			name:    "read timeout",
+			path:    "/stall",
+			wantErr: ErrorCode_unavailable,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			if tt.redirectCheck != nil {
+				ctx = withRedirectCheck(ctx, tt.redirectCheck)
+			}
+			request, err := http.NewRequestWithContext(ctx, http.MethodGet, origin.URL+tt.path, nil)
+			require.NoError(t, err)
+			policy := policies.Match(request.URL.Hostname())
+			require.NoError(t, policy.Prepare(request))
+			var data []byte
+			response, err := policy.Do(request)
+			if err == nil {
+				defer response.Body.Close()
+				data, err = io.ReadAll(response.Body)
+			}
+			if tt.wantErr != "" {
+				assert.Equal(t, tt.wantErr, ErrorCodeOf(err))
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.wantData, string(data))
+		})
+	}
+
+	request, err := http.NewRequest(http.MethodGet, "ftp://example.com/", nil)
+	require.NoError(t, err)
+	assert.Equal(t, ErrorCode_forbidden, ErrorCodeOf(policies[0].Prepare(request)))
+}
@@ -0,0 +1,77 @@
+package service
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/bbars/assets/service/storage"
+	"github.com/bbars/assets/service/tracing"
+	"github.com/pkg/errors"
+)
+
+type HealthCheck struct {
+	Name     string `json:"name"`
+	Ok       bool   `json:"ok"`
+	Error    string `json:"error,omitempty"`
+	Duration string `json:"duration"`
+}
+
+type Readiness struct {
+	Ready  bool           `json:"ready"`
+	Checks []*HealthCheck `json:"checks"`
+}
+
+// Readiness verifies dependencies of the service: repository must be reachable and migrated,
+// storage must be writable and have at least Config.MinFreeSpace bytes available.
+func (a *Assets) Readiness(ctx context.Context) (readiness *Readiness, err error) {
+	ctx, span := tracing.Start(ctx, "Assets.Readiness")
+	defer tracing.End(span, &err)
+	defer RecoverService(ctx, &err)
+
+	readiness = &Readiness{
+		Ready: true,
+		Checks: []*HealthCheck{
+			runHealthCheck(ctx, "repository", a.checkRepository),
+			runHealthCheck(ctx, "storage", a.checkStorage),
+		},
+	}
+	for _, check := range readiness.Checks {
+		readiness.Ready = readiness.Ready && check.Ok
+	}
+	return
+}
+
+func (a *Assets) checkRepository(ctx context.Context) (err error) {
+	pending, err := a.Repo.PendingMigrations(ctx)
+	if err != nil {
+		err = errors.Wrap(err, "query migrations")
+		return
+	}
+	if len(pending) > 0 {
+		err = errors.Errorf("pending migrations: %s", strings.Join(pending, ", "))
+		return
+	}
+	return
+}
+
+func (a *Assets) checkStorage(ctx context.Context) (err error) {
+	if hc, ok := a.Storage.(storage.HealthChecker); ok {
+		err = hc.CheckHealth(ctx, a.Config.MinFreeSpace)
+	}
+	return
+}
+
+func runHealthCheck(ctx context.Context, name string, check func(ctx context.Context) error) (hc *HealthCheck) {
+	start := time.Now()
+	err := check(ctx)
+	hc = &HealthCheck{
+		Name:     name,
+		Ok:       err == nil,
+		Duration: time.Since(start).String(),
+	}
+	if err != nil {
+		hc.Error = err.Error()
+	}
+	return
+}
@@ -0,0 +1,53 @@
+package service
+
+import (
+	"github.com/bbars/assets/service/metrics"
+)
+
+var (
+	metricStorageWrites = metrics.NewCounter(
+		"assets_storage_writes_total",
+		"Blobs written to storage by result (new or dedup when the content already existed).",
+		"result",
+	)
+	metricStoredBytes = metrics.NewCounter(
+		"assets_stored_bytes_total",
+		"Bytes of assets written to storage by result (new or dedup).",
+		"result",
+	)
+	metricFetches = metrics.NewCounter(
+		"assets_fetches_total",
+		"Remote fetches by original URL by result and HTTP status.",
+		"result",
+		"status",
+	)
+	metricFetchesInFlight = metrics.NewGauge(
+		"assets_fetches_in_flight",
+		"Background fetch goroutines currently running.",
+	)
+	metricFetchesThrottled = metrics.NewCounter(
+		"assets_fetches_throttled_total",
+		"Fetches delayed by per-host limits by reason (rate or connections).",
+		"reason",
+	)
+	metricFetchesQueued = metrics.NewGauge(
+		"assets_fetches_queued",
+		"Fetches currently waiting for per-host limits by reason.",
+		"reason",
+	)
+	metricFetchThrottleWait = metrics.NewHistogram(
+		"assets_fetch_throttle_wait_seconds",
+		"Time fetches waited for per-host limits by reason.",
+		nil,
+		"reason",
+	)
+)
+
+func observeStorageWrite(exists bool, size int64) {
+	result := "new"
+	if exists {
+		result = "dedup"
+	}
+	metricStorageWrites.Inc(result)
+	metricStoredBytes.Add(float64(size), result)
+}
@@ -0,0 +1,63 @@
+package metrics
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRegistryWriteTo(t *testing.T) {
+	r := NewRegistry()
+	c := r.NewCounter("test_requests_total", "Requests.", "handler", "code")
+	g := r.NewGauge("test_in_flight", "In-flight \"jobs\".")
+	h := r.NewHistogram("test_duration_seconds", "Duration.", []float64{0.1, 1}, "handler")
+
+	c.Inc("get", "200")
+	c.Add(2, "get", "200")
+	c.Inc("store", "400")
+	g.Inc()
+	g.Inc()
+	g.Dec()
+	h.Observe(0.05, "get")
+	h.Observe(0.5, "get")
+	h.Observe(5, "get")
+
+	out := strings.Builder{}
+	_, err := r.WriteTo(&out)
+	assert.NoError(t, err)
+	assert.Equal(t, `# HELP test_requests_total Requests.
+# TYPE test_requests_total counter
+test_requests_total{handler="get",code="200"} 3
+test_requests_total{handler="store",code="400"} 1
+# HELP test_in_flight In-flight "jobs".
+# TYPE test_in_flight gauge
+test_in_flight 1
+# HELP test_duration_seconds Duration.
+# TYPE test_duration_seconds histogram
+test_duration_seconds_bucket{handler="get",le="0.1"} 1
+test_duration_seconds_bucket{handler="get",le="1"} 2
+test_duration_seconds_bucket{handler="get",le="+Inf"} 3
+test_duration_seconds_sum{handler="get"} 5.55
+test_duration_seconds_count{handler="get"} 3
+`, out.String())
+}
+
+func TestLabelValueEscaping(t *testing.T) {
+	r := NewRegistry()
+	c := r.NewCounter("test_total", "Test.", "v")
+	c.Inc("a\"b\\c\nd")
+
+	out := strings.Builder{}
+	_, err := r.WriteTo(&out)
+	assert.NoError(t, err)
+	assert.Contains(t, out.String(), `test_total{v="a\"b\\c\nd"} 1`)
+}
+
+func TestLabelCountMismatch(t *testing.T) {
+	r := NewRegistry()
+	c := r.NewCounter("test_total", "Test.", "a", "b")
+	assert.Panics(t, func() {
+		c.Inc("only-one")
+	})
+}
@@ -0,0 +1,153 @@
+package service
+
+import (
+	"context"
+	"os"
+
+	"github.com/bbars/assets/service/storage"
+	"github.com/bbars/assets/service/tracing"
+	"github.com/bbars/assets/utils"
+	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// ListBlobs returns sizes of blobs referenced by stored assets by content hash.
+func (a *Assets) ListBlobs(ctx context.Context) (blobs map[string]int64, err error) {
+	ctx, span := tracing.Start(ctx, "Assets.ListBlobs")
+	defer tracing.End(span, &err)
+	defer RecoverService(ctx, &err)
+
+	blobs, err = a.Repo.ListBlobs(ctx)
+	if err != nil {
+		err = errors.Wrap(err, "query blobs")
+		return
+	}
+	return
+}
+
+// MigrateBlob copies the blob from the storage to the target one verifying its content hash
+// and sets targetName as storage name of assets referencing it (unless it is empty).
+// The blob is not copied again if the target storage has it, so an interrupted migration may be resumed.
+// If removeSource is set, files of the blob are removed from the storage directory unless they are the target ones.
+func (a *Assets) MigrateBlob(ctx context.Context, target storage.Storage, targetName string, contentHash string, removeSource bool) (copied bool, err error) {
+	ctx, span := tracing.Start(ctx, "Assets.MigrateBlob", attribute.String("asset.content_hash", contentHash))
+	defer func() {
+		span.SetAttributes(attribute.Bool("storage.copied", copied))
+		tracing.End(span, &err)
+	}()
+	defer RecoverService(ctx, &err)
+
+	// found before the copy, since a directory storage finds the copy first when it is relayouted in place
+	var sourcePaths []string
+	if removeSource {
+		sourcePaths, err = a.blobFiles(contentHash)
+		if err != nil {
+			err = errors.Wrap(err, "find source blob")
+			return
+		}
+	}
+
+	exists, err := target.Check(ctx, contentHash)
+	if err != nil {
+		err = errors.Wrap(err, "check target blob")
+		return
+	}
+	if !exists {
+		err = a.copyBlob(ctx, target, contentHash)
+		if err != nil {
+			return
+		}
+		copied = true
+	}
+
+	if targetName != "" {
+		err = a.Repo.SetStorageName(ctx, contentHash, targetName)
+		if err != nil {
+			err = errors.Wrap(err, "update storage name")
+			return
+		}
+	}
+
+	if len(sourcePaths) > 0 {
+		err = removeBlobFiles(ctx, sourcePaths, target, contentHash)
+		if err != nil {
+			err = errors.Wrap(err, "remove source blob")
+			return
+		}
+	}
+	return
+}
+
+func (a *Assets) copyBlob(ctx context.Context, target storage.Storage, contentHash string) (err error) {
+	rc, err := a.Storage.OpenRead(ctx, contentHash, nil)
+	if err != nil {
+		err = errors.Wrap(err, "open source blob")
+		return
+	}
+	defer rc.Close()
+
+	_, writtenHash, _, err := target.Write(ctx, rc, 0)
+	if err != nil {
+		err = errors.Wrap(err, "write target blob")
+		return
+	}
+	if writtenHash != contentHash {
+		err = errors.Errorf("source blob is corrupted, its content hash is %s", writtenHash)
+		return
+	}
+	return
+}
+
+// blobFileStorage is implemented by storages keeping blobs in files (DirStorage, CompressedStorage).
+type blobFileStorage interface {
+	Files(contentHash string) (paths []string, err error)
+}
+
+// blobFiles returns paths of the blob files in the storage directory (the blob file first),
+// empty if it is removed already (by the interrupted migration).
+func (a *Assets) blobFiles(contentHash string) (paths []string, err error) {
+	fileStorage, ok := a.Storage.(blobFileStorage)
+	if !ok {
+		err = errors.New("storage does not support removal of blobs")
+		return
+	}
+	paths, err = fileStorage.Files(contentHash)
+	return
+}
+
+// removeBlobFiles removes the files unless the first one is the blob file of the target storage
+// (e.g. the same directory reached by another path).
+func removeBlobFiles(ctx context.Context, paths []string, target storage.Storage, contentHash string) (err error) {
+	if targetFiles, ok := target.(blobFileStorage); ok {
+		var targetPaths []string
+		targetPaths, err = targetFiles.Files(contentHash)
+		if err != nil {
+			return
+		}
+		if len(targetPaths) == 0 {
+			err = errors.New("blob is not found in the target storage")
+			return
+		}
+		var info, targetInfo os.FileInfo
+		info, err = os.Stat(paths[0])
+		if err != nil {
+			return
+		}
+		targetInfo, err = os.Stat(targetPaths[0])
+		if err != nil {
+			return
+		}
+		if os.SameFile(info, targetInfo) {
+			return
+		}
+	}
+
+	for _, path := range paths {
+		err = os.Remove(path)
+		if err != nil {
+			return
+		}
+		utils.ContextLogger(ctx).Debug("blob file removed", "path", path)
+	}
+	return
+}
@@ -0,0 +1,105 @@
+package service
+
+import (
+	"context"
+	"io"
+	"sync/atomic"
+	"time"
+
+	"github.com/bbars/assets/service/tracing"
+	"github.com/bbars/assets/service/types"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// fetchProgress counts bytes of the remote object received by an in-flight fetch.
+type fetchProgress struct {
+	received int64 // atomic
+	total    int64
+}
+
+type progressReader struct {
+	r        io.Reader
+	progress *fetchProgress
+}
+
+func (pr *progressReader) Read(p []byte) (n int, err error) {
+	n, err = pr.r.Read(p)
+	atomic.AddInt64(&pr.progress.received, int64(n))
+	return
+}
+
+// trackProgress registers progress of the fetch counted by reads of the returned reader,
+// untrackProgress must be called when the fetch result is saved.
+func (a *Assets) trackProgress(assetKey string, total int64, r io.Reader) io.Reader {
+	progress := &fetchProgress{
+		total: total,
+	}
+	a.progress.Store(assetKey, progress)
+	return &progressReader{
+		r:        r,
+		progress: progress,
+	}
+}
+
+func (a *Assets) untrackProgress(assetKey string) {
+	a.progress.Delete(assetKey)
+}
+
+// progressOf returns progress of the in-flight fetch of the asset or nil.
+func (a *Assets) progressOf(assetKey string) *types.FetchProgress {
+	v, ok := a.progress.Load(assetKey)
+	if !ok {
+		return nil
+	}
+	progress := v.(*fetchProgress)
+	return &types.FetchProgress{
+		Received: atomic.LoadInt64(&progress.received),
+		Total:    progress.total,
+	}
+}
+
+// WatchByKey calls fn with the asset (including fetch progress) every interval while it changes,
+// until its fetch is finished (done, failed or deleted) or ctx is done.
+func (a *Assets) WatchByKey(ctx context.Context, assetKey string, interval time.Duration, fn func(asset *types.Asset) error) (err error) {
+	ctx, span := tracing.Start(ctx, "Assets.WatchByKey", attribute.String("asset.key", assetKey))
+	defer tracing.End(span, &err)
+	defer RecoverService(ctx, &err)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	var prev *types.Asset
+	for {
+		var asset *types.Asset
+		asset, err = a.DescribeByKey(ctx, assetKey)
+		if err != nil {
+			return
+		}
+		if prev == nil || watchedChanged(prev, asset) {
+			err = fn(asset)
+			if err != nil {
+				return
+			}
+		}
+		if asset.Status == types.AssetStatus_done || asset.Error != "" || asset.Deleted {
+			return
+		}
+		prev = asset
+
+		select {
+		case <-ctx.Done():
+			// unwrapped, so the caller tells cancellation from failures
+			err = ctx.Err()
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func watchedChanged(prev *types.Asset, asset *types.Asset) bool {
+	return prev.Status != asset.Status ||
+		prev.Size != asset.Size ||
+		prev.Error != asset.Error ||
+		prev.Deleted != asset.Deleted ||
+		prev.Progress.GetReceived() != asset.Progress.GetReceived()
+}
@@ -0,0 +1,155 @@
+package service
+
+import (
+	"context"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bbars/assets/service/repository"
+	"github.com/bbars/assets/service/types"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTrackProgress(t *testing.T) {
+	a := &Assets{}
+	assert.Nil(t, a.progressOf("k1"))
+
+	r := a.trackProgress("k1", 10, strings.NewReader("0123456789"))
+	assert.Equal(t, &types.FetchProgress{Received: 0, Total: 10}, a.progressOf("k1"))
+
+	_, err := io.ReadFull(r, make([]byte, 3))
+	require.NoError(t, err)
+	assert.Equal(t, &types.FetchProgress{Received: 3, Total: 10}, a.progressOf("k1"))
+	assert.Nil(t, a.progressOf("k2"))
+
+	_, err = io.ReadAll(r)
+	require.NoError(t, err)
+	assert.Equal(t, &types.FetchProgress{Received: 10, Total: 10}, a.progressOf("k1"))
+
+	a.untrackProgress("k1")
+	assert.Nil(t, a.progressOf("k1"))
+}
+
+// watchRepo returns the states of the asset one by one, the last one is repeated.
+type watchRepo struct {
+	repository.Repository
+	states []*types.Asset
+	calls  int
+}
+
+func (r *watchRepo) GetByAssetKey(ctx context.Context, assetKey string) (asset *types.Asset, err error) {
+	if len(r.states) == 0 {
+		err = errors.Wrapf(repository.ErrNotFound, "asset_key=%+q", assetKey)
+		return
+	}
+	i := r.calls
+	if i >= len(r.states) {
+		i = len(r.states) - 1
+	}
+	r.calls++
+	assetCopy := *r.states[i]
+	asset = &assetCopy
+	return
+}
+
+func TestWatchByKey(t *testing.T) {
+	processing := &types.Asset{AssetKey: "k1", Status: types.AssetStatus_processing}
+	done := &types.Asset{AssetKey: "k1", Status: types.AssetStatus_done, Size: 4}
+	failed := &types.Asset{AssetKey: "k1", Status: types.AssetStatus_done, Error: "fetch failed"}
+	deleted := &types.Asset{AssetKey: "k1", Status: types.AssetStatus_processing, Deleted: true}
+
+	tests := []struct {
+		name       string
+		states     []*types.Asset
+		timeout    time.Duration
+		fnErr      error
+		wantEvents []*types.Asset
+		wantErr    error
+		wantCode   ErrorCode
+	}{
+		{
+			name:       "until done",
+			states:     []*types.Asset{processing, processing, processing, done},
+			wantEvents: []*types.Asset{processing, done},
+		},
+		{
+			name:       "already done",
+			states:     []*types.Asset{done},
+			wantEvents: []*types.Asset{done},
+		},
+		{
+			name:       "until failed",
+			states:     []*types.Asset{processing, failed},
+			wantEvents: []*types.Asset{processing, failed},
+		},
+		{
+			name:       "until deleted",
+			states:     []*types.Asset{processing, deleted},
+			wantEvents: []*types.Asset{processing, deleted},
+		},
+		{
+			name:     "not found",
+			wantCode: ErrorCode_notFound,
+		},
+		{
+			name:       "fn failed",
+			states:     []*types.Asset{processing, done},
+			fnErr:      errors.New("client has gone"),
+			wantEvents: []*types.Asset{processing},
+			wantCode:   ErrorCode_internal,
+		},
+		{
+			name:       "cancelled",
+			states:     []*types.Asset{processing},
+			timeout:    50 * time.Millisecond,
+			wantEvents: []*types.Asset{processing},
+			wantErr:    context.DeadlineExceeded,
+			wantCode:   ErrorCode_unavailable,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := &Assets{Repo: &watchRepo{states: tt.states}}
+			ctx := context.Background()
+			if tt.timeout > 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, tt.timeout)
+				defer cancel()
+			}
+
+			var events []*types.Asset
+			err := a.WatchByKey(ctx, "k1", time.Millisecond, func(asset *types.Asset) error {
+				events = append(events, asset)
+				return tt.fnErr
+			})
+			assert.Equal(t, tt.wantEvents, events)
+			assert.Equal(t, tt.wantCode, ErrorCodeOf(err), "err: %v", err)
+			if tt.wantErr != nil {
+				assert.Equal(t, tt.wantErr, err, "cancellation is not wrapped")
+			}
+		})
+	}
+
+	t.Run("progress changes", func(t *testing.T) {
+		a := &Assets{Repo: &watchRepo{states: []*types.Asset{processing}}}
+		r := a.trackProgress("k1", 4, strings.NewReader("data"))
+		var received []int64
+		err := a.WatchByKey(context.Background(), "k1", time.Millisecond, func(asset *types.Asset) error {
+			received = append(received, asset.Progress.GetReceived())
+			if len(received) == 1 {
+				_, err := io.ReadAll(r)
+				require.NoError(t, err)
+			} else {
+				a.Repo = &watchRepo{states: []*types.Asset{done}}
+				a.untrackProgress("k1")
+			}
+			return nil
+		})
+		require.NoError(t, err)
+		assert.Equal(t, []int64{0, 4, -1}, received)
+	})
+}
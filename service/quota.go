@@ -0,0 +1,193 @@
+package service
+
+import (
+	"context"
+	"io"
+	"os"
+	"time"
+
+	"github.com/bbars/assets/service/storage"
+	"github.com/bbars/assets/service/tracing"
+	"github.com/bbars/assets/service/types"
+	"github.com/bbars/assets/utils"
+	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+var (
+	ErrQuotaExceeded = errors.New("user quota exceeded")
+)
+
+func (a *Assets) Usage(ctx context.Context, userId string) (usage *types.Usage, err error) {
+	ctx, span := tracing.Start(ctx, "Assets.Usage", attribute.String("user.id", userId))
+	defer tracing.End(span, &err)
+	defer RecoverService(ctx, &err)
+
+	if userId == "" {
+		err = NewError(ErrorCode_invalid, errors.New("value of userId can't be empty"))
+		return
+	}
+	usage, err = a.Repo.GetUsage(ctx, userId)
+	if err != nil {
+		err = errors.Wrapf(err, "query usage of user_id=%+q", userId)
+		return
+	}
+	if usage.MaxSize == nil {
+		usage.MaxSize = &a.Config.UserMaxSize
+	}
+	if usage.MaxCount == nil {
+		usage.MaxCount = &a.Config.UserMaxCount
+	}
+	return
+}
+
+// SetUserMaxSize overrides default size quota for the user.
+// Pass nil to fall back to the default quota, 0 to disable the limit.
+func (a *Assets) SetUserMaxSize(ctx context.Context, userId string, maxSize *int64) (usage *types.Usage, err error) {
+	return a.setUserQuota(ctx, userId, func(usage *types.Usage) {
+		usage.MaxSize = maxSize
+	})
+}
+
+// SetUserMaxCount overrides default asset count quota for the user.
+// Pass nil to fall back to the default quota, 0 to disable the limit.
+func (a *Assets) SetUserMaxCount(ctx context.Context, userId string, maxCount *int64) (usage *types.Usage, err error) {
+	return a.setUserQuota(ctx, userId, func(usage *types.Usage) {
+		usage.MaxCount = maxCount
+	})
+}
+
+func (a *Assets) setUserQuota(ctx context.Context, userId string, modify func(usage *types.Usage)) (usage *types.Usage, err error) {
+	defer RecoverService(ctx, &err)
+
+	if userId == "" {
+		err = NewError(ErrorCode_invalid, errors.New("value of userId can't be empty"))
+		return
+	}
+	usage, err = a.Repo.GetUsage(ctx, userId)
+	if err != nil {
+		err = errors.Wrapf(err, "query usage of user_id=%+q", userId)
+		return
+	}
+	modify(usage)
+	err = a.Repo.SetQuota(ctx, userId, usage.MaxSize, usage.MaxCount)
+	if err != nil {
+		err = errors.Wrapf(err, "set quota of user_id=%+q", userId)
+		return
+	}
+	return a.Usage(ctx, userId)
+}
+
+// checkUserQuota ensures the user is able to store count more assets.
+// The size quota is not checked before the content is hashed: content already owned by the user
+// doesn't grow the usage, so the size is limited by writeByUser and checked by verifyUserQuota when the asset is saved.
+func (a *Assets) checkUserQuota(ctx context.Context, userId string, count int64) (err error) {
+	if userId == "" {
+		return
+	}
+	usage, err := a.Usage(ctx, userId)
+	if err != nil {
+		return
+	}
+	if *usage.MaxCount > 0 && usage.Count+count > *usage.MaxCount {
+		err = errors.Wrapf(ErrQuotaExceeded, "asset count %d reached limit %d", usage.Count, *usage.MaxCount)
+		return
+	}
+	return
+}
+
+// writeByUser writes the data to the storage within the size quota of the user as well as maxSize.
+// The exact usage is unknown until the content is hashed, so the limit is the remaining quota
+// or the usage if larger (content owned by the user is not larger than the usage), verifyUserQuota does the rest.
+func (a *Assets) writeByUser(ctx context.Context, userId string, r io.Reader, maxSize int64) (exists bool, contentHash string, size int64, err error) {
+	var quotaSize int64
+	if userId != "" {
+		var usage *types.Usage
+		usage, err = a.Usage(ctx, userId)
+		if err != nil {
+			return
+		}
+		if *usage.MaxSize > 0 {
+			quotaSize = *usage.MaxSize - usage.Size
+			if quotaSize < usage.Size {
+				quotaSize = usage.Size
+			}
+		}
+	}
+
+	exists, contentHash, size, err = a.Storage.Write(ctx, r, minLimit(maxSize, quotaSize))
+	if err != nil && errors.Is(err, storage.ErrTooLarge) && quotaSize > 0 && minLimit(maxSize, quotaSize) == quotaSize {
+		err = errors.Wrapf(ErrQuotaExceeded, "write exceeds size quota of user_id=%+q: %s", userId, err.Error())
+	}
+	return
+}
+
+// verifyUserQuota checks the usage after the asset is saved (so content owned by the user is counted once)
+// to catch writes exceeding the quota, including concurrent ones, and revokes the asset if so.
+func (a *Assets) verifyUserQuota(ctx context.Context, asset *types.Asset) (err error) {
+	if asset.UserId == "" {
+		return
+	}
+	usage, err := a.Usage(ctx, asset.UserId)
+	if err != nil {
+		return
+	}
+	switch {
+	case *usage.MaxCount > 0 && usage.Count > *usage.MaxCount:
+		err = errors.Wrapf(ErrQuotaExceeded, "asset count %d exceeds limit %d", usage.Count, *usage.MaxCount)
+	case *usage.MaxSize > 0 && usage.Size > *usage.MaxSize:
+		err = errors.Wrapf(ErrQuotaExceeded, "size %d exceeds limit %d", usage.Size, *usage.MaxSize)
+	default:
+		return
+	}
+
+	now := time.Now()
+	asset.Deleted = true
+	asset.Dtime = &now
+	asset.Error = err.Error()
+	revokeErr := a.Repo.Update(ctx, asset)
+	if revokeErr != nil {
+		err = errors.Wrapf(err, "revoke asset: %s", revokeErr.Error())
+		return
+	}
+	if !asset.Dedup && asset.ContentHash != "" {
+		removeErr := a.removeOrphanedBlob(ctx, asset.ContentHash)
+		if removeErr != nil {
+			utils.ContextLogger(ctx).Error("remove blob of revoked asset", "assetKey", asset.AssetKey, "err", removeErr)
+		}
+	}
+	return
+}
+
+// removeOrphanedBlob removes the blob written for the revoked asset unless other assets reference it.
+func (a *Assets) removeOrphanedBlob(ctx context.Context, contentHash string) (err error) {
+	count, err := a.Repo.CountByContentHash(ctx, contentHash)
+	if err != nil {
+		err = errors.Wrapf(err, "count assets by content_hash=%+q", contentHash)
+		return
+	}
+	if count > 0 {
+		return
+	}
+	paths, err := a.blobFiles(contentHash)
+	if err != nil {
+		return
+	}
+	for _, path := range paths {
+		err = os.Remove(path)
+		if err != nil && !os.IsNotExist(err) {
+			err = errors.Wrapf(err, "remove blob file %+q", path)
+			return
+		}
+		err = nil
+	}
+	return
+}
+
+// minLimit returns the strictest of two limits, where 0 means no limit.
+func minLimit(a int64, b int64) int64 {
+	if a <= 0 || (b > 0 && b < a) {
+		return b
+	}
+	return a
+}
@@ -0,0 +1,30 @@
+package service
+
+import (
+	"context"
+
+	"github.com/bbars/assets/service/storage"
+	"github.com/bbars/assets/service/tracing"
+	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// RekeyBlob encrypts the blob by the current key of the storage (see storage.EncryptedStorage.Rekey),
+// changed is false if it is encrypted by the key already.
+func (a *Assets) RekeyBlob(ctx context.Context, contentHash string) (changed bool, err error) {
+	ctx, span := tracing.Start(ctx, "Assets.RekeyBlob", attribute.String("asset.content_hash", contentHash))
+	defer tracing.End(span, &err)
+	defer RecoverService(ctx, &err)
+
+	rekeyer, ok := a.Storage.(storage.Rekeyer)
+	if !ok {
+		err = errors.New("storage does not support encryption")
+		return
+	}
+	changed, err = rekeyer.Rekey(ctx, contentHash)
+	if err != nil {
+		err = errors.Wrap(err, "rekey blob")
+		return
+	}
+	return
+}
@@ -1,7 +1,9 @@
 package repository
 
 import (
+	"context"
 	"errors"
+	"time"
 
 	"github.com/bbars/assets/service/types"
 )
@@ -16,9 +18,20 @@ var (
 )
 
 type Repository interface {
-	Migrate() (err error)
-	GetByAssetKey(assetKey string) (asset *types.Asset, err error)
-	GetByOriginalUrl(originalUrl string, allowError bool) (asset *types.Asset, err error)
-	Insert(asset *types.Asset) (err error)
-	Update(asset *types.Asset) (err error)
+	Migrate(ctx context.Context) (err error)
+	PendingMigrations(ctx context.Context) (migrationNames []string, err error)
+	GetByAssetKey(ctx context.Context, assetKey string) (asset *types.Asset, err error)
+	GetByOriginalUrl(ctx context.Context, originalUrl string, allowError bool) (asset *types.Asset, err error)
+	GetByFile(ctx context.Context, userId string, absolutePath string, mtime time.Time, size int64) (asset *types.Asset, err error)
+	ListUnfinished(ctx context.Context) (assets []*types.Asset, err error)
+	ListByUserId(ctx context.Context, userId string) (assets []*types.Asset, err error)
+	Insert(ctx context.Context, asset *types.Asset) (err error)
+	Update(ctx context.Context, asset *types.Asset) (err error)
+	GetUsage(ctx context.Context, userId string) (usage *types.Usage, err error)
+	ListBlobs(ctx context.Context) (blobs map[string]int64, err error)
+	CountByContentHash(ctx context.Context, contentHash string) (count int64, err error)
+	Backup(ctx context.Context, path string) (blobs map[string]int64, err error)
+	Restore(ctx context.Context, path string) (err error)
+	SetStorageName(ctx context.Context, contentHash string, storageName string) (err error)
+	SetQuota(ctx context.Context, userId string, maxSize *int64, maxCount *int64) (err error)
 }
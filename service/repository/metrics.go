@@ -0,0 +1,35 @@
+package repository
+
+import (
+	"context"
+	"time"
+
+	"github.com/bbars/assets/service/metrics"
+	"github.com/bbars/assets/service/tracing"
+	semconv "go.opentelemetry.io/otel/semconv/v1.17.0"
+)
+
+var (
+	metricQueryDuration = metrics.NewHistogram(
+		"assets_repository_query_duration_seconds",
+		"Repository query latencies by method.",
+		nil,
+		"query",
+	)
+)
+
+// startQuery starts a span of the query and returns a function
+// to be deferred to observe the query latency and end the span.
+func startQuery(ctx context.Context, query string) (context.Context, func(err *error)) {
+	start := time.Now()
+	ctx, span := tracing.Start(
+		ctx,
+		"repository."+query,
+		semconv.DBSystemSqlite,
+		semconv.DBOperation(query),
+	)
+	return ctx, func(err *error) {
+		metricQueryDuration.Observe(time.Since(start).Seconds(), query)
+		tracing.End(span, err)
+	}
+}
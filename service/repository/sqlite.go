@@ -1,7 +1,9 @@
 package repository
 
 import (
+	"context"
 	"database/sql"
+	"encoding/json"
 	"fmt"
 	"io"
 	"io/fs"
@@ -32,7 +34,10 @@ func NewSqlite(db *sql.DB, migrations fs.ReadDirFS) *sqlite {
 
 var _ Repository = &sqlite{}
 
-func (sq *sqlite) Migrate() (err error) {
+func (sq *sqlite) Migrate(ctx context.Context) (err error) {
+	ctx, end := startQuery(ctx, "migrate")
+	defer end(&err)
+
 	dirEntries, err := sq.migrations.ReadDir(SqliteMigrationsDir)
 	if err != nil {
 		err = errors.Wrap(err, "list migrations")
@@ -40,7 +45,7 @@ func (sq *sqlite) Migrate() (err error) {
 	}
 
 	// apply initial migration
-	_ = sq.applyMigration(SqliteMigrationsDir+"/"+InitialMigrationName, true)
+	_ = sq.applyMigration(ctx, SqliteMigrationsDir+"/"+InitialMigrationName, true)
 
 	// apply pending migrations
 	for _, dirEntry := range dirEntries {
@@ -49,7 +54,7 @@ func (sq *sqlite) Migrate() (err error) {
 			continue
 		}
 
-		err = sq.applyMigration(SqliteMigrationsDir+"/"+migrationName, false)
+		err = sq.applyMigration(ctx, SqliteMigrationsDir+"/"+migrationName, false)
 		if err != nil {
 			err = errors.Wrapf(err, "apply migration %+q", migrationName)
 			break
@@ -59,37 +64,67 @@ func (sq *sqlite) Migrate() (err error) {
 	return
 }
 
-func (sq *sqlite) applyMigration(filePath string, skipPreCheck bool) (err error) {
+func (sq *sqlite) PendingMigrations(ctx context.Context) (migrationNames []string, err error) {
+	ctx, end := startQuery(ctx, "pendingMigrations")
+	defer end(&err)
+
+	dirEntries, err := sq.migrations.ReadDir(SqliteMigrationsDir)
+	if err != nil {
+		err = errors.Wrap(err, "list migrations")
+		return
+	}
+
+	for _, dirEntry := range dirEntries {
+		migrationName := dirEntry.Name()
+		var applied bool
+		applied, err = sq.isMigrationApplied(ctx, migrationName)
+		if err != nil {
+			err = errors.Wrapf(err, "check migration %+q", migrationName)
+			return
+		}
+		if !applied {
+			migrationNames = append(migrationNames, migrationName)
+		}
+	}
+	return
+}
+
+func (sq *sqlite) isMigrationApplied(ctx context.Context, migrationName string) (applied bool, err error) {
+	err = sq.Db.GetContext(
+		ctx,
+		&applied,
+		fmt.Sprintf(
+			`
+			SELECT`+` 1 FROM %s
+			WHERE name = $1
+			AND error = ''
+			`,
+			MigrationTableName,
+		),
+		migrationName,
+	)
+	if errors.Is(err, sql.ErrNoRows) {
+		err = nil
+	}
+	return
+}
+
+func (sq *sqlite) applyMigration(ctx context.Context, filePath string, skipPreCheck bool) (err error) {
 	migrationName := filepath.Base(filePath)
 
 	if !skipPreCheck {
 		var applied bool
-		err = sq.Db.Get(
-			&applied,
-			fmt.Sprintf(
-				`
-				SELECT`+` 1 FROM %s
-				WHERE name = $1
-				AND error = ''
-				`,
-				MigrationTableName,
-			),
-			migrationName,
-		)
+		applied, err = sq.isMigrationApplied(ctx, migrationName)
 		if err != nil {
-			if errors.Is(err, sql.ErrNoRows) {
-				err = nil
-			} else {
-				err = errors.Wrapf(err, "pre-check migration %+q", filePath)
-				return
-			}
+			err = errors.Wrapf(err, "pre-check migration %+q", filePath)
+			return
 		}
 		if applied {
 			return
 		}
 	}
 
-	tx, err := sq.Db.Begin()
+	tx, err := sq.Db.BeginTx(ctx, nil)
 	if err != nil {
 		err = errors.Wrapf(err, "begin transaction for migration %+q", filePath)
 		return
@@ -108,7 +143,8 @@ func (sq *sqlite) applyMigration(filePath string, skipPreCheck bool) (err error)
 			errorMessage = err.Error()
 		}
 
-		_, errFix := sq.Db.Exec(
+		_, errFix := sq.Db.ExecContext(
+			ctx,
 			fmt.Sprintf(
 				`
 				INSERT`+` INTO %s
@@ -141,7 +177,7 @@ func (sq *sqlite) applyMigration(filePath string, skipPreCheck bool) (err error)
 		return
 	}
 
-	_, err = tx.Exec(string(query))
+	_, err = tx.ExecContext(ctx, string(query))
 	if err != nil {
 		err = errors.Wrapf(err, "execute migration %+q", filePath)
 		return
@@ -149,9 +185,13 @@ func (sq *sqlite) applyMigration(filePath string, skipPreCheck bool) (err error)
 	return
 }
 
-func (sq *sqlite) GetByAssetKey(assetKey string) (asset *types.Asset, err error) {
+func (sq *sqlite) GetByAssetKey(ctx context.Context, assetKey string) (asset *types.Asset, err error) {
+	ctx, end := startQuery(ctx, "getByAssetKey")
+	defer end(&err)
+
 	asset = types.NewAsset()
-	err = sq.Db.Get(
+	err = sq.Db.GetContext(
+		ctx,
 		asset,
 		fmt.Sprintf(
 			`
@@ -170,14 +210,19 @@ func (sq *sqlite) GetByAssetKey(assetKey string) (asset *types.Asset, err error)
 	return
 }
 
-func (sq *sqlite) GetByOriginalUrl(originalUrl string, allowError bool) (asset *types.Asset, err error) {
+func (sq *sqlite) GetByOriginalUrl(ctx context.Context, originalUrl string, allowError bool) (asset *types.Asset, err error) {
+	ctx, end := startQuery(ctx, "getByOriginalUrl")
+	defer end(&err)
+
 	asset = types.NewAsset()
-	err = sq.Db.Get(
+	err = sq.Db.GetContext(
+		ctx,
 		asset,
 		fmt.Sprintf(
 			`
 			SELECT`+` * FROM %s
 			WHERE original_url = $1
+			AND NOT deleted
 			AND ($2 OR error = "")
 			`,
 			asset.TableName(),
@@ -193,8 +238,115 @@ func (sq *sqlite) GetByOriginalUrl(originalUrl string, allowError bool) (asset *
 	return
 }
 
-func (sq *sqlite) Insert(asset *types.Asset) (err error) {
-	_, err = sq.Db.NamedExec(
+// GetByFile finds the last asset stored from the local file described in info as
+// {"file": {"absolutePath": ..., "mtime": ...}}.
+// Assets are looked up by the path (see asset_file_path index), mtime is compared as an instant,
+// since it is saved in the time zone of the storing process.
+func (sq *sqlite) GetByFile(ctx context.Context, userId string, absolutePath string, mtime time.Time, size int64) (asset *types.Asset, err error) {
+	ctx, end := startQuery(ctx, "getByFile")
+	defer end(&err)
+
+	var assets []*types.Asset
+	err = sq.Db.SelectContext(
+		ctx,
+		&assets,
+		fmt.Sprintf(
+			`
+			SELECT`+` * FROM %s
+			WHERE COALESCE(user_id, '') = $1
+			AND json_extract(CASE WHEN json_valid(info) THEN info ELSE '{}' END, '$.file.absolutePath') = $2
+			AND size = $3
+			AND status = $4
+			AND NOT deleted
+			ORDER BY btime DESC
+			`,
+			types.NewAsset().TableName(),
+		),
+		userId,
+		absolutePath,
+		size,
+		types.AssetStatus_done,
+	)
+	if err != nil {
+		err = errors.Wrap(err, "select assets by file")
+		return
+	}
+	for _, candidate := range assets {
+		fileInfo := struct {
+			File struct {
+				Mtime *time.Time `json:"mtime"`
+			} `json:"file"`
+		}{}
+		if json.Unmarshal([]byte(candidate.Info), &fileInfo) == nil && fileInfo.File.Mtime != nil && fileInfo.File.Mtime.Equal(mtime) {
+			asset = candidate
+			return
+		}
+	}
+	err = errors.Wrap(ErrNotFound, "select asset by file")
+	return
+}
+
+func (sq *sqlite) ListUnfinished(ctx context.Context) (assets []*types.Asset, err error) {
+	ctx, end := startQuery(ctx, "listUnfinished")
+	defer end(&err)
+
+	err = sq.Db.SelectContext(
+		ctx,
+		&assets,
+		fmt.Sprintf(
+			`
+			SELECT`+` * FROM %s
+			WHERE status IN ($1, $2)
+			AND COALESCE(original_url, '') != ''
+			AND NOT deleted
+			ORDER BY btime
+			`,
+			(&types.Asset{}).TableName(),
+		),
+		types.AssetStatus_pending,
+		types.AssetStatus_processing,
+	)
+	return
+}
+
+func (sq *sqlite) ListByUserId(ctx context.Context, userId string) (assets []*types.Asset, err error) {
+	ctx, end := startQuery(ctx, "listByUserId")
+	defer end(&err)
+
+	err = sq.Db.SelectContext(
+		ctx,
+		&assets,
+		fmt.Sprintf(
+			`
+			SELECT`+` * FROM %s
+			WHERE COALESCE(user_id, '') = $1
+			AND status = $2
+			AND NOT deleted
+			ORDER BY btime
+			`,
+			(&types.Asset{}).TableName(),
+		),
+		userId,
+		types.AssetStatus_done,
+	)
+	return
+}
+
+func (sq *sqlite) Insert(ctx context.Context, asset *types.Asset) (err error) {
+	ctx, end := startQuery(ctx, "insert")
+	defer end(&err)
+
+	tx, err := sq.Db.BeginTxx(ctx, nil)
+	if err != nil {
+		err = errors.Wrap(err, "begin transaction")
+		return
+	}
+	defer func() {
+		err = sq.endTx(tx, err)
+	}()
+
+	_, err = tx.NamedExecContext(
+		ctx,
 		fmt.Sprintf(
 			`
 			INSERT`+` INTO %s
@@ -206,15 +358,53 @@ func (sq *sqlite) Insert(asset *types.Asset) (err error) {
 		),
 		asset,
 	)
+	if err != nil {
+		return
+	}
 	//_, err = sqlite.Insert(sq.Db, asset)
+
+	err = sq.refreshUsage(ctx, tx, asset.UserId)
 	return
 }
 
-func (sq *sqlite) Update(asset *types.Asset) (err error) {
+func (sq *sqlite) Update(ctx context.Context, asset *types.Asset) (err error) {
+	ctx, end := startQuery(ctx, "update")
+	defer end(&err)
+
 	now := time.Now()
 	asset.Mtime = &now
 
-	_, err = sq.Db.NamedExec(
+	tx, err := sq.Db.BeginTxx(ctx, nil)
+	if err != nil {
+		err = errors.Wrap(err, "begin transaction")
+		return
+	}
+	defer func() {
+		err = sq.endTx(tx, err)
+	}()
+
+	var prevUserId sql.NullString
+	err = tx.GetContext(
+		ctx,
+		&prevUserId,
+		fmt.Sprintf(
+			`
+			SELECT`+` user_id FROM %s
+			WHERE asset_key = $1
+			`,
+			asset.TableName(),
+		),
+		asset.AssetKey,
+	)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			err = errors.Wrap(ErrNotFound, "select asset by asset key")
+		}
+		return
+	}
+
+	_, err = tx.NamedExecContext(
+		ctx,
 		fmt.Sprintf(
 			`
 			UPDATE`+` %s
@@ -238,6 +428,9 @@ func (sq *sqlite) Update(asset *types.Asset) (err error) {
 		),
 		asset,
 	)
+	if err != nil {
+		return
+	}
 	/*
 		_, err = sqlite.UpdateOne(sq.Db,
 			[]string{
@@ -259,5 +452,180 @@ func (sq *sqlite) Update(asset *types.Asset) (err error) {
 		)
 		return
 	*/
+
+	err = sq.refreshUsage(ctx, tx, asset.UserId)
+	if err != nil {
+		return
+	}
+	if prevUserId.String != asset.UserId {
+		err = sq.refreshUsage(ctx, tx, prevUserId.String)
+	}
+	return
+}
+
+// SetStorageName sets storage name of stored assets referencing the blob.
+func (sq *sqlite) SetStorageName(ctx context.Context, contentHash string, storageName string) (err error) {
+	ctx, end := startQuery(ctx, "setStorageName")
+	defer end(&err)
+
+	_, err = sq.Db.ExecContext(
+		ctx,
+		fmt.Sprintf(
+			`
+			UPDATE`+` %s
+			SET storage_name = $1
+			WHERE content_hash = $2
+			AND status = $3
+			AND NOT deleted
+			`,
+			(&types.Asset{}).TableName(),
+		),
+		storageName,
+		contentHash,
+		types.AssetStatus_done,
+	)
+	return
+}
+
+// CountByContentHash counts assets referencing the blob, except deleted ones.
+func (sq *sqlite) CountByContentHash(ctx context.Context, contentHash string) (count int64, err error) {
+	ctx, end := startQuery(ctx, "countByContentHash")
+	defer end(&err)
+
+	err = sq.Db.GetContext(
+		ctx,
+		&count,
+		fmt.Sprintf(
+			`
+			SELECT`+` COUNT(*) FROM %s
+			WHERE content_hash = $1
+			AND NOT deleted
+			`,
+			(&types.Asset{}).TableName(),
+		),
+		contentHash,
+	)
+	return
+}
+
+func (sq *sqlite) GetUsage(ctx context.Context, userId string) (usage *types.Usage, err error) {
+	ctx, end := startQuery(ctx, "getUsage")
+	defer end(&err)
+
+	usage = &types.Usage{}
+	err = sq.Db.GetContext(
+		ctx,
+		usage,
+		fmt.Sprintf(
+			`
+			SELECT`+` * FROM %s
+			WHERE user_id = $1
+			`,
+			usage.TableName(),
+		),
+		userId,
+	)
+	if errors.Is(err, sql.ErrNoRows) {
+		// nothing stored yet
+		usage.UserId = userId
+		err = nil
+	}
+	return
+}
+
+func (sq *sqlite) SetQuota(ctx context.Context, userId string, maxSize *int64, maxCount *int64) (err error) {
+	ctx, end := startQuery(ctx, "setQuota")
+	defer end(&err)
+
+	tx, err := sq.Db.BeginTxx(ctx, nil)
+	if err != nil {
+		err = errors.Wrap(err, "begin transaction")
+		return
+	}
+	defer func() {
+		err = sq.endTx(tx, err)
+	}()
+
+	err = sq.refreshUsage(ctx, tx, userId)
+	if err != nil {
+		return
+	}
+	_, err = tx.ExecContext(
+		ctx,
+		fmt.Sprintf(
+			`
+			UPDATE`+` %s
+			SET
+			  max_size = $1
+			, max_count = $2
+			WHERE user_id = $3
+			`,
+			(&types.Usage{}).TableName(),
+		),
+		maxSize,
+		maxCount,
+		userId,
+	)
 	return
 }
+
+// refreshUsage recalculates usage of the user within the transaction.
+// Blobs with the same content_hash are counted once per user.
+func (sq *sqlite) refreshUsage(ctx context.Context, tx *sqlx.Tx, userId string) (err error) {
+	if userId == "" {
+		return
+	}
+	_, err = tx.ExecContext(
+		ctx,
+		fmt.Sprintf(
+			`
+			INSERT`+` INTO %s
+			(user_id, size, count, mtime)
+			VALUES (
+			  $1
+			, (
+				SELECT COALESCE(SUM(size), 0) FROM (
+				  SELECT MAX(size) AS size FROM %s
+				  WHERE user_id = $1
+				  AND NOT deleted
+				  AND COALESCE(error, '') = ''
+				  GROUP BY CASE WHEN COALESCE(content_hash, '') = '' THEN asset_key ELSE content_hash END
+				)
+			  )
+			, (
+				SELECT COUNT(*) FROM %s
+				WHERE user_id = $1
+				AND NOT deleted
+				AND COALESCE(error, '') = ''
+			  )
+			, $2
+			)
+			ON CONFLICT (user_id) DO UPDATE SET
+			  size = excluded.size
+			, count = excluded.count
+			, mtime = excluded.mtime
+			`,
+			(&types.Usage{}).TableName(),
+			(&types.Asset{}).TableName(),
+			(&types.Asset{}).TableName(),
+		),
+		userId,
+		time.Now().UTC(),
+	)
+	if err != nil {
+		err = errors.Wrapf(err, "refresh usage of user_id=%+q", userId)
+		return
+	}
+	return
+}
+
+func (sq *sqlite) endTx(tx *sqlx.Tx, err error) error {
+	if err != nil {
+		rollbackErr := tx.Rollback()
+		if rollbackErr != nil {
+			err = errors.Wrapf(err, "rollback: %s", rollbackErr.Error())
+		}
+		return err
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,135 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"github.com/bbars/assets/service/types"
+	"github.com/mattn/go-sqlite3"
+	"github.com/pkg/errors"
+)
+
+// Backup writes a consistent copy of the database to the file using SQLite online backup API,
+// blobs referenced by the copy are returned (see ListBlobs).
+func (sq *sqlite) Backup(ctx context.Context, path string) (blobs map[string]int64, err error) {
+	ctx, end := startQuery(ctx, "backup")
+	defer end(&err)
+
+	dst, err := sql.Open("sqlite3", path)
+	if err != nil {
+		err = errors.Wrapf(err, "open backup database %+q", path)
+		return
+	}
+	defer func() {
+		closeErr := dst.Close()
+		if closeErr != nil && err == nil {
+			err = errors.Wrapf(closeErr, "close backup database %+q", path)
+		}
+	}()
+
+	err = copySqlite(ctx, dst, sq.Db.DB)
+	if err != nil {
+		return
+	}
+	blobs, err = NewSqlite(dst, nil).ListBlobs(ctx)
+	if err != nil {
+		err = errors.Wrap(err, "list blobs of backup database")
+		return
+	}
+	return
+}
+
+// Restore replaces the database contents with a copy made by Backup.
+func (sq *sqlite) Restore(ctx context.Context, path string) (err error) {
+	ctx, end := startQuery(ctx, "restore")
+	defer end(&err)
+
+	src, err := sql.Open("sqlite3", "file:"+path+"?mode=ro")
+	if err != nil {
+		err = errors.Wrapf(err, "open backup database %+q", path)
+		return
+	}
+	defer func() {
+		_ = src.Close()
+	}()
+
+	err = copySqlite(ctx, sq.Db.DB, src)
+	return
+}
+
+// ListBlobs returns sizes of blobs referenced by stored assets by content hash.
+func (sq *sqlite) ListBlobs(ctx context.Context) (blobs map[string]int64, err error) {
+	ctx, end := startQuery(ctx, "listBlobs")
+	defer end(&err)
+
+	rows, err := sq.Db.QueryContext(
+		ctx,
+		fmt.Sprintf(
+			`
+			SELECT`+` content_hash, MAX(size) FROM %s
+			WHERE COALESCE(content_hash, '') != ''
+			AND status = $1
+			AND NOT deleted
+			GROUP BY content_hash
+			`,
+			(&types.Asset{}).TableName(),
+		),
+		types.AssetStatus_done,
+	)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	blobs = make(map[string]int64)
+	for rows.Next() {
+		var contentHash string
+		var size int64
+		err = rows.Scan(&contentHash, &size)
+		if err != nil {
+			return
+		}
+		blobs[contentHash] = size
+	}
+	err = rows.Err()
+	return
+}
+
+// copySqlite copies all pages of src database to dst one.
+func copySqlite(ctx context.Context, dst *sql.DB, src *sql.DB) (err error) {
+	dstConn, err := dst.Conn(ctx)
+	if err != nil {
+		err = errors.Wrap(err, "connect to destination database")
+		return
+	}
+	defer dstConn.Close()
+	srcConn, err := src.Conn(ctx)
+	if err != nil {
+		err = errors.Wrap(err, "connect to source database")
+		return
+	}
+	defer srcConn.Close()
+
+	return dstConn.Raw(func(dstDriverConn any) error {
+		return srcConn.Raw(func(srcDriverConn any) (err error) {
+			backup, err := dstDriverConn.(*sqlite3.SQLiteConn).Backup("main", srcDriverConn.(*sqlite3.SQLiteConn), "main")
+			if err != nil {
+				err = errors.Wrap(err, "start backup")
+				return
+			}
+			defer func() {
+				finishErr := backup.Finish()
+				if finishErr != nil && err == nil {
+					err = errors.Wrap(finishErr, "finish backup")
+				}
+			}()
+			_, err = backup.Step(-1)
+			if err != nil {
+				err = errors.Wrap(err, "copy pages")
+				return
+			}
+			return
+		})
+	})
+}
@@ -0,0 +1,73 @@
+package service
+
+import (
+	"context"
+	"sync/atomic"
+
+	"github.com/bbars/assets/utils"
+	"github.com/pkg/errors"
+)
+
+// goFetch runs a background fetch tracked by Drain.
+func (a *Assets) goFetch(fetch func()) {
+	a.fetches.Add(1)
+	metricFetchesInFlight.Inc()
+	go func() {
+		defer a.fetches.Done()
+		defer metricFetchesInFlight.Dec()
+		fetch()
+	}()
+}
+
+func (a *Assets) isDraining() bool {
+	return atomic.LoadInt32(&a.draining) != 0
+}
+
+// Drain waits for background fetches to finish until ctx is done.
+// Fetches interrupted by cancellation of their context after Drain is called
+// are saved with pending status to be resumed by ResumeFetches on next start.
+func (a *Assets) Drain(ctx context.Context) (err error) {
+	atomic.StoreInt32(&a.draining, 1)
+
+	done := make(chan struct{})
+	go func() {
+		a.fetches.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		err = errors.Wrap(ctx.Err(), "drain background fetches")
+	}
+	return
+}
+
+// ResumeFetches starts fetching (in background, one by one) assets left
+// unfinished by interrupted fetches.
+func (a *Assets) ResumeFetches(ctx context.Context) (count int, err error) {
+	defer RecoverService(ctx, &err)
+
+	assets, err := a.Repo.ListUnfinished(ctx)
+	if err != nil {
+		err = errors.Wrap(err, "query unfinished assets")
+		return
+	}
+	count = len(assets)
+	if count == 0 {
+		return
+	}
+
+	a.goFetch(func() {
+		for _, asset := range assets {
+			if ctx.Err() != nil {
+				return
+			}
+			_, fetchErr := a.storeByOriginalUrl(ctx, asset, nil, nil)
+			if fetchErr != nil {
+				utils.ContextLogger(ctx).Error("resume fetch failed", "assetKey", asset.AssetKey, "err", fetchErr)
+			}
+		}
+	})
+	return
+}
@@ -1,13 +1,34 @@
 package storage
 
 import (
+	"context"
 	"io"
 
 	"github.com/bbars/assets/utils"
+	"github.com/pkg/errors"
+)
+
+var (
+	ErrTooLarge = errors.New("size limit exceeded")
 )
 
 type Storage interface {
-	OpenRead(contentHash string, rng *utils.Range) (rc io.ReadCloser, err error)
-	Write(r io.Reader, maxSize int64) (exists bool, contentHash string, size int64, err error)
-	Check(contentHash string) (exists bool, err error)
+	OpenRead(ctx context.Context, contentHash string, rng *utils.Range) (rc io.ReadCloser, err error)
+	Write(ctx context.Context, r io.Reader, maxSize int64) (exists bool, contentHash string, size int64, err error)
+	Check(ctx context.Context, contentHash string) (exists bool, err error)
+}
+
+// HealthChecker is implemented by storages able to verify they are ready to accept writes.
+type HealthChecker interface {
+	CheckHealth(ctx context.Context, minFreeSpace int64) (err error)
+}
+
+// Rekeyer is implemented by storages encrypting blobs, so they can be re-encrypted by the current key.
+type Rekeyer interface {
+	Rekey(ctx context.Context, contentHash string) (changed bool, err error)
+}
+
+// StatsReporter is implemented by storages able to report their usage and deduplication of blobs.
+type StatsReporter interface {
+	Stats(ctx context.Context) (stats *ChunkStats, err error)
 }
@@ -0,0 +1,552 @@
+package storage
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/bbars/assets/service/tracing"
+	"github.com/bbars/assets/utils"
+	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+const (
+	chunkExt         = ".chunk"
+	chunkManifestExt = ".chunks"
+
+	// chunkManifestMagic - header of manifest files, followed by records of chunks
+	chunkManifestMagic = "CDC1"
+
+	// chunkRecordSize - size of a manifest record: SHA-256 of the chunk and big-endian end offset of it within the blob
+	chunkRecordSize = sha256.Size + 8
+)
+
+// ChunkedStorage splits blobs of the directory storage into content-defined chunks (FastCDC)
+// kept by their SHA-256, so blobs differing by a few bytes share most of their chunks.
+// Content hash is the one of the whole blob.
+//
+// A blob is described by a manifest file listing its chunks with their end offsets,
+// so a range is read by looking up its first chunk by binary search and reading the chunks covering it only.
+// Chunks are never removed, since other blobs may share them.
+// Blobs stored before chunking was enabled are read from Plain storage.
+type ChunkedStorage struct {
+	Dir *DirStorage
+
+	// MinSize, AvgSize, MaxSize - sizes of chunks, AvgSize must be a power of two
+	MinSize int64
+	AvgSize int64
+	MaxSize int64
+
+	// Plain - storage of blobs stored unchunked (read only)
+	Plain Storage
+}
+
+var _ Storage = &ChunkedStorage{}
+
+// ChunkStats - usage of the chunked storage.
+type ChunkStats struct {
+	// Blobs, Size - count and total size of chunked blobs
+	Blobs int64 `json:"blobs"`
+	Size  int64 `json:"size"`
+
+	// Chunks - count of unique chunks
+	Chunks int64 `json:"chunks"`
+
+	// StoredSize - size of chunk and manifest files
+	StoredSize int64 `json:"storedSize"`
+
+	// DedupRatio - Size to StoredSize ratio
+	DedupRatio float64 `json:"dedupRatio"`
+}
+
+// Validate checks the settings.
+func (storage *ChunkedStorage) Validate() (err error) {
+	if storage.MinSize <= 0 || storage.MinSize > storage.AvgSize || storage.AvgSize > storage.MaxSize {
+		err = errors.Errorf(
+			"invalid chunk sizes min=%d avg=%d max=%d, expected 0 < min <= avg <= max",
+			storage.MinSize, storage.AvgSize, storage.MaxSize,
+		)
+		return
+	}
+	if storage.AvgSize&(storage.AvgSize-1) != 0 {
+		err = errors.Errorf("average chunk size %d is not a power of two", storage.AvgSize)
+		return
+	}
+	return
+}
+
+func (storage *ChunkedStorage) OpenRead(ctx context.Context, contentHash string, rng *utils.Range) (rc io.ReadCloser, err error) {
+	ctx, span := tracing.Start(ctx, "ChunkedStorage.OpenRead", attribute.String("asset.content_hash", contentHash))
+	defer tracing.End(span, &err)
+
+	exists, path, err := storage.Dir.dig(contentHash+chunkManifestExt, false)
+	if err != nil {
+		return
+	}
+	if !exists {
+		if storage.Plain == nil {
+			err = os.ErrNotExist
+			return
+		}
+		return storage.Plain.OpenRead(ctx, contentHash, rng)
+	}
+
+	manifest, err := openChunkManifest(path)
+	if err != nil {
+		return
+	}
+	from := int64(0)
+	if rng != nil {
+		from = rng.From
+	}
+	first, start, err := manifest.find(from)
+	if err != nil {
+		_ = manifest.Close()
+		return
+	}
+	utils.ContextLogger(ctx).Debug("open chunked blob", "path", path, "chunks", manifest.count, "firstChunk", first)
+
+	rc = &chunkReader{
+		storage:  storage,
+		manifest: manifest,
+		next:     first,
+		start:    start,
+		skip:     from - start,
+	}
+	if rng != nil {
+		rc = utils.NewRangeReader(rc, 0, rng.Length())
+	}
+	return
+}
+
+func (storage *ChunkedStorage) Write(ctx context.Context, r io.Reader, maxSize int64) (exists bool, contentHash string, size int64, err error) {
+	ctx, span := tracing.Start(ctx, "ChunkedStorage.Write")
+	defer func() {
+		span.SetAttributes(
+			attribute.String("asset.content_hash", contentHash),
+			attribute.Int64("asset.size", size),
+			attribute.Bool("storage.exists", exists),
+		)
+		tracing.End(span, &err)
+	}()
+
+	tempPath, contentHash, size, err := storage.Dir.storeTemp(r, maxSize)
+	defer func() {
+		if tempPath == "" {
+			return
+		}
+		rmTempErr := os.Remove(tempPath)
+		if rmTempErr != nil && err == nil {
+			err = errors.Wrapf(rmTempErr, "remove temp file %+q", tempPath)
+			return
+		}
+	}()
+	if err != nil {
+		err = errors.Wrap(err, "store temporary")
+		return
+	}
+
+	exists, err = storage.Check(ctx, contentHash)
+	if err != nil || exists {
+		return
+	}
+
+	err = storage.storeChunks(ctx, tempPath, contentHash, size)
+	return
+}
+
+func (storage *ChunkedStorage) Check(ctx context.Context, contentHash string) (exists bool, err error) {
+	exists, _, err = storage.Dir.dig(contentHash+chunkManifestExt, false)
+	if err != nil || exists || storage.Plain == nil {
+		return
+	}
+	return storage.Plain.Check(ctx, contentHash)
+}
+
+// Path returns path of the blob file (e.g. to hard-link it) if it is stored unchunked,
+// os.ErrNotExist if there is no such blob or it is chunked.
+func (storage *ChunkedStorage) Path(contentHash string) (path string, err error) {
+	exists, _, err := storage.Dir.dig(contentHash+chunkManifestExt, false)
+	if err != nil {
+		return
+	}
+	plain, ok := storage.Plain.(interface {
+		Path(contentHash string) (path string, err error)
+	})
+	if exists || !ok {
+		err = os.ErrNotExist
+		return
+	}
+	return plain.Path(contentHash)
+}
+
+// Files returns paths of files of the blob, empty if there is no such blob.
+// Only the manifest is returned for a chunked blob, since its chunks may be shared.
+func (storage *ChunkedStorage) Files(contentHash string) (paths []string, err error) {
+	exists, path, err := storage.Dir.dig(contentHash+chunkManifestExt, false)
+	if err != nil {
+		return
+	}
+	if exists {
+		paths = []string{path}
+		return
+	}
+	if plain, ok := storage.Plain.(interface {
+		Files(contentHash string) (paths []string, err error)
+	}); ok {
+		return plain.Files(contentHash)
+	}
+	return
+}
+
+var _ HealthChecker = &ChunkedStorage{}
+
+func (storage *ChunkedStorage) CheckHealth(ctx context.Context, minFreeSpace int64) (err error) {
+	return storage.Dir.CheckHealth(ctx, minFreeSpace)
+}
+
+var _ StatsReporter = &ChunkedStorage{}
+
+// Stats walks the storage directory counting chunked blobs and chunks.
+func (storage *ChunkedStorage) Stats(ctx context.Context) (stats *ChunkStats, err error) {
+	ctx, span := tracing.Start(ctx, "ChunkedStorage.Stats")
+	defer tracing.End(span, &err)
+
+	stats = &ChunkStats{}
+	err = filepath.WalkDir(storage.Dir.Dir, func(path string, entry fs.DirEntry, walkErr error) (err error) {
+		if walkErr != nil {
+			return walkErr
+		}
+		if err = ctx.Err(); err != nil {
+			return
+		}
+		isChunk := strings.HasSuffix(path, chunkExt)
+		isManifest := strings.HasSuffix(path, chunkManifestExt)
+		if entry.IsDir() || !isChunk && !isManifest {
+			return
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return
+		}
+		stats.StoredSize += info.Size()
+		if isChunk {
+			stats.Chunks++
+			return
+		}
+
+		manifest, err := openChunkManifest(path)
+		if err != nil {
+			return
+		}
+		defer manifest.Close()
+		size, err := manifest.size()
+		if err != nil {
+			return
+		}
+		stats.Blobs++
+		stats.Size += size
+		return
+	})
+	if err != nil {
+		err = errors.Wrapf(err, "walk directory %+q", storage.Dir.Dir)
+		return
+	}
+	if stats.StoredSize > 0 {
+		stats.DedupRatio = float64(stats.Size) / float64(stats.StoredSize)
+	}
+	return
+}
+
+// storeChunks splits the temp file into chunks storing missing ones and writes the manifest of the blob.
+func (storage *ChunkedStorage) storeChunks(ctx context.Context, tempPath string, contentHash string, size int64) (err error) {
+	src, err := os.Open(tempPath)
+	if err != nil {
+		return
+	}
+	defer src.Close()
+
+	f, err := os.CreateTemp(storage.Dir.Dir, "asset")
+	if err != nil {
+		err = errors.Wrap(err, "create temp file for manifest")
+		return
+	}
+	manifestTempPath := f.Name()
+	defer func() {
+		if manifestTempPath != "" {
+			_ = os.Remove(manifestTempPath)
+		}
+	}()
+
+	chunks, newChunks, newBytes := 0, 0, int64(0)
+	w := bufio.NewWriter(f)
+	_, err = w.WriteString(chunkManifestMagic)
+	c := newChunker(src, int(storage.MinSize), int(storage.AvgSize), int(storage.MaxSize))
+	record := make([]byte, chunkRecordSize)
+	end := int64(0)
+	for err == nil {
+		var chunk []byte
+		chunk, err = c.Next()
+		if err == io.EOF {
+			err = nil
+			break
+		} else if err != nil {
+			err = errors.Wrap(err, "read chunk")
+			break
+		}
+
+		sum := sha256.Sum256(chunk)
+		var created bool
+		created, err = storage.storeChunk(hex.EncodeToString(sum[:]), chunk)
+		if err != nil {
+			break
+		}
+		observeChunkWrite(created, len(chunk))
+		if created {
+			newChunks++
+			newBytes += int64(len(chunk))
+		}
+		chunks++
+
+		end += int64(len(chunk))
+		copy(record, sum[:])
+		binary.BigEndian.PutUint64(record[sha256.Size:], uint64(end))
+		_, err = w.Write(record)
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	closeErr := f.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		err = errors.Wrap(err, "write manifest")
+		return
+	}
+	if end != size {
+		err = errors.Errorf("chunks size %d differs from blob size %d", end, size)
+		return
+	}
+
+	// the manifest is moved last, so the blob is never found without its chunks
+	_, path, err := storage.Dir.dig(contentHash+chunkManifestExt, true)
+	if err != nil {
+		err = errors.Wrapf(err, "prepare persistent storage for contentHash=%s", contentHash)
+		return
+	}
+	err = storage.Dir.moveTemp(manifestTempPath, path)
+	if err != nil {
+		return
+	}
+	manifestTempPath = ""
+	utils.ContextLogger(ctx).Debug(
+		"blob stored chunked",
+		"path", path,
+		"size", size,
+		"chunks", chunks,
+		"newChunks", newChunks,
+		"newBytes", newBytes,
+	)
+	return
+}
+
+// storeChunk writes the chunk unless it is stored already.
+func (storage *ChunkedStorage) storeChunk(chunkHash string, data []byte) (created bool, err error) {
+	exists, path, err := storage.Dir.dig(chunkHash+chunkExt, true)
+	if err != nil {
+		err = errors.Wrapf(err, "prepare persistent storage for chunk %s", chunkHash)
+		return
+	}
+	if exists {
+		return
+	}
+
+	f, err := os.CreateTemp(storage.Dir.Dir, "chunk")
+	if err != nil {
+		err = errors.Wrap(err, "create temp file for chunk")
+		return
+	}
+	tempPath := f.Name()
+	_, err = f.Write(data)
+	closeErr := f.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = storage.Dir.moveTemp(tempPath, path)
+	}
+	if err != nil {
+		_ = os.Remove(tempPath)
+		err = errors.Wrapf(err, "write chunk %s", chunkHash)
+		return
+	}
+	created = true
+	return
+}
+
+// chunkManifest - opened manifest file of a chunked blob.
+type chunkManifest struct {
+	*os.File
+	count int64
+}
+
+func openChunkManifest(path string) (manifest *chunkManifest, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		err = errors.Wrapf(err, "open manifest %+q", path)
+		return
+	}
+	magic := make([]byte, len(chunkManifestMagic))
+	_, err = io.ReadFull(f, magic)
+	if err == nil && string(magic) != chunkManifestMagic {
+		err = errors.New("unknown format")
+	}
+	var info os.FileInfo
+	if err == nil {
+		info, err = f.Stat()
+	}
+	if err == nil && (info.Size()-int64(len(chunkManifestMagic)))%chunkRecordSize != 0 {
+		err = errors.New("truncated record")
+	}
+	if err != nil {
+		_ = f.Close()
+		err = errors.Wrapf(err, "read manifest %+q", path)
+		return
+	}
+	manifest = &chunkManifest{
+		File:  f,
+		count: (info.Size() - int64(len(chunkManifestMagic))) / chunkRecordSize,
+	}
+	return
+}
+
+// record returns hash of the chunk and its end offset within the blob.
+func (manifest *chunkManifest) record(index int64) (chunkHash string, end int64, err error) {
+	record := make([]byte, chunkRecordSize)
+	_, err = manifest.ReadAt(record, int64(len(chunkManifestMagic))+index*chunkRecordSize)
+	if err != nil {
+		err = errors.Wrapf(err, "read record #%d of manifest %+q", index, manifest.Name())
+		return
+	}
+	chunkHash = hex.EncodeToString(record[:sha256.Size])
+	end = int64(binary.BigEndian.Uint64(record[sha256.Size:]))
+	return
+}
+
+// size returns size of the blob (end offset of the last chunk).
+func (manifest *chunkManifest) size() (size int64, err error) {
+	if manifest.count == 0 {
+		return
+	}
+	_, size, err = manifest.record(manifest.count - 1)
+	return
+}
+
+// find returns index of the chunk containing offset (count if it is beyond the blob) and start offset of the chunk.
+func (manifest *chunkManifest) find(offset int64) (index int64, start int64, err error) {
+	index = int64(sort.Search(int(manifest.count), func(i int) bool {
+		if err != nil {
+			return true
+		}
+		var end int64
+		_, end, err = manifest.record(int64(i))
+		return end > offset
+	}))
+	if err != nil || index == 0 {
+		return
+	}
+	_, start, err = manifest.record(index - 1)
+	return
+}
+
+// chunkReader reads chunks of the manifest starting from the next one.
+type chunkReader struct {
+	storage  *ChunkedStorage
+	manifest *chunkManifest
+	next     int64
+
+	// start - offset of the next chunk within the blob, skip - bytes to skip of it
+	start int64
+	skip  int64
+
+	chunk     *os.File
+	remaining int64
+}
+
+func (cr *chunkReader) Read(p []byte) (n int, err error) {
+	for n == 0 && err == nil {
+		if cr.chunk == nil {
+			if cr.next >= cr.manifest.count {
+				err = io.EOF
+				return
+			}
+			err = cr.openNext()
+			if err != nil {
+				return
+			}
+		}
+
+		n, err = cr.chunk.Read(p)
+		cr.remaining -= int64(n)
+		if err == io.EOF {
+			if cr.remaining != 0 {
+				err = errors.Errorf("chunk #%d of manifest %+q is truncated", cr.next-1, cr.manifest.Name())
+				return
+			}
+			err = cr.chunk.Close()
+			cr.chunk = nil
+		}
+	}
+	return
+}
+
+func (cr *chunkReader) openNext() (err error) {
+	chunkHash, end, err := cr.manifest.record(cr.next)
+	if err != nil {
+		return
+	}
+	exists, path, err := cr.storage.Dir.dig(chunkHash+chunkExt, false)
+	if err != nil {
+		return
+	}
+	if !exists {
+		err = errors.Errorf("chunk %s of manifest %+q is missing", chunkHash, cr.manifest.Name())
+		return
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		err = errors.Wrapf(err, "open chunk %+q", path)
+		return
+	}
+	if cr.skip > 0 {
+		_, err = f.Seek(cr.skip, io.SeekStart)
+		if err != nil {
+			_ = f.Close()
+			err = errors.Wrapf(err, "seek chunk %+q", path)
+			return
+		}
+	}
+	cr.chunk = f
+	cr.remaining = end - cr.start - cr.skip
+	cr.start = end
+	cr.skip = 0
+	cr.next++
+	return
+}
+
+func (cr *chunkReader) Close() (err error) {
+	if cr.chunk != nil {
+		_ = cr.chunk.Close()
+	}
+	return cr.manifest.Close()
+}
@@ -0,0 +1,180 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"math/rand"
+	"os"
+	"testing"
+
+	"github.com/bbars/assets/utils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestChunker(t *testing.T) {
+	data := make([]byte, 200000)
+	rand.New(rand.NewSource(1)).Read(data)
+
+	split := func(data []byte) (sizes []int) {
+		c := newChunker(bytes.NewReader(data), 256, 1024, 4096)
+		joined := make([]byte, 0, len(data))
+		for {
+			chunk, err := c.Next()
+			if err == io.EOF {
+				break
+			}
+			require.NoError(t, err)
+			joined = append(joined, chunk...)
+			sizes = append(sizes, len(chunk))
+		}
+		assert.True(t, bytes.Equal(data, joined), "chunks make the data")
+		return
+	}
+
+	sizes := split(data)
+	for i, size := range sizes {
+		assert.LessOrEqual(t, size, 4096)
+		if i < len(sizes)-1 {
+			assert.GreaterOrEqual(t, size, 256)
+		}
+	}
+	avg := len(data) / len(sizes)
+	assert.InDelta(t, 1024, avg, 512, "average chunk size")
+
+	// an insertion changes the chunks around it only
+	edited := append(append(append([]byte{}, data[:100000]...), "inserted"...), data[100000:]...)
+	editedSizes := split(edited)
+	assert.Equal(t, sizes[:10], editedSizes[:10])
+	assert.Equal(t, sizes[len(sizes)-10:], editedSizes[len(editedSizes)-10:])
+
+	assert.Empty(t, split(nil))
+}
+
+func TestChunkedStorage(t *testing.T) {
+	ctx := context.Background()
+	random := make([]byte, 50000)
+	rand.New(rand.NewSource(1)).Read(random)
+	newStorage := func(t *testing.T) *ChunkedStorage {
+		cs := &ChunkedStorage{
+			Dir:     &DirStorage{Dir: t.TempDir(), PathDepth: 2, DirPerm: 0755, FilePerm: 0644},
+			MinSize: 256,
+			AvgSize: 1024,
+			MaxSize: 4096,
+		}
+		require.NoError(t, cs.Validate())
+		return cs
+	}
+
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{name: "chunks", data: random},
+		{name: "single chunk", data: random[:100]},
+		{name: "empty", data: []byte{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cs := newStorage(t)
+			exists, contentHash, size, err := cs.Write(ctx, bytes.NewReader(tt.data), 0)
+			require.NoError(t, err)
+			assert.False(t, exists)
+			assert.Equal(t, int64(len(tt.data)), size)
+
+			// the content hash is the one of the whole blob
+			_, plainHash, _, err := (&DirStorage{Dir: t.TempDir(), DirPerm: 0755, FilePerm: 0644}).Write(ctx, bytes.NewReader(tt.data), 0)
+			require.NoError(t, err)
+			assert.Equal(t, plainHash, contentHash)
+
+			exists, _, _, err = cs.Write(ctx, bytes.NewReader(tt.data), 0)
+			require.NoError(t, err)
+			assert.True(t, exists)
+
+			for _, rng := range []*utils.Range{
+				nil,
+				{From: 0, To: 10},
+				{From: 1000, To: 9000},
+				{From: 25000, To: int64(len(tt.data))},
+				{From: int64(len(tt.data)) - 1, To: int64(len(tt.data))},
+			} {
+				if rng != nil && (rng.To > int64(len(tt.data)) || rng.From < 0 || rng.From >= rng.To) {
+					continue
+				}
+				rc, err := cs.OpenRead(ctx, contentHash, rng)
+				require.NoError(t, err)
+				data, err := io.ReadAll(rc)
+				require.NoError(t, err)
+				require.NoError(t, rc.Close())
+				want := tt.data
+				if rng != nil {
+					want = tt.data[rng.From:rng.To]
+				}
+				assert.Equal(t, want, data, "range %v", rng)
+			}
+		})
+	}
+
+	t.Run("similar blobs share chunks", func(t *testing.T) {
+		cs := newStorage(t)
+		edited := append(append(append([]byte{}, random[:20000]...), "a few bytes"...), random[20000:]...)
+		for _, data := range [][]byte{random, edited} {
+			_, _, _, err := cs.Write(ctx, bytes.NewReader(data), 0)
+			require.NoError(t, err)
+		}
+
+		stats, err := cs.Stats(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, int64(2), stats.Blobs)
+		assert.Equal(t, int64(len(random)+len(edited)), stats.Size)
+		assert.Less(t, stats.StoredSize, int64(len(random)+10000))
+		assert.Greater(t, stats.DedupRatio, 1.5)
+	})
+
+	t.Run("missing chunk", func(t *testing.T) {
+		cs := newStorage(t)
+		_, contentHash, _, err := cs.Write(ctx, bytes.NewReader(random), 0)
+		require.NoError(t, err)
+		paths, err := cs.Files(contentHash)
+		require.NoError(t, err)
+		require.Len(t, paths, 1)
+		manifest, err := openChunkManifest(paths[0])
+		require.NoError(t, err)
+		chunkHash, _, err := manifest.record(manifest.count - 1)
+		require.NoError(t, err)
+		require.NoError(t, manifest.Close())
+		_, path, err := cs.Dir.dig(chunkHash+chunkExt, false)
+		require.NoError(t, err)
+		require.NoError(t, os.Remove(path))
+
+		rc, err := cs.OpenRead(ctx, contentHash, &utils.Range{From: 0, To: 100})
+		require.NoError(t, err)
+		_, err = io.ReadAll(rc)
+		assert.NoError(t, err, "chunks before the missing one are readable")
+		require.NoError(t, rc.Close())
+
+		rc, err = cs.OpenRead(ctx, contentHash, nil)
+		require.NoError(t, err)
+		_, err = io.ReadAll(rc)
+		assert.Error(t, err)
+		require.NoError(t, rc.Close())
+	})
+
+	t.Run("unchunked blobs are readable", func(t *testing.T) {
+		cs := newStorage(t)
+		_, contentHash, _, err := cs.Dir.Write(ctx, bytes.NewReader(random), 0)
+		require.NoError(t, err)
+		cs.Plain = cs.Dir
+
+		exists, err := cs.Check(ctx, contentHash)
+		require.NoError(t, err)
+		assert.True(t, exists)
+		rc, err := cs.OpenRead(ctx, contentHash, &utils.Range{From: 100, To: 200})
+		require.NoError(t, err)
+		data, err := io.ReadAll(rc)
+		require.NoError(t, err)
+		require.NoError(t, rc.Close())
+		assert.Equal(t, random[100:200], data)
+	})
+}
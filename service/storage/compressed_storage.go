@@ -0,0 +1,525 @@
+package storage
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/bbars/assets/service/tracing"
+	"github.com/bbars/assets/utils"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+const (
+	CompressionNone = "none"
+	CompressionZstd = "zstd"
+	CompressionGzip = "gzip"
+)
+
+// compressionExts - extensions of blob files by codec, the codec name is also the HTTP content coding.
+var compressionExts = map[string]string{
+	CompressionZstd: ".zst",
+	CompressionGzip: ".gz",
+}
+
+const compressedIndexExt = ".idx"
+
+// DefaultCompressedContentTypes - content types worth compressing, matched against the sniffed content type of a blob.
+var DefaultCompressedContentTypes = []string{
+	"text/*",
+	"application/json",
+	"application/javascript",
+	"application/xml",
+	"image/svg+xml",
+}
+
+// EncodedReader is implemented by storages keeping blobs encoded (e.g. compressed),
+// so they can be served as is to clients accepting the encoding.
+type EncodedReader interface {
+	// OpenEncoded opens the stored form of the blob, encoding is empty (and rc is nil) if it is stored as is.
+	OpenEncoded(ctx context.Context, contentHash string) (rc io.ReadCloser, encoding string, size int64, err error)
+
+	// Encoding returns encoding of the stored form of the blob, empty if it is stored as is.
+	Encoding(ctx context.Context, contentHash string) (encoding string, err error)
+}
+
+// CompressedStorage keeps blobs of the directory storage compressed if their content type is compressible.
+// Content hash is the one of uncompressed data.
+//
+// A blob is split into frames of FrameSize compressed independently, so a range is read by decompressing
+// the frames covering it only (their offsets are kept in a sidecar index file).
+// Concatenated frames make a valid zstd or gzip stream, so the blob file may be served as is.
+// Blobs stored as is or by another codec remain readable.
+type CompressedStorage struct {
+	Dir *DirStorage
+
+	// Codec - compression of new blobs: zstd, gzip or none (compressed blobs are still readable)
+	Codec string
+
+	// FrameSize - size of uncompressed data compressed independently
+	FrameSize int64
+
+	// MinSize - blobs smaller than this are stored as is
+	MinSize int64
+
+	// ContentTypes - patterns of compressible content types, e.g. 'text/*'
+	ContentTypes []string
+}
+
+var _ Storage = &CompressedStorage{}
+
+// compressedIndex - contents of the index file of a compressed blob.
+type compressedIndex struct {
+	FrameSize int64 `json:"frameSize"`
+	Size      int64 `json:"size"`
+
+	// Frames - end offsets of compressed frames within the blob file
+	Frames []int64 `json:"frames"`
+}
+
+// Validate checks the settings.
+func (storage *CompressedStorage) Validate() (err error) {
+	if storage.Codec == CompressionNone {
+		return
+	}
+	if _, ok := compressionExts[storage.Codec]; !ok {
+		err = errors.Errorf("unsupported compression %+q", storage.Codec)
+		return
+	}
+	if storage.FrameSize <= 0 {
+		err = errors.Errorf("invalid frame size %d", storage.FrameSize)
+		return
+	}
+	return
+}
+
+func (storage *CompressedStorage) OpenRead(ctx context.Context, contentHash string, rng *utils.Range) (rc io.ReadCloser, err error) {
+	ctx, span := tracing.Start(ctx, "CompressedStorage.OpenRead", attribute.String("asset.content_hash", contentHash))
+	defer tracing.End(span, &err)
+
+	codec, path, err := storage.find(contentHash)
+	if err != nil {
+		return
+	}
+	if codec == "" {
+		return storage.Dir.OpenRead(ctx, contentHash, rng)
+	}
+
+	index, err := storage.readIndex(contentHash)
+	if err != nil {
+		return
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		err = errors.Wrapf(err, "open file %+q", path)
+		return
+	}
+
+	// frames covering the range
+	from, to := int64(0), index.Size
+	if rng != nil {
+		from, to = rng.From, rng.To
+	}
+	first, last := int64(0), int64(len(index.Frames))-1
+	if to > from {
+		first = from / index.FrameSize
+		last = (to - 1) / index.FrameSize
+	}
+	var offset, end int64
+	if first > 0 && first <= int64(len(index.Frames)) {
+		offset = index.Frames[first-1]
+	}
+	if last >= 0 && last < int64(len(index.Frames)) {
+		end = index.Frames[last]
+	}
+	utils.ContextLogger(ctx).Debug("open compressed blob", "path", path, "frames", last-first+1)
+
+	dr, err := newDecompressor(codec, io.NewSectionReader(f, offset, end-offset))
+	if err != nil {
+		_ = f.Close()
+		err = errors.Wrapf(err, "decompress file %+q", path)
+		return
+	}
+	rc = &compressedReader{Reader: dr, file: f}
+	if rng != nil {
+		rc = utils.NewRangeReader(rc, from-first*index.FrameSize, rng.Length())
+	}
+	return
+}
+
+func (storage *CompressedStorage) OpenEncoded(ctx context.Context, contentHash string) (rc io.ReadCloser, encoding string, size int64, err error) {
+	ctx, span := tracing.Start(ctx, "CompressedStorage.OpenEncoded", attribute.String("asset.content_hash", contentHash))
+	defer tracing.End(span, &err)
+
+	codec, path, err := storage.find(contentHash)
+	if err != nil || codec == "" {
+		return
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		err = errors.Wrapf(err, "open file %+q", path)
+		return
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		err = errors.Wrapf(err, "stat file %+q", path)
+		return
+	}
+	utils.ContextLogger(ctx).Debug("open encoded blob", "path", path)
+	rc, encoding, size = f, codec, fi.Size()
+	return
+}
+
+//goland:noinspection GoUnusedParameter
+func (storage *CompressedStorage) Encoding(ctx context.Context, contentHash string) (encoding string, err error) {
+	encoding, _, err = storage.find(contentHash)
+	return
+}
+
+func (storage *CompressedStorage) Write(ctx context.Context, r io.Reader, maxSize int64) (exists bool, contentHash string, size int64, err error) {
+	ctx, span := tracing.Start(ctx, "CompressedStorage.Write")
+	defer func() {
+		span.SetAttributes(
+			attribute.String("asset.content_hash", contentHash),
+			attribute.Int64("asset.size", size),
+			attribute.Bool("storage.exists", exists),
+		)
+		tracing.End(span, &err)
+	}()
+
+	tempPath, contentHash, size, err := storage.Dir.storeTemp(r, maxSize)
+	defer func() {
+		if tempPath != "" {
+			rmTempErr := os.Remove(tempPath)
+			if rmTempErr != nil && err == nil {
+				err = errors.Wrapf(rmTempErr, "remove temp file %+q", tempPath)
+				return
+			}
+		}
+	}()
+	if err != nil {
+		err = errors.Wrap(err, "store temporary")
+		return
+	}
+
+	exists, err = storage.Check(ctx, contentHash)
+	if err != nil || exists {
+		return
+	}
+
+	compressible := storage.Codec != CompressionNone && size >= storage.MinSize
+	if compressible {
+		compressible, err = storage.compressible(tempPath)
+		if err != nil {
+			return
+		}
+	}
+	if compressible {
+		var compressed bool
+		compressed, err = storage.storeCompressed(ctx, tempPath, contentHash, size)
+		if err != nil || compressed {
+			return
+		}
+	}
+
+	_, path, err := storage.Dir.dig(contentHash, true)
+	if err != nil {
+		err = errors.Wrapf(err, "prepare persistent storage for contentHash=%s", contentHash)
+		return
+	}
+	err = storage.Dir.moveTemp(tempPath, path)
+	if err != nil {
+		return
+	}
+	tempPath = ""
+	utils.ContextLogger(ctx).Debug("blob stored", "path", path, "size", size)
+	return
+}
+
+//goland:noinspection GoUnusedParameter
+func (storage *CompressedStorage) Check(ctx context.Context, contentHash string) (exists bool, err error) {
+	_, path, err := storage.find(contentHash)
+	exists = err == nil && path != ""
+	return
+}
+
+// Path returns path of the blob file (e.g. to hard-link it) if it is stored as is,
+// os.ErrNotExist if there is no such blob or it is compressed.
+func (storage *CompressedStorage) Path(contentHash string) (path string, err error) {
+	codec, path, err := storage.find(contentHash)
+	if err == nil && (path == "" || codec != "") {
+		path = ""
+		err = os.ErrNotExist
+	}
+	return
+}
+
+// Files returns paths of all files of the blob (the blob file first), empty if there is no such blob.
+func (storage *CompressedStorage) Files(contentHash string) (paths []string, err error) {
+	codec, path, err := storage.find(contentHash)
+	if err != nil || path == "" {
+		return
+	}
+	paths = []string{path}
+	if codec != "" {
+		var indexPath string
+		_, indexPath, err = storage.Dir.dig(contentHash+compressedIndexExt, false)
+		if err != nil {
+			return
+		}
+		paths = append(paths, indexPath)
+	}
+	return
+}
+
+var _ HealthChecker = &CompressedStorage{}
+
+func (storage *CompressedStorage) CheckHealth(ctx context.Context, minFreeSpace int64) (err error) {
+	return storage.Dir.CheckHealth(ctx, minFreeSpace)
+}
+
+// find looks for the blob file stored as is (codec is empty then) or compressed by any codec,
+// path is empty if there is no such blob.
+func (storage *CompressedStorage) find(contentHash string) (codec string, path string, err error) {
+	exists, path, err := storage.Dir.dig(contentHash, false)
+	if err != nil || exists {
+		return
+	}
+	for _, c := range []string{CompressionZstd, CompressionGzip} {
+		exists, path, err = storage.Dir.dig(contentHash+compressionExts[c], false)
+		if err != nil {
+			return
+		}
+		if exists {
+			codec = c
+			return
+		}
+	}
+	path = ""
+	return
+}
+
+// compressible sniffs content type of the file.
+func (storage *CompressedStorage) compressible(path string) (ok bool, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	head := make([]byte, 512)
+	n, err := io.ReadFull(f, head)
+	if err == io.ErrUnexpectedEOF {
+		err = nil
+	}
+	if err != nil {
+		err = errors.Wrapf(err, "read file %+q", path)
+		return
+	}
+	contentType, _, _ := mime.ParseMediaType(http.DetectContentType(head[:n]))
+	for _, pattern := range storage.ContentTypes {
+		if prefix := strings.TrimSuffix(pattern, "*"); prefix != pattern {
+			ok = strings.HasPrefix(contentType, prefix)
+		} else {
+			ok = contentType == pattern
+		}
+		if ok {
+			return
+		}
+	}
+	return
+}
+
+// storeCompressed compresses the temp file into the tree, compressed is false if it doesn't get smaller.
+func (storage *CompressedStorage) storeCompressed(ctx context.Context, tempPath string, contentHash string, size int64) (compressed bool, err error) {
+	src, err := os.Open(tempPath)
+	if err != nil {
+		return
+	}
+	defer src.Close()
+
+	dst, err := os.CreateTemp(storage.Dir.Dir, "asset")
+	if err != nil {
+		err = errors.Wrap(err, "create temp file for compressed asset")
+		return
+	}
+	compressedTempPath := dst.Name()
+	defer func() {
+		if compressedTempPath != "" {
+			_ = os.Remove(compressedTempPath)
+		}
+	}()
+
+	index, err := compressFrames(dst, src, storage.Codec, storage.FrameSize)
+	closeErr := dst.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		err = errors.Wrap(err, "compress asset")
+		return
+	}
+	index.Size = size
+	compressedSize := int64(0)
+	if len(index.Frames) > 0 {
+		compressedSize = index.Frames[len(index.Frames)-1]
+	}
+	if compressedSize >= size {
+		return
+	}
+
+	// the index is written first, so the blob file is never found without it
+	data, err := json.Marshal(index)
+	if err != nil {
+		return
+	}
+	_, indexPath, err := storage.Dir.dig(contentHash+compressedIndexExt, true)
+	if err != nil {
+		err = errors.Wrapf(err, "prepare persistent storage for contentHash=%s", contentHash)
+		return
+	}
+	err = os.WriteFile(indexPath, data, storage.Dir.FilePerm)
+	if err != nil {
+		err = errors.Wrapf(err, "write index file %+q", indexPath)
+		return
+	}
+
+	_, path, err := storage.Dir.dig(contentHash+compressionExts[storage.Codec], true)
+	if err != nil {
+		err = errors.Wrapf(err, "prepare persistent storage for contentHash=%s", contentHash)
+		return
+	}
+	err = storage.Dir.moveTemp(compressedTempPath, path)
+	if err != nil {
+		return
+	}
+	compressedTempPath = ""
+	compressed = true
+	utils.ContextLogger(ctx).Debug("blob stored compressed", "path", path, "size", size, "compressedSize", compressedSize)
+	return
+}
+
+func (storage *CompressedStorage) readIndex(contentHash string) (index *compressedIndex, err error) {
+	_, path, err := storage.Dir.dig(contentHash+compressedIndexExt, false)
+	if err != nil {
+		return
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		err = errors.Wrapf(err, "read index file %+q", path)
+		return
+	}
+	index = &compressedIndex{}
+	err = json.Unmarshal(data, index)
+	if err != nil {
+		err = errors.Wrapf(err, "decode index file %+q", path)
+		return
+	}
+	if index.FrameSize <= 0 {
+		err = errors.Errorf("invalid frame size in index file %+q", path)
+		return
+	}
+	return
+}
+
+// compressFrames writes src compressed by frames of frameSize, the index of written frames is returned.
+func compressFrames(dst io.Writer, src io.Reader, codec string, frameSize int64) (index *compressedIndex, err error) {
+	index = &compressedIndex{FrameSize: frameSize}
+	frame := make([]byte, frameSize)
+	buf := &bytes.Buffer{}
+	var zw *zstd.Encoder
+	var gw *gzip.Writer
+	switch codec {
+	case CompressionZstd:
+		zw, err = zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1))
+		if err != nil {
+			return
+		}
+		defer zw.Close()
+	case CompressionGzip:
+		gw = gzip.NewWriter(buf)
+	default:
+		err = errors.Errorf("unsupported compression %+q", codec)
+		return
+	}
+
+	offset := int64(0)
+	for {
+		var n int
+		n, err = io.ReadFull(src, frame)
+		if err == io.EOF {
+			err = nil
+			return
+		} else if err != nil && err != io.ErrUnexpectedEOF {
+			return
+		}
+		last := err == io.ErrUnexpectedEOF
+		err = nil
+
+		buf.Reset()
+		if zw != nil {
+			buf.Write(zw.EncodeAll(frame[:n], nil))
+		} else {
+			gw.Reset(buf)
+			_, err = gw.Write(frame[:n])
+			if err == nil {
+				err = gw.Close()
+			}
+			if err != nil {
+				return
+			}
+		}
+		_, err = dst.Write(buf.Bytes())
+		if err != nil {
+			return
+		}
+		offset += int64(buf.Len())
+		index.Frames = append(index.Frames, offset)
+		if last {
+			return
+		}
+	}
+}
+
+func newDecompressor(codec string, r io.Reader) (dr io.ReadCloser, err error) {
+	switch codec {
+	case CompressionZstd:
+		var zr *zstd.Decoder
+		zr, err = zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return
+		}
+		dr = zr.IOReadCloser()
+	case CompressionGzip:
+		dr, err = gzip.NewReader(r)
+	default:
+		err = errors.Errorf("unsupported compression %+q", codec)
+	}
+	return
+}
+
+// compressedReader closes both the decompressor and the blob file.
+type compressedReader struct {
+	io.Reader
+	file *os.File
+}
+
+func (cr *compressedReader) Close() (err error) {
+	if c, ok := cr.Reader.(io.Closer); ok {
+		err = c.Close()
+	}
+	closeErr := cr.file.Close()
+	if err == nil {
+		err = closeErr
+	}
+	return
+}
@@ -0,0 +1,130 @@
+package storage
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"math/rand"
+	"strings"
+	"testing"
+
+	"github.com/bbars/assets/utils"
+	"github.com/klauspost/compress/zstd"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCompressedStorage(t *testing.T) {
+	ctx := context.Background()
+	text := []byte(strings.Repeat("compressible text of the asset\n", 200))
+	binary := make([]byte, 5000)
+	rand.New(rand.NewSource(1)).Read(binary)
+
+	for _, codec := range []string{CompressionZstd, CompressionGzip} {
+		t.Run(codec, func(t *testing.T) {
+			dir := &DirStorage{Dir: t.TempDir(), PathDepth: 2, DirPerm: 0755, FilePerm: 0644}
+			cs := &CompressedStorage{
+				Dir:          dir,
+				Codec:        codec,
+				FrameSize:    1000,
+				MinSize:      100,
+				ContentTypes: DefaultCompressedContentTypes,
+			}
+			require.NoError(t, cs.Validate())
+
+			tests := []struct {
+				name        string
+				data        []byte
+				wantEncoded bool
+			}{
+				{name: "text", data: text, wantEncoded: true},
+				{name: "binary", data: binary},
+				{name: "small text", data: text[:50]},
+			}
+			for _, tt := range tests {
+				t.Run(tt.name, func(t *testing.T) {
+					exists, contentHash, size, err := cs.Write(ctx, bytes.NewReader(tt.data), 0)
+					require.NoError(t, err)
+					assert.False(t, exists)
+					assert.Equal(t, int64(len(tt.data)), size)
+
+					// the content hash is the one of uncompressed data
+					_, plainHash, _, err := (&DirStorage{Dir: t.TempDir(), DirPerm: 0755, FilePerm: 0644}).Write(ctx, bytes.NewReader(tt.data), 0)
+					require.NoError(t, err)
+					assert.Equal(t, plainHash, contentHash)
+
+					exists, _, _, err = cs.Write(ctx, bytes.NewReader(tt.data), 0)
+					require.NoError(t, err)
+					assert.True(t, exists)
+
+					rc, encoding, encodedSize, err := cs.OpenEncoded(ctx, contentHash)
+					require.NoError(t, err)
+					if !tt.wantEncoded {
+						assert.Nil(t, rc)
+						assert.Empty(t, encoding)
+					} else {
+						assert.Equal(t, codec, encoding)
+						assert.Less(t, encodedSize, size)
+						// the stored form is a valid stream of the codec
+						var dr io.Reader
+						if codec == CompressionZstd {
+							zr, err := zstd.NewReader(rc)
+							require.NoError(t, err)
+							defer zr.Close()
+							dr = zr
+						} else {
+							dr, err = gzip.NewReader(rc)
+							require.NoError(t, err)
+						}
+						decoded, err := io.ReadAll(dr)
+						require.NoError(t, err)
+						require.NoError(t, rc.Close())
+						assert.Equal(t, tt.data, decoded)
+					}
+
+					for _, rng := range []*utils.Range{
+						nil,
+						{From: 0, To: 10},
+						{From: 990, To: 1010},
+						{From: 1000, To: 2000},
+						{From: 2500, To: int64(len(tt.data))},
+						{From: int64(len(tt.data)) - 1, To: int64(len(tt.data))},
+					} {
+						if rng != nil && (rng.To > int64(len(tt.data)) || rng.From >= rng.To) {
+							continue
+						}
+						rc, err := cs.OpenRead(ctx, contentHash, rng)
+						require.NoError(t, err)
+						data, err := io.ReadAll(rc)
+						require.NoError(t, err)
+						require.NoError(t, rc.Close())
+						want := tt.data
+						if rng != nil {
+							want = tt.data[rng.From:rng.To]
+						}
+						assert.Equal(t, want, data, "range %v", rng)
+					}
+				})
+			}
+		})
+	}
+
+	t.Run("blobs of other codecs are readable", func(t *testing.T) {
+		dir := &DirStorage{Dir: t.TempDir(), PathDepth: 1, DirPerm: 0755, FilePerm: 0644}
+		gzipStorage := &CompressedStorage{Dir: dir, Codec: CompressionGzip, FrameSize: 1000, ContentTypes: []string{"text/*"}}
+		_, contentHash, _, err := gzipStorage.Write(ctx, bytes.NewReader(text), 0)
+		require.NoError(t, err)
+
+		zstdStorage := &CompressedStorage{Dir: dir, Codec: CompressionZstd, FrameSize: 1000, ContentTypes: []string{"text/*"}}
+		exists, err := zstdStorage.Check(ctx, contentHash)
+		require.NoError(t, err)
+		assert.True(t, exists)
+		rc, err := zstdStorage.OpenRead(ctx, contentHash, &utils.Range{From: 1500, To: 1600})
+		require.NoError(t, err)
+		data, err := io.ReadAll(rc)
+		require.NoError(t, err)
+		require.NoError(t, rc.Close())
+		assert.Equal(t, text[1500:1600], data)
+	})
+}
@@ -1,16 +1,20 @@
 package storage
 
 import (
+	"context"
 	"crypto/md5"
 	"crypto/sha1"
 	"fmt"
+	"hash"
 	"io"
 	"os"
 	"path/filepath"
 	"strings"
 
+	"github.com/bbars/assets/service/tracing"
 	"github.com/bbars/assets/utils"
 	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 const PathChunkLen = 2
@@ -25,7 +29,10 @@ type DirStorage struct {
 
 var _ Storage = &DirStorage{}
 
-func (storage *DirStorage) OpenRead(contentHash string, rng *utils.Range) (rc io.ReadCloser, err error) {
+func (storage *DirStorage) OpenRead(ctx context.Context, contentHash string, rng *utils.Range) (rc io.ReadCloser, err error) {
+	ctx, span := tracing.Start(ctx, "DirStorage.OpenRead", attribute.String("asset.content_hash", contentHash))
+	defer tracing.End(span, &err)
+
 	exists, path, err := storage.dig(contentHash, false)
 	if err != nil {
 		return
@@ -40,13 +47,24 @@ func (storage *DirStorage) OpenRead(contentHash string, rng *utils.Range) (rc io
 		err = errors.Wrapf(err, "open file %+q", path)
 		return
 	}
+	utils.ContextLogger(ctx).Debug("open blob", "path", path)
 	if rng != nil {
 		rc = utils.NewRangeReader(rc, rng.From, rng.Length())
 	}
 	return
 }
 
-func (storage *DirStorage) Write(r io.Reader, maxSize int64) (exists bool, contentHash string, size int64, err error) {
+func (storage *DirStorage) Write(ctx context.Context, r io.Reader, maxSize int64) (exists bool, contentHash string, size int64, err error) {
+	ctx, span := tracing.Start(ctx, "DirStorage.Write")
+	defer func() {
+		span.SetAttributes(
+			attribute.String("asset.content_hash", contentHash),
+			attribute.Int64("asset.size", size),
+			attribute.Bool("storage.exists", exists),
+		)
+		tracing.End(span, &err)
+	}()
+
 	tempPath, contentHash, size, err := storage.storeTemp(r, maxSize)
 	defer func() {
 		if tempPath != "" {
@@ -68,30 +86,107 @@ func (storage *DirStorage) Write(r io.Reader, maxSize int64) (exists bool, conte
 		return
 	}
 	if exists {
+		utils.ContextLogger(ctx).Debug("blob exists", "path", path, "size", size)
+		return
+	}
+
+	err = storage.moveTemp(tempPath, path)
+	if err != nil {
 		return
 	}
+	tempPath = ""
+	utils.ContextLogger(ctx).Debug("blob stored", "path", path, "size", size)
 
+	return
+}
+
+// moveTemp moves the temp file to the path within the tree.
+func (storage *DirStorage) moveTemp(tempPath string, path string) (err error) {
 	err = os.Rename(tempPath, path)
 	if err != nil {
 		err = errors.Wrapf(err, "move temp file %+q to %+q", tempPath, path)
 		return
 	}
-	tempPath = ""
 
 	err = os.Chmod(path, storage.FilePerm)
 	if err != nil {
 		err = errors.Wrapf(err, "chmod %#o on %+q", storage.FilePerm, path)
 		return
 	}
+	return
+}
 
+// Path returns path of the blob file (e.g. to hard-link it), os.ErrNotExist if there is no such blob.
+func (storage *DirStorage) Path(contentHash string) (path string, err error) {
+	exists, path, err := storage.dig(contentHash, false)
+	if err != nil {
+		return
+	}
+	if !exists {
+		path = ""
+		err = os.ErrNotExist
+		return
+	}
+	return
+}
+
+// Files returns paths of all files of the blob, empty if there is no such blob.
+func (storage *DirStorage) Files(contentHash string) (paths []string, err error) {
+	exists, path, err := storage.dig(contentHash, false)
+	if err != nil || !exists {
+		return
+	}
+	paths = []string{path}
 	return
 }
 
-func (storage *DirStorage) Check(contentHash string) (exists bool, err error) {
+//goland:noinspection GoUnusedParameter
+func (storage *DirStorage) Check(ctx context.Context, contentHash string) (exists bool, err error) {
 	exists, _, err = storage.dig(contentHash, false)
 	return
 }
 
+var _ HealthChecker = &DirStorage{}
+
+//goland:noinspection GoUnusedParameter
+func (storage *DirStorage) CheckHealth(ctx context.Context, minFreeSpace int64) (err error) {
+	fi, err := os.Stat(storage.Dir)
+	if err != nil {
+		err = errors.Wrapf(err, "stat root directory %+q", storage.Dir)
+		return
+	}
+	if !fi.IsDir() {
+		err = fmt.Errorf("file %+q is not a directory", storage.Dir)
+		return
+	}
+
+	f, err := os.CreateTemp(storage.Dir, "health")
+	if err != nil {
+		err = errors.Wrapf(err, "root directory %+q is not writable", storage.Dir)
+		return
+	}
+	_ = f.Close()
+	err = os.Remove(f.Name())
+	if err != nil {
+		err = errors.Wrapf(err, "remove temp file %+q", f.Name())
+		return
+	}
+
+	if minFreeSpace > 0 {
+		var free int64
+		free, err = freeSpace(storage.Dir)
+		if err != nil {
+			err = errors.Wrapf(err, "get free space of %+q", storage.Dir)
+			return
+		}
+		if free >= 0 && free < minFreeSpace {
+			err = errors.Errorf("free space %d is below threshold %d", free, minFreeSpace)
+			return
+		}
+	}
+	return
+}
+
 func (storage *DirStorage) dig(contentHash string, prepare bool) (exists bool, path string, err error) {
 	contentHashLen := len([]rune(contentHash))
 	if contentHashLen > 512 {
@@ -173,23 +268,14 @@ func (storage *DirStorage) storeTemp(r io.Reader, maxSize int64) (path string, c
 	}()
 	path = f.Name()
 
-	md5Calc := md5.New()
-	sha1Calc := sha1.New()
-
-	teeMd5 := io.TeeReader(r, md5Calc)
-	teeSha1 := io.TeeReader(teeMd5, sha1Calc)
-
-	_, err = streamCopy(f, teeSha1, maxSize)
+	hashes := newContentHashes()
+	_, err = streamCopy(f, io.TeeReader(r, hashes), maxSize)
 	if err != nil {
 		err = errors.Wrap(err, "reading asset data stream and calculating hashes")
 		return
 	}
 
-	contentHash = fmt.Sprintf(
-		"%x%x",
-		md5Calc.Sum(nil),
-		sha1Calc.Sum(nil),
-	)
+	contentHash = hashes.contentHash()
 
 	fi, err := f.Stat()
 	if err != nil {
@@ -201,6 +287,49 @@ func (storage *DirStorage) storeTemp(r io.Reader, maxSize int64) (path string, c
 	return
 }
 
+// contentHashes calculates content hash of data written to it.
+type contentHashes struct {
+	md5  hash.Hash
+	sha1 hash.Hash
+}
+
+func newContentHashes() *contentHashes {
+	return &contentHashes{
+		md5:  md5.New(),
+		sha1: sha1.New(),
+	}
+}
+
+func (h *contentHashes) Write(p []byte) (n int, err error) {
+	_, _ = h.md5.Write(p)
+	return h.sha1.Write(p)
+}
+
+func (h *contentHashes) contentHash() string {
+	return fmt.Sprintf(
+		"%x%x",
+		h.md5.Sum(nil),
+		h.sha1.Sum(nil),
+	)
+}
+
+// limitedReader fails with ErrTooLarge if more than maxSize bytes are read (0 means no limit).
+type limitedReader struct {
+	r       io.Reader
+	maxSize int64
+	read    int64
+}
+
+func (lr *limitedReader) Read(p []byte) (n int, err error) {
+	n, err = lr.r.Read(p)
+	lr.read += int64(n)
+	if lr.maxSize > 0 && lr.read > lr.maxSize {
+		err = errors.Wrapf(ErrTooLarge, "read size %d exceeds limit %d", lr.read, lr.maxSize)
+		return
+	}
+	return
+}
+
 // streamCopy is an adopted version of io.Copy
 func streamCopy(dst io.Writer, src io.Reader, maxSize int64) (written int64, err error) {
 	size := 32 * 1024
@@ -225,7 +354,7 @@ func streamCopy(dst io.Writer, src io.Reader, maxSize int64) (written int64, err
 				break
 			}
 			if maxSize > 0 && written > maxSize {
-				err = errors.Errorf("written size %d exceeds limit %d", written, maxSize)
+				err = errors.Wrapf(ErrTooLarge, "written size %d exceeds limit %d", written, maxSize)
 				break
 			}
 		}
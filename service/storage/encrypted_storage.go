@@ -0,0 +1,599 @@
+package storage
+
+import (
+	"context"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/bbars/assets/service/tracing"
+	"github.com/bbars/assets/utils"
+	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+const (
+	encryptedExt = ".enc"
+
+	// encryptedTrailerLenSize - size of the length of the key trailer at the end of the blob file
+	encryptedTrailerLenSize = 4
+)
+
+// EncryptedStorage keeps blobs of the directory storage encrypted by AES-256-GCM.
+// Content hash is the one of unencrypted data.
+//
+// Every blob is encrypted by its own random data key in chunks of ChunkSize sealed independently,
+// so a range is read by decrypting the chunks covering it only.
+// The data key is kept in a trailer of the blob file wrapped by a master key of the keyring along with its ID,
+// so the blob file is self-contained and it is placed once by the first writer of the content.
+// Rotation of master keys re-wraps data keys only (see Rekey).
+// Blobs stored before encryption was enabled are read from Plain storage.
+type EncryptedStorage struct {
+	Dir  *DirStorage
+	Keys *Keyring
+
+	// ChunkSize - size of unencrypted data sealed independently
+	ChunkSize int64
+
+	// Plain - storage of blobs stored unencrypted (read only, they are encrypted by Rekey)
+	Plain Storage
+}
+
+var _ Storage = &EncryptedStorage{}
+
+// encryptedKey - the key trailer of an encrypted blob.
+// The blob file consists of sealed chunks, JSON of the key and its length (4 bytes, big-endian).
+type encryptedKey struct {
+	// KeyId - ID of the master key wrapping the data key
+	KeyId string `json:"keyId"`
+
+	Nonce     []byte `json:"nonce"`
+	DataKey   []byte `json:"dataKey"`
+	ChunkSize int64  `json:"chunkSize"`
+	Size      int64  `json:"size"`
+}
+
+// additionalData binds the wrapped data key to the blob and its layout.
+func (key *encryptedKey) additionalData(contentHash string) []byte {
+	return []byte(fmt.Sprintf("%s:%d:%d", contentHash, key.ChunkSize, key.Size))
+}
+
+// sealedSize returns size of the sealed chunks of the blob.
+func (key *encryptedKey) sealedSize(overhead int) int64 {
+	chunks := (key.Size + key.ChunkSize - 1) / key.ChunkSize
+	return key.Size + chunks*int64(overhead)
+}
+
+// Validate checks the settings.
+func (storage *EncryptedStorage) Validate() (err error) {
+	if storage.Keys == nil {
+		err = errors.New("keyring is not set")
+		return
+	}
+	if storage.ChunkSize <= 0 {
+		err = errors.Errorf("invalid chunk size %d", storage.ChunkSize)
+		return
+	}
+	return
+}
+
+func (storage *EncryptedStorage) OpenRead(ctx context.Context, contentHash string, rng *utils.Range) (rc io.ReadCloser, err error) {
+	ctx, span := tracing.Start(ctx, "EncryptedStorage.OpenRead", attribute.String("asset.content_hash", contentHash))
+	defer tracing.End(span, &err)
+
+	exists, path, err := storage.Dir.dig(contentHash+encryptedExt, false)
+	if err != nil {
+		return
+	}
+	if !exists {
+		if storage.Plain == nil {
+			err = os.ErrNotExist
+			return
+		}
+		return storage.Plain.OpenRead(ctx, contentHash, rng)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		err = errors.Wrapf(err, "open file %+q", path)
+		return
+	}
+	key, dataKey, err := storage.readKey(f, contentHash)
+	if err != nil {
+		_ = f.Close()
+		return
+	}
+	aead, err := newAead(dataKey)
+	if err != nil {
+		_ = f.Close()
+		return
+	}
+	from := int64(0)
+	if rng != nil {
+		from = rng.From
+	}
+	first := from / key.ChunkSize
+	utils.ContextLogger(ctx).Debug("open encrypted blob", "path", path, "keyId", key.KeyId)
+
+	rc = &decryptReader{
+		file:      f,
+		aead:      aead,
+		chunkSize: key.ChunkSize,
+		size:      key.Size,
+		next:      first,
+	}
+	if rng != nil {
+		rc = utils.NewRangeReader(rc, from-first*key.ChunkSize, rng.Length())
+	}
+	return
+}
+
+func (storage *EncryptedStorage) Write(ctx context.Context, r io.Reader, maxSize int64) (exists bool, contentHash string, size int64, err error) {
+	ctx, span := tracing.Start(ctx, "EncryptedStorage.Write")
+	defer func() {
+		span.SetAttributes(
+			attribute.String("asset.content_hash", contentHash),
+			attribute.Int64("asset.size", size),
+			attribute.Bool("storage.exists", exists),
+		)
+		tracing.End(span, &err)
+	}()
+
+	// data is encrypted while it is read, so it never reaches the disk unencrypted
+	tempPath, contentHash, size, err := storage.storeEncryptedTemp(r, maxSize)
+	defer func() {
+		if tempPath == "" {
+			return
+		}
+		rmTempErr := os.Remove(tempPath)
+		if rmTempErr != nil && err == nil {
+			err = errors.Wrapf(rmTempErr, "remove temp file %+q", tempPath)
+			return
+		}
+	}()
+	if err != nil {
+		err = errors.Wrap(err, "store temporary")
+		return
+	}
+
+	exists, err = storage.Check(ctx, contentHash)
+	if err != nil || exists {
+		return
+	}
+
+	exists, err = storage.placeEncryptedTemp(ctx, tempPath, contentHash, size)
+	return
+}
+
+func (storage *EncryptedStorage) Check(ctx context.Context, contentHash string) (exists bool, err error) {
+	exists, _, err = storage.Dir.dig(contentHash+encryptedExt, false)
+	if err != nil || exists || storage.Plain == nil {
+		return
+	}
+	return storage.Plain.Check(ctx, contentHash)
+}
+
+// Path returns path of the blob file (e.g. to hard-link it) if it is stored unencrypted,
+// os.ErrNotExist if there is no such blob or it is encrypted.
+func (storage *EncryptedStorage) Path(contentHash string) (path string, err error) {
+	exists, _, err := storage.Dir.dig(contentHash+encryptedExt, false)
+	if err != nil {
+		return
+	}
+	plain, ok := storage.Plain.(interface {
+		Path(contentHash string) (path string, err error)
+	})
+	if exists || !ok {
+		err = os.ErrNotExist
+		return
+	}
+	return plain.Path(contentHash)
+}
+
+// Files returns paths of all files of the blob (the blob file first), empty if there is no such blob.
+func (storage *EncryptedStorage) Files(contentHash string) (paths []string, err error) {
+	exists, path, err := storage.Dir.dig(contentHash+encryptedExt, false)
+	if err != nil {
+		return
+	}
+	if exists {
+		paths = []string{path}
+		return
+	}
+	if plain, ok := storage.Plain.(interface {
+		Files(contentHash string) (paths []string, err error)
+	}); ok {
+		return plain.Files(contentHash)
+	}
+	return
+}
+
+var _ HealthChecker = &EncryptedStorage{}
+
+func (storage *EncryptedStorage) CheckHealth(ctx context.Context, minFreeSpace int64) (err error) {
+	return storage.Dir.CheckHealth(ctx, minFreeSpace)
+}
+
+// Rekey re-wraps the data key of the blob by the current master key,
+// the blob is encrypted if it is stored unencrypted. Changed is false if it is encrypted by the current key already.
+func (storage *EncryptedStorage) Rekey(ctx context.Context, contentHash string) (changed bool, err error) {
+	ctx, span := tracing.Start(ctx, "EncryptedStorage.Rekey", attribute.String("asset.content_hash", contentHash))
+	defer func() {
+		span.SetAttributes(attribute.Bool("storage.changed", changed))
+		tracing.End(span, &err)
+	}()
+
+	exists, path, err := storage.Dir.dig(contentHash+encryptedExt, false)
+	if err != nil {
+		return
+	}
+	if !exists {
+		err = storage.encryptPlain(ctx, contentHash)
+		changed = err == nil
+		return
+	}
+
+	// left by encryptPlain interrupted after the blob was encrypted
+	removed, err := storage.removePlain(ctx, contentHash)
+	if err != nil {
+		return
+	}
+	changed = removed
+
+	rekeyed, prevKeyId, err := storage.rewrapKey(path, contentHash)
+	if err != nil || !rekeyed {
+		return
+	}
+	changed = true
+	utils.ContextLogger(ctx).Debug("blob rekeyed", "contentHash", contentHash, "keyId", storage.Keys.Current, "prevKeyId", prevKeyId)
+	return
+}
+
+// rewrapKey replaces the key trailer of the blob file by the one wrapped by the current master key,
+// the sealed chunks are copied as is. Rekeyed is false if the data key is wrapped by the current key already.
+func (storage *EncryptedStorage) rewrapKey(path string, contentHash string) (rekeyed bool, prevKeyId string, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		err = errors.Wrapf(err, "open file %+q", path)
+		return
+	}
+	defer f.Close()
+	key, dataKey, err := storage.readKey(f, contentHash)
+	if err != nil {
+		return
+	}
+	prevKeyId = key.KeyId
+	if key.KeyId == storage.Keys.Current {
+		return
+	}
+	aead, err := newAead(dataKey)
+	if err != nil {
+		return
+	}
+
+	temp, err := os.CreateTemp(storage.Dir.Dir, "asset")
+	if err != nil {
+		err = errors.Wrap(err, "create temp file for rekeyed blob")
+		return
+	}
+	tempPath := temp.Name()
+	defer func() {
+		if tempPath != "" {
+			_ = os.Remove(tempPath)
+		}
+	}()
+	_, err = io.Copy(temp, io.NewSectionReader(f, 0, key.sealedSize(aead.Overhead())))
+	if err == nil {
+		err = storage.writeKey(temp, contentHash, dataKey, key.ChunkSize, key.Size)
+	}
+	closeErr := temp.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		err = errors.Wrapf(err, "rewrite blob %+q", path)
+		return
+	}
+	// the blob file is replaced atomically, it is the same data anyway
+	err = storage.Dir.moveTemp(tempPath, path)
+	if err != nil {
+		return
+	}
+	tempPath = ""
+	rekeyed = true
+	return
+}
+
+// encryptPlain encrypts the blob of Plain storage and removes its files.
+func (storage *EncryptedStorage) encryptPlain(ctx context.Context, contentHash string) (err error) {
+	if storage.Plain == nil {
+		err = os.ErrNotExist
+		return
+	}
+	rc, err := storage.Plain.OpenRead(ctx, contentHash, nil)
+	if err != nil {
+		return
+	}
+	tempPath, tempHash, size, err := storage.storeEncryptedTemp(rc, 0)
+	_ = rc.Close()
+	defer func() {
+		if tempPath != "" {
+			_ = os.Remove(tempPath)
+		}
+	}()
+	if err != nil {
+		err = errors.Wrap(err, "store temporary")
+		return
+	}
+	if tempHash != contentHash {
+		err = errors.Errorf("blob is corrupted, its content hash is %s", tempHash)
+		return
+	}
+
+	_, err = storage.placeEncryptedTemp(ctx, tempPath, contentHash, size)
+	if err != nil {
+		return
+	}
+	_, err = storage.removePlain(ctx, contentHash)
+	return
+}
+
+// removePlain removes files of the blob from Plain storage, removed is false if there are no such ones.
+func (storage *EncryptedStorage) removePlain(ctx context.Context, contentHash string) (removed bool, err error) {
+	plain, ok := storage.Plain.(interface {
+		Files(contentHash string) (paths []string, err error)
+	})
+	if !ok {
+		return
+	}
+	paths, err := plain.Files(contentHash)
+	if err != nil {
+		return
+	}
+	for _, path := range paths {
+		err = os.Remove(path)
+		if err != nil {
+			err = errors.Wrapf(err, "remove unencrypted file %+q", path)
+			return
+		}
+		removed = true
+		utils.ContextLogger(ctx).Debug("unencrypted blob file removed", "path", path)
+	}
+	return
+}
+
+// storeEncryptedTemp encrypts data into a temp file by a new data key calculating content hash of unencrypted data,
+// the key trailer is appended when the data is read completely.
+func (storage *EncryptedStorage) storeEncryptedTemp(r io.Reader, maxSize int64) (tempPath string, contentHash string, size int64, err error) {
+	dataKey := make([]byte, encryptionKeySize)
+	_, err = rand.Read(dataKey)
+	if err != nil {
+		err = errors.Wrap(err, "generate data key")
+		return
+	}
+	dataAead, err := newAead(dataKey)
+	if err != nil {
+		return
+	}
+
+	f, err := os.CreateTemp(storage.Dir.Dir, "asset")
+	if err != nil {
+		err = errors.Wrap(err, "create temp file for encrypted asset")
+		return
+	}
+	tempPath = f.Name()
+	hashes := newContentHashes()
+	src := &limitedReader{r: io.TeeReader(r, hashes), maxSize: maxSize}
+	err = encryptChunks(f, src, dataAead, storage.ChunkSize)
+	if err == nil {
+		contentHash = hashes.contentHash()
+		size = src.read
+		err = storage.writeKey(f, contentHash, dataKey, storage.ChunkSize, size)
+	}
+	closeErr := f.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		err = errors.Wrap(err, "reading asset data stream and encrypting it")
+		return
+	}
+	return
+}
+
+// placeEncryptedTemp places the encrypted temp file into the tree unless the blob exists already,
+// so concurrent writers of the same content never replace the placed blob. The temp file is left to the caller.
+func (storage *EncryptedStorage) placeEncryptedTemp(ctx context.Context, tempPath string, contentHash string, size int64) (exists bool, err error) {
+	_, path, err := storage.Dir.dig(contentHash+encryptedExt, true)
+	if err != nil {
+		err = errors.Wrapf(err, "prepare persistent storage for contentHash=%s", contentHash)
+		return
+	}
+	err = os.Chmod(tempPath, storage.Dir.FilePerm)
+	if err != nil {
+		err = errors.Wrapf(err, "chmod %#o on %+q", storage.Dir.FilePerm, tempPath)
+		return
+	}
+	// unlike renaming, linking fails if the path exists
+	err = os.Link(tempPath, path)
+	if os.IsExist(err) {
+		exists = true
+		err = nil
+		utils.ContextLogger(ctx).Debug("blob exists", "path", path, "size", size)
+		return
+	} else if err != nil {
+		err = errors.Wrapf(err, "link temp file %+q to %+q", tempPath, path)
+		return
+	}
+	utils.ContextLogger(ctx).Debug("blob stored encrypted", "path", path, "size", size, "keyId", storage.Keys.Current)
+	return
+}
+
+// readKey reads the key trailer of the blob file and unwraps its data key.
+func (storage *EncryptedStorage) readKey(f *os.File, contentHash string) (key *encryptedKey, dataKey []byte, err error) {
+	stat, err := f.Stat()
+	if err != nil {
+		err = errors.Wrapf(err, "stat file %+q", f.Name())
+		return
+	}
+	lenBuf := make([]byte, encryptedTrailerLenSize)
+	keyLen := int64(-1)
+	if stat.Size() >= encryptedTrailerLenSize {
+		_, err = f.ReadAt(lenBuf, stat.Size()-encryptedTrailerLenSize)
+		if err != nil {
+			err = errors.Wrapf(err, "read key length of %+q", f.Name())
+			return
+		}
+		keyLen = int64(binary.BigEndian.Uint32(lenBuf))
+	}
+	keyOffset := stat.Size() - encryptedTrailerLenSize - keyLen
+	if keyLen < 0 || keyOffset < 0 {
+		err = errors.Errorf("no key trailer in %+q", f.Name())
+		return
+	}
+	data := make([]byte, keyLen)
+	_, err = f.ReadAt(data, keyOffset)
+	if err != nil {
+		err = errors.Wrapf(err, "read key of %+q", f.Name())
+		return
+	}
+	key = &encryptedKey{}
+	err = json.Unmarshal(data, key)
+	if err != nil {
+		err = errors.Wrapf(err, "decode key of %+q", f.Name())
+		return
+	}
+	if key.ChunkSize <= 0 {
+		err = errors.Errorf("invalid chunk size in key of %+q", f.Name())
+		return
+	}
+	aead, err := storage.Keys.aead(key.KeyId)
+	if err != nil {
+		return
+	}
+	dataKey, err = aead.Open(nil, key.Nonce, key.DataKey, key.additionalData(contentHash))
+	if err != nil {
+		err = errors.Wrapf(err, "unwrap data key of %+q by key %+q", f.Name(), key.KeyId)
+		return
+	}
+	return
+}
+
+// writeKey wraps the data key by the current master key and writes the key trailer.
+func (storage *EncryptedStorage) writeKey(w io.Writer, contentHash string, dataKey []byte, chunkSize int64, size int64) (err error) {
+	aead, err := storage.Keys.aead(storage.Keys.Current)
+	if err != nil {
+		return
+	}
+	key := &encryptedKey{
+		KeyId:     storage.Keys.Current,
+		Nonce:     make([]byte, aead.NonceSize()),
+		ChunkSize: chunkSize,
+		Size:      size,
+	}
+	_, err = rand.Read(key.Nonce)
+	if err != nil {
+		err = errors.Wrap(err, "generate nonce")
+		return
+	}
+	key.DataKey = aead.Seal(nil, key.Nonce, dataKey, key.additionalData(contentHash))
+	data, err := json.Marshal(key)
+	if err != nil {
+		return
+	}
+	lenBuf := make([]byte, encryptedTrailerLenSize)
+	binary.BigEndian.PutUint32(lenBuf, uint32(len(data)))
+	_, err = w.Write(append(data, lenBuf...))
+	if err != nil {
+		err = errors.Wrap(err, "write key")
+		return
+	}
+	return
+}
+
+// chunkNonce - nonce of the chunk, data keys are unique per blob, so chunk index is enough.
+func chunkNonce(aead cipher.AEAD, index int64) []byte {
+	nonce := make([]byte, aead.NonceSize())
+	binary.BigEndian.PutUint64(nonce[len(nonce)-8:], uint64(index))
+	return nonce
+}
+
+func encryptChunks(dst io.Writer, src io.Reader, aead cipher.AEAD, chunkSize int64) (err error) {
+	chunk := make([]byte, chunkSize)
+	sealed := make([]byte, 0, chunkSize+int64(aead.Overhead()))
+	for index := int64(0); ; index++ {
+		var n int
+		n, err = io.ReadFull(src, chunk)
+		if err == io.EOF {
+			err = nil
+			return
+		} else if err != nil && err != io.ErrUnexpectedEOF {
+			return
+		}
+		last := err == io.ErrUnexpectedEOF
+		err = nil
+
+		sealed = aead.Seal(sealed[:0], chunkNonce(aead, index), chunk[:n], nil)
+		_, err = dst.Write(sealed)
+		if err != nil || last {
+			return
+		}
+	}
+}
+
+// decryptReader decrypts chunks of the blob file starting from the next one.
+type decryptReader struct {
+	file      *os.File
+	aead      cipher.AEAD
+	chunkSize int64
+	size      int64
+	next      int64
+	sealed    []byte
+	buf       []byte
+}
+
+func (dr *decryptReader) Read(p []byte) (n int, err error) {
+	if len(dr.buf) == 0 {
+		offset := dr.next * dr.chunkSize
+		if offset >= dr.size {
+			err = io.EOF
+			return
+		}
+		length := dr.size - offset
+		if length > dr.chunkSize {
+			length = dr.chunkSize
+		}
+		overhead := int64(dr.aead.Overhead())
+		if dr.sealed == nil {
+			dr.sealed = make([]byte, dr.chunkSize+overhead)
+		}
+		sealed := dr.sealed[:length+overhead]
+		var read int
+		read, err = dr.file.ReadAt(sealed, dr.next*(dr.chunkSize+overhead))
+		if read == len(sealed) {
+			err = nil
+		} else if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return
+		}
+		dr.buf, err = dr.aead.Open(sealed[:0], chunkNonce(dr.aead, dr.next), sealed, nil)
+		if err != nil {
+			err = errors.Wrapf(err, "decrypt chunk #%d", dr.next)
+			return
+		}
+		dr.next++
+	}
+	n = copy(p, dr.buf)
+	dr.buf = dr.buf[n:]
+	return
+}
+
+func (dr *decryptReader) Close() error {
+	return dr.file.Close()
+}
@@ -0,0 +1,287 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"io"
+	"io/fs"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/bbars/assets/utils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testKeyring(t *testing.T, current string, keyIds ...string) *Keyring {
+	keys := make([]string, 0, len(keyIds))
+	for _, keyId := range keyIds {
+		key := bytes.Repeat([]byte(keyId[:1]), encryptionKeySize)
+		keys = append(keys, `"`+keyId+`":"`+base64.StdEncoding.EncodeToString(key)+`"`)
+	}
+	keyring, err := ParseKeyring([]byte(`{"current":"` + current + `","keys":{` + strings.Join(keys, ",") + `}}`))
+	require.NoError(t, err)
+	return keyring
+}
+
+func TestParseKeyring(t *testing.T) {
+	key := base64.StdEncoding.EncodeToString(make([]byte, encryptionKeySize))
+	tests := []struct {
+		name    string
+		data    string
+		wantErr bool
+	}{
+		{name: "valid", data: `{"current":"k1","keys":{"k1":"` + key + `"}}`},
+		{name: "current is missing", data: `{"current":"k2","keys":{"k1":"` + key + `"}}`, wantErr: true},
+		{name: "short key", data: `{"current":"k1","keys":{"k1":"AAAA"}}`, wantErr: true},
+		{name: "not base64", data: `{"current":"k1","keys":{"k1":"?"}}`, wantErr: true},
+		{name: "not json", data: `current=k1`, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ParseKeyring([]byte(tt.data))
+			assert.Equal(t, tt.wantErr, err != nil, "err: %v", err)
+		})
+	}
+}
+
+func TestEncryptedStorage(t *testing.T) {
+	ctx := context.Background()
+	random := make([]byte, 5000)
+	rand.New(rand.NewSource(1)).Read(random)
+
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{name: "chunks", data: random},
+		{name: "exact chunks", data: random[:4000]},
+		{name: "single chunk", data: random[:10]},
+		{name: "empty", data: []byte{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := &DirStorage{Dir: t.TempDir(), PathDepth: 2, DirPerm: 0755, FilePerm: 0644}
+			es := &EncryptedStorage{Dir: dir, Keys: testKeyring(t, "a1", "a1"), ChunkSize: 1000}
+			require.NoError(t, es.Validate())
+
+			exists, contentHash, size, err := es.Write(ctx, bytes.NewReader(tt.data), 0)
+			require.NoError(t, err)
+			assert.False(t, exists)
+			assert.Equal(t, int64(len(tt.data)), size)
+
+			// the content hash is the one of unencrypted data
+			_, plainHash, _, err := (&DirStorage{Dir: t.TempDir(), DirPerm: 0755, FilePerm: 0644}).Write(ctx, bytes.NewReader(tt.data), 0)
+			require.NoError(t, err)
+			assert.Equal(t, plainHash, contentHash)
+
+			exists, _, _, err = es.Write(ctx, bytes.NewReader(tt.data), 0)
+			require.NoError(t, err)
+			assert.True(t, exists)
+
+			paths, err := es.Files(contentHash)
+			require.NoError(t, err)
+			require.Len(t, paths, 1, "the key is kept in the blob file")
+			stored, err := os.ReadFile(paths[0])
+			require.NoError(t, err)
+			if len(tt.data) > 0 {
+				assert.NotContains(t, string(stored), string(tt.data))
+			}
+			_, err = es.Path(contentHash)
+			assert.ErrorIs(t, err, os.ErrNotExist)
+
+			for _, rng := range []*utils.Range{
+				nil,
+				{From: 0, To: 10},
+				{From: 990, To: 1010},
+				{From: 1000, To: 2000},
+				{From: 2500, To: int64(len(tt.data))},
+				{From: int64(len(tt.data)) - 1, To: int64(len(tt.data))},
+			} {
+				if rng != nil && (rng.To > int64(len(tt.data)) || rng.From < 0 || rng.From >= rng.To) {
+					continue
+				}
+				rc, err := es.OpenRead(ctx, contentHash, rng)
+				require.NoError(t, err)
+				data, err := io.ReadAll(rc)
+				require.NoError(t, err)
+				require.NoError(t, rc.Close())
+				want := tt.data
+				if rng != nil {
+					want = tt.data[rng.From:rng.To]
+				}
+				assert.Equal(t, want, data, "range %v", rng)
+			}
+		})
+	}
+
+	t.Run("tampered blob", func(t *testing.T) {
+		dir := &DirStorage{Dir: t.TempDir(), PathDepth: 1, DirPerm: 0755, FilePerm: 0644}
+		es := &EncryptedStorage{Dir: dir, Keys: testKeyring(t, "a1", "a1"), ChunkSize: 1000}
+		_, contentHash, _, err := es.Write(ctx, bytes.NewReader(random), 0)
+		require.NoError(t, err)
+		paths, err := es.Files(contentHash)
+		require.NoError(t, err)
+		stored, err := os.ReadFile(paths[0])
+		require.NoError(t, err)
+		stored[1500] ^= 1
+		require.NoError(t, os.WriteFile(paths[0], stored, 0644))
+
+		rc, err := es.OpenRead(ctx, contentHash, &utils.Range{From: 0, To: 1000})
+		require.NoError(t, err)
+		_, err = io.ReadAll(rc)
+		assert.NoError(t, err, "chunks before the tampered one are readable")
+		require.NoError(t, rc.Close())
+
+		rc, err = es.OpenRead(ctx, contentHash, nil)
+		require.NoError(t, err)
+		_, err = io.ReadAll(rc)
+		assert.Error(t, err)
+		require.NoError(t, rc.Close())
+	})
+
+	t.Run("concurrent writes of the same content", func(t *testing.T) {
+		dir := &DirStorage{Dir: t.TempDir(), PathDepth: 1, DirPerm: 0755, FilePerm: 0644}
+		es := &EncryptedStorage{Dir: dir, Keys: testKeyring(t, "a1", "a1"), ChunkSize: 1000}
+		const writers = 8
+		start := make(chan struct{})
+		type result struct {
+			exists bool
+			err    error
+		}
+		results := make(chan result, writers)
+		for i := 0; i < writers; i++ {
+			go func() {
+				<-start
+				exists, _, _, err := es.Write(ctx, bytes.NewReader(random), 0)
+				results <- result{exists: exists, err: err}
+			}()
+		}
+		close(start)
+		placed := 0
+		for i := 0; i < writers; i++ {
+			res := <-results
+			require.NoError(t, res.err)
+			if !res.exists {
+				placed++
+			}
+		}
+		assert.Equal(t, 1, placed, "the blob is placed by the first writer only")
+
+		_, contentHash, _, err := (&DirStorage{Dir: t.TempDir(), DirPerm: 0755, FilePerm: 0644}).Write(ctx, bytes.NewReader(random), 0)
+		require.NoError(t, err)
+		rc, err := es.OpenRead(ctx, contentHash, nil)
+		require.NoError(t, err)
+		data, err := io.ReadAll(rc)
+		require.NoError(t, err)
+		require.NoError(t, rc.Close())
+		assert.Equal(t, random, data)
+
+		entries, err := os.ReadDir(dir.Dir)
+		require.NoError(t, err)
+		for _, entry := range entries {
+			assert.True(t, entry.IsDir(), "temp file %s of a loser is left", entry.Name())
+		}
+	})
+
+	t.Run("unencrypted data never reaches the disk", func(t *testing.T) {
+		dir := &DirStorage{Dir: t.TempDir(), PathDepth: 1, DirPerm: 0755, FilePerm: 0644}
+		es := &EncryptedStorage{Dir: dir, Keys: testKeyring(t, "a1", "a1"), ChunkSize: 1000}
+		secret := bytes.Repeat([]byte("personal data "), 500)
+		// files are checked when the data is read completely, before the blob is stored
+		r := io.MultiReader(bytes.NewReader(secret), readerFunc(func(p []byte) (int, error) {
+			assertNoFileContains(t, dir.Dir, secret[:100])
+			return 0, io.EOF
+		}))
+		_, _, _, err := es.Write(ctx, r, 0)
+		require.NoError(t, err)
+		assertNoFileContains(t, dir.Dir, secret[:100])
+
+		_, _, _, err = es.Write(ctx, bytes.NewReader(random), 100)
+		assert.ErrorIs(t, err, ErrTooLarge)
+	})
+
+	t.Run("rekey removes unencrypted leftovers", func(t *testing.T) {
+		dir := &DirStorage{Dir: t.TempDir(), PathDepth: 1, DirPerm: 0755, FilePerm: 0644}
+		_, contentHash, _, err := dir.Write(ctx, bytes.NewReader(random), 0)
+		require.NoError(t, err)
+		// as if encryption of the plain blob was interrupted before its removal
+		es := &EncryptedStorage{Dir: dir, Keys: testKeyring(t, "a1", "a1"), ChunkSize: 1000}
+		_, _, _, err = es.Write(ctx, bytes.NewReader(random), 0)
+		require.NoError(t, err)
+		es.Plain = dir
+
+		changed, err := es.Rekey(ctx, contentHash)
+		require.NoError(t, err)
+		assert.True(t, changed)
+		_, err = dir.Path(contentHash)
+		assert.ErrorIs(t, err, os.ErrNotExist)
+		changed, err = es.Rekey(ctx, contentHash)
+		require.NoError(t, err)
+		assert.False(t, changed)
+	})
+
+	t.Run("rekey", func(t *testing.T) {
+		dir := &DirStorage{Dir: t.TempDir(), PathDepth: 1, DirPerm: 0755, FilePerm: 0644}
+		plain := &CompressedStorage{Dir: dir, Codec: CompressionNone}
+		_, plainHash, _, err := plain.Write(ctx, bytes.NewReader(random[:3000]), 0)
+		require.NoError(t, err)
+
+		es := &EncryptedStorage{Dir: dir, Keys: testKeyring(t, "a1", "a1"), ChunkSize: 1000, Plain: plain}
+		_, encryptedHash, _, err := es.Write(ctx, bytes.NewReader(random), 0)
+		require.NoError(t, err)
+
+		// keys are rotated, blobs encrypted by the old one are readable
+		es.Keys = testKeyring(t, "b2", "a1", "b2")
+		for _, contentHash := range []string{plainHash, encryptedHash} {
+			changed, err := es.Rekey(ctx, contentHash)
+			require.NoError(t, err)
+			assert.True(t, changed)
+			changed, err = es.Rekey(ctx, contentHash)
+			require.NoError(t, err)
+			assert.False(t, changed)
+		}
+		_, err = plain.Path(plainHash)
+		assert.ErrorIs(t, err, os.ErrNotExist, "unencrypted blob is removed")
+
+		// the old key is not needed anymore
+		es.Keys = testKeyring(t, "b2", "b2")
+		for contentHash, want := range map[string][]byte{plainHash: random[:3000], encryptedHash: random} {
+			rc, err := es.OpenRead(ctx, contentHash, nil)
+			require.NoError(t, err)
+			data, err := io.ReadAll(rc)
+			require.NoError(t, err)
+			require.NoError(t, rc.Close())
+			assert.Equal(t, want, data)
+		}
+
+		es.Keys = testKeyring(t, "a1", "a1")
+		_, err = es.OpenRead(ctx, encryptedHash, nil)
+		assert.Error(t, err)
+	})
+}
+
+type readerFunc func(p []byte) (int, error)
+
+func (f readerFunc) Read(p []byte) (int, error) {
+	return f(p)
+}
+
+func assertNoFileContains(t *testing.T, dir string, data []byte) {
+	err := filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			return err
+		}
+		contents, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		assert.False(t, bytes.Contains(contents, data), "file %s contains unencrypted data", path)
+		return nil
+	})
+	require.NoError(t, err)
+}
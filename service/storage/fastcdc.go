@@ -0,0 +1,116 @@
+package storage
+
+import (
+	"io"
+	"math/bits"
+)
+
+// gearTable - random values of bytes for the gear rolling hash, generated by splitmix64 from a fixed seed,
+// so chunk boundaries (and therefore stored chunks) are stable across versions.
+var gearTable = func() (table [256]uint64) {
+	seed := uint64(0x61737365747363dc)
+	for i := range table {
+		seed += 0x9e3779b97f4a7c15
+		z := seed
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		table[i] = z ^ (z >> 31)
+	}
+	return
+}()
+
+// chunker splits a stream into content-defined chunks by FastCDC with normalized chunking:
+// a boundary is harder to find before the average size and easier after it,
+// so chunk sizes concentrate around the average one.
+// A boundary depends on the preceding 64 bytes only, so an insertion changes the chunks around it only.
+type chunker struct {
+	r       io.Reader
+	minSize int
+	avgSize int
+	maxSize int
+	maskS   uint64
+	maskL   uint64
+
+	buf   []byte
+	start int
+	end   int
+	eof   bool
+}
+
+func newChunker(r io.Reader, minSize int, avgSize int, maxSize int) *chunker {
+	avgBits := bits.Len(uint(avgSize)) - 1
+	return &chunker{
+		r:       r,
+		minSize: minSize,
+		avgSize: avgSize,
+		maxSize: maxSize,
+		maskS:   highBitsMask(avgBits + 1),
+		maskL:   highBitsMask(avgBits - 1),
+		buf:     make([]byte, maxSize),
+	}
+}
+
+// highBitsMask - mask of n high bits, since high bits of the gear hash depend on more preceding bytes than low ones.
+func highBitsMask(n int) uint64 {
+	if n <= 0 {
+		return 0
+	}
+	return ^uint64(0) << (64 - n)
+}
+
+// Next returns the next chunk, it is valid until the following call only.
+// io.EOF is returned after the last chunk.
+func (c *chunker) Next() (chunk []byte, err error) {
+	if c.end-c.start < c.maxSize && !c.eof {
+		c.end = copy(c.buf, c.buf[c.start:c.end])
+		c.start = 0
+		var n int
+		n, err = io.ReadFull(c.r, c.buf[c.end:])
+		c.end += n
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			c.eof = true
+			err = nil
+		} else if err != nil {
+			return
+		}
+	}
+	if c.start == c.end {
+		err = io.EOF
+		return
+	}
+	n := c.cut(c.buf[c.start:c.end])
+	chunk = c.buf[c.start : c.start+n]
+	c.start += n
+	return
+}
+
+// cut returns length of the chunk at the beginning of data.
+func (c *chunker) cut(data []byte) int {
+	n := len(data)
+	if n <= c.minSize {
+		return n
+	}
+	if n > c.maxSize {
+		n = c.maxSize
+	}
+	normal := c.avgSize
+	if normal > n {
+		normal = n
+	}
+
+	fp := uint64(0)
+	i := c.minSize
+	for ; i < normal; i++ {
+		fp = (fp << 1) + gearTable[data[i]]
+		if fp&c.maskS == 0 {
+			return i + 1
+		}
+	}
+	for ; i < n; i++ {
+		fp = (fp << 1) + gearTable[data[i]]
+		if fp&c.maskL == 0 {
+			return i + 1
+		}
+	}
+	return n
+}
@@ -0,0 +1,8 @@
+//go:build !linux && !darwin && !freebsd
+
+package storage
+
+// freeSpace is not supported on this platform, so it always reports unknown (-1) free space.
+func freeSpace(_ string) (free int64, err error) {
+	return -1, nil
+}
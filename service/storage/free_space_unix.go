@@ -0,0 +1,18 @@
+//go:build linux || darwin || freebsd
+
+package storage
+
+import (
+	"syscall"
+)
+
+// freeSpace returns number of bytes available to unprivileged user on the filesystem containing dir.
+func freeSpace(dir string) (free int64, err error) {
+	var st syscall.Statfs_t
+	err = syscall.Statfs(dir, &st)
+	if err != nil {
+		return
+	}
+	free = int64(st.Bavail) * int64(st.Bsize)
+	return
+}
@@ -0,0 +1,92 @@
+package storage
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/base64"
+	"encoding/json"
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+const encryptionKeySize = 32 // AES-256
+
+// Keyring - master keys wrapping data keys of encrypted blobs.
+type Keyring struct {
+	// Current - ID of the key new blobs are encrypted with
+	Current string `json:"current"`
+
+	// Keys - base64-encoded 32-byte keys by ID, old ones are kept to read blobs encrypted before rotation
+	Keys map[string]string `json:"keys"`
+
+	aeads map[string]cipher.AEAD
+}
+
+func LoadKeyring(name string) (keyring *Keyring, err error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		err = errors.Wrap(err, "read keyfile")
+		return
+	}
+	keyring, err = ParseKeyring(data)
+	if err != nil {
+		err = errors.Wrapf(err, "parse keyfile %+q", name)
+		return
+	}
+	return
+}
+
+func ParseKeyring(data []byte) (keyring *Keyring, err error) {
+	keyring = &Keyring{}
+	err = json.Unmarshal(data, keyring)
+	if err != nil {
+		return
+	}
+	keyring.aeads = make(map[string]cipher.AEAD, len(keyring.Keys))
+	for keyId, encoded := range keyring.Keys {
+		if keyId == "" {
+			err = errors.New("empty key ID")
+			return
+		}
+		var key []byte
+		key, err = base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			err = errors.Wrapf(err, "decode key %+q", keyId)
+			return
+		}
+		keyring.aeads[keyId], err = newAead(key)
+		if err != nil {
+			err = errors.Wrapf(err, "key %+q", keyId)
+			return
+		}
+	}
+	if _, ok := keyring.aeads[keyring.Current]; !ok {
+		err = errors.Errorf("current key %+q is not found", keyring.Current)
+		return
+	}
+	return
+}
+
+// aead returns cipher of the key, error if there is no such key.
+func (keyring *Keyring) aead(keyId string) (aead cipher.AEAD, err error) {
+	aead, ok := keyring.aeads[keyId]
+	if !ok {
+		err = errors.Errorf("key %+q is not found in the keyring", keyId)
+		return
+	}
+	return
+}
+
+func newAead(key []byte) (aead cipher.AEAD, err error) {
+	if len(key) != encryptionKeySize {
+		err = errors.Errorf("key must be %d bytes long, got %d", encryptionKeySize, len(key))
+		return
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return
+	}
+	aead, err = cipher.NewGCM(block)
+	return
+}
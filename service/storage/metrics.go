@@ -0,0 +1,27 @@
+package storage
+
+import (
+	"github.com/bbars/assets/service/metrics"
+)
+
+var (
+	metricChunkWrites = metrics.NewCounter(
+		"assets_storage_chunk_writes_total",
+		"Chunks written to chunked storage by result (new or dedup when the chunk already existed).",
+		"result",
+	)
+	metricChunkBytes = metrics.NewCounter(
+		"assets_storage_chunk_bytes_total",
+		"Bytes of chunks written to chunked storage by result (new or dedup).",
+		"result",
+	)
+)
+
+func observeChunkWrite(created bool, size int) {
+	result := "dedup"
+	if created {
+		result = "new"
+	}
+	metricChunkWrites.Inc(result)
+	metricChunkBytes.Add(float64(size), result)
+}
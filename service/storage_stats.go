@@ -0,0 +1,28 @@
+package service
+
+import (
+	"context"
+
+	"github.com/bbars/assets/service/storage"
+	"github.com/bbars/assets/service/tracing"
+	"github.com/pkg/errors"
+)
+
+// StorageStats returns usage and deduplication ratio of the storage (see storage.ChunkedStorage.Stats).
+func (a *Assets) StorageStats(ctx context.Context) (stats *storage.ChunkStats, err error) {
+	ctx, span := tracing.Start(ctx, "Assets.StorageStats")
+	defer tracing.End(span, &err)
+	defer RecoverService(ctx, &err)
+
+	reporter, ok := a.Storage.(storage.StatsReporter)
+	if !ok {
+		err = errors.New("storage does not support stats")
+		return
+	}
+	stats, err = reporter.Stats(ctx)
+	if err != nil {
+		err = errors.Wrap(err, "collect storage stats")
+		return
+	}
+	return
+}
@@ -0,0 +1,126 @@
+package tracing
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"os"
+
+	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.17.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	InstrumentationName = "github.com/bbars/assets"
+
+	ExporterNone   = "none"
+	ExporterStdout = "stdout"
+	ExporterOtlp   = "otlp"
+)
+
+// Start creates a span using the global tracer provider.
+func Start(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return otel.Tracer(InstrumentationName).Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// StartClient creates a span of an outgoing request.
+func StartClient(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return otel.Tracer(InstrumentationName).Start(ctx, name, trace.WithAttributes(attrs...), trace.WithSpanKind(trace.SpanKindClient))
+}
+
+// StartServer creates a span of an incoming request continuing the trace propagated via the header.
+func StartServer(ctx context.Context, header http.Header, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	ctx = otel.GetTextMapPropagator().Extract(ctx, propagation.HeaderCarrier(header))
+	return otel.Tracer(InstrumentationName).Start(ctx, name, trace.WithAttributes(attrs...), trace.WithSpanKind(trace.SpanKindServer))
+}
+
+// Inject propagates the trace context of ctx into the header of an outgoing request.
+func Inject(ctx context.Context, header http.Header) {
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(header))
+}
+
+// End records the error (if any) to the span and ends it. Designed to be deferred:
+//
+//	ctx, span := tracing.Start(ctx, "name")
+//	defer tracing.End(span, &err)
+func End(span trace.Span, err *error) {
+	if err != nil && *err != nil {
+		span.RecordError(*err)
+		span.SetStatus(codes.Error, (*err).Error())
+	}
+	span.End()
+}
+
+// Init sets up the global tracer provider and propagator.
+// The stdout exporter writes spans to the file (or stdout if file is empty),
+// the otlp exporter is configured with standard OTEL_EXPORTER_OTLP_* environment variables.
+func Init(ctx context.Context, exporter string, file string, serviceName string) (shutdown func(ctx context.Context) error, err error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{},
+		propagation.Baggage{},
+	))
+
+	var spanExporter sdktrace.SpanExporter
+	var closer io.Closer
+	switch exporter {
+	case "", ExporterNone:
+		shutdown = func(ctx context.Context) error { return nil }
+		return
+	case ExporterStdout:
+		var out io.Writer = os.Stdout
+		if file != "" {
+			var f *os.File
+			f, err = os.OpenFile(file, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+			if err != nil {
+				err = errors.Wrapf(err, "open trace file %+q", file)
+				return
+			}
+			out = f
+			closer = f
+		}
+		spanExporter, err = stdouttrace.New(stdouttrace.WithWriter(out))
+	case ExporterOtlp:
+		spanExporter, err = otlptracehttp.New(ctx)
+	default:
+		err = errors.Errorf("unknown trace exporter %+q", exporter)
+	}
+	if err != nil {
+		err = errors.Wrapf(err, "create %s trace exporter", exporter)
+		return
+	}
+
+	tp := NewProvider(spanExporter, serviceName)
+	otel.SetTracerProvider(tp)
+
+	shutdown = func(ctx context.Context) (err error) {
+		err = tp.Shutdown(ctx)
+		if closer != nil {
+			closeErr := closer.Close()
+			if closeErr != nil && err == nil {
+				err = closeErr
+			}
+		}
+		return
+	}
+	return
+}
+
+// NewProvider creates a tracer provider batching spans to the exporter.
+func NewProvider(spanExporter sdktrace.SpanExporter, serviceName string) *sdktrace.TracerProvider {
+	return sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(spanExporter),
+		sdktrace.WithResource(resource.NewWithAttributes(
+			semconv.SchemaURL,
+			semconv.ServiceName(serviceName),
+		)),
+	)
+}
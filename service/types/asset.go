@@ -64,6 +64,12 @@ type Asset struct {
 
 	// Error - message describing an error occurred while processing the asset
 	Error string `json:"error" db:"error"`
+
+	// Progress - state of the fetch while the asset is processing (not stored)
+	Progress *FetchProgress `json:"progress,omitempty" db:"-"`
+
+	// Dedup - the contents already existed in the storage when the asset was stored (not stored)
+	Dedup bool `json:"-" db:"-"`
 }
 
 func (a *Asset) GenerateAssetKey() {
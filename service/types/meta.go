@@ -0,0 +1,14 @@
+package types
+
+// AssetMeta - mutable part of the asset metadata.
+// Nil fields are left unchanged on update.
+type AssetMeta struct {
+	// ContentType - http-style content-type (mime + additional info)
+	ContentType *string `json:"contentType"`
+
+	// OriginalName - original asset name (e.g. file name)
+	OriginalName *string `json:"originalName"`
+
+	// Info - arbitrary short information: meta, description, etc
+	Info *string `json:"info"`
+}
@@ -0,0 +1,18 @@
+package types
+
+// FetchProgress - state of an in-flight fetch by original URL
+type FetchProgress struct {
+	// Received - bytes of the remote object received so far
+	Received int64 `json:"received"`
+
+	// Total - size of the remote object (-1 if unknown)
+	Total int64 `json:"total"`
+}
+
+// GetReceived is nil-safe getter of Received.
+func (p *FetchProgress) GetReceived() int64 {
+	if p == nil {
+		return -1
+	}
+	return p.Received
+}
@@ -0,0 +1,29 @@
+package types
+
+import (
+	"time"
+)
+
+type Usage struct {
+	// UserId - owner user identifier
+	UserId string `json:"userId" db:"user_id"`
+
+	// Size - total size of distinct blobs owned by the user
+	Size int64 `json:"size" db:"size"`
+
+	// Count - number of assets owned by the user
+	Count int64 `json:"count" db:"count"`
+
+	// MaxSize - size quota of the user (nil means default quota, 0 means no limit)
+	MaxSize *int64 `json:"maxSize" db:"max_size"`
+
+	// MaxCount - asset count quota of the user (nil means default quota, 0 means no limit)
+	MaxCount *int64 `json:"maxCount" db:"max_count"`
+
+	// Mtime - modify time
+	Mtime *time.Time `json:"mtime" db:"mtime"`
+}
+
+func (u *Usage) TableName() string {
+	return "user_usage"
+}
@@ -0,0 +1,47 @@
+package utils
+
+import (
+	"context"
+	"time"
+)
+
+// ContextDetach returns a context keeping values of the parent but ignoring its cancellation and deadline.
+func ContextDetach(parent context.Context) context.Context {
+	return detachedContext{parent: parent}
+}
+
+type detachedContext struct {
+	parent context.Context
+}
+
+var _ context.Context = detachedContext{}
+
+func (detachedContext) Deadline() (deadline time.Time, ok bool) {
+	return
+}
+
+func (detachedContext) Done() <-chan struct{} {
+	return nil
+}
+
+func (detachedContext) Err() error {
+	return nil
+}
+
+func (dc detachedContext) Value(key any) any {
+	return dc.parent.Value(key)
+}
+
+// ContextRebase returns a context keeping values of the parent but cancelled along with base instead of the parent.
+func ContextRebase(parent context.Context, base context.Context) context.Context {
+	return rebasedContext{Context: base, parent: parent}
+}
+
+type rebasedContext struct {
+	context.Context
+	parent context.Context
+}
+
+func (rc rebasedContext) Value(key any) any {
+	return rc.parent.Value(key)
+}
@@ -0,0 +1,31 @@
+package utils
+
+import (
+	"context"
+	"os"
+)
+
+const ContextLoggerKey = "logger"
+
+var defaultLogger = NewLogger(os.Stderr, LogFormatLogfmt, LogLevelInfo)
+
+func ContextSetLogger(parent context.Context, logger *Logger) context.Context {
+	return context.WithValue(
+		parent,
+		ContextLoggerKey,
+		logger,
+	)
+}
+
+// ContextLogger returns logger of the context or default one writing logfmt to stderr.
+func ContextLogger(ctx context.Context) *Logger {
+	if logger, ok := ctx.Value(ContextLoggerKey).(*Logger); ok && logger != nil {
+		return logger
+	}
+	return defaultLogger
+}
+
+// ContextWithLogFields returns a context with the logger adding the fields to every record.
+func ContextWithLogFields(parent context.Context, kv ...any) context.Context {
+	return ContextSetLogger(parent, ContextLogger(parent).With(kv...))
+}
@@ -0,0 +1,191 @@
+package utils
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+type LogLevel int
+
+const (
+	LogLevelDebug LogLevel = iota
+	LogLevelInfo
+	LogLevelWarn
+	LogLevelError
+)
+
+var logLevelNames = map[LogLevel]string{
+	LogLevelDebug: "debug",
+	LogLevelInfo:  "info",
+	LogLevelWarn:  "warn",
+	LogLevelError: "error",
+}
+
+func (l LogLevel) String() string {
+	if name, ok := logLevelNames[l]; ok {
+		return name
+	}
+	return strconv.Itoa(int(l))
+}
+
+func ParseLogLevel(s string) (level LogLevel, err error) {
+	for level, name := range logLevelNames {
+		if strings.EqualFold(s, name) {
+			return level, nil
+		}
+	}
+	err = errors.Errorf("unknown log level %+q", s)
+	return
+}
+
+type LogFormat string
+
+const (
+	LogFormatLogfmt = LogFormat("logfmt")
+	LogFormatJson   = LogFormat("json")
+)
+
+func ParseLogFormat(s string) (format LogFormat, err error) {
+	switch format = LogFormat(strings.ToLower(s)); format {
+	case LogFormatLogfmt, LogFormatJson:
+	default:
+		err = errors.Errorf("unknown log format %+q", s)
+	}
+	return
+}
+
+// Logger writes leveled structured records, one per line.
+// Fields are passed as alternating keys and values.
+type Logger struct {
+	out    io.Writer
+	mu     *sync.Mutex
+	format LogFormat
+	level  LogLevel
+	fields []any
+}
+
+func NewLogger(out io.Writer, format LogFormat, level LogLevel) *Logger {
+	return &Logger{
+		out:    out,
+		mu:     &sync.Mutex{},
+		format: format,
+		level:  level,
+	}
+}
+
+// With returns a logger adding the fields to every record.
+func (l *Logger) With(kv ...any) *Logger {
+	child := *l
+	child.fields = make([]any, 0, len(l.fields)+len(kv))
+	child.fields = append(child.fields, l.fields...)
+	child.fields = append(child.fields, kv...)
+	return &child
+}
+
+func (l *Logger) Enabled(level LogLevel) bool {
+	return level >= l.level
+}
+
+func (l *Logger) Debug(msg string, kv ...any) {
+	l.Log(LogLevelDebug, msg, kv...)
+}
+
+func (l *Logger) Info(msg string, kv ...any) {
+	l.Log(LogLevelInfo, msg, kv...)
+}
+
+func (l *Logger) Warn(msg string, kv ...any) {
+	l.Log(LogLevelWarn, msg, kv...)
+}
+
+func (l *Logger) Error(msg string, kv ...any) {
+	l.Log(LogLevelError, msg, kv...)
+}
+
+func (l *Logger) Log(level LogLevel, msg string, kv ...any) {
+	if !l.Enabled(level) {
+		return
+	}
+	fields := make([]any, 0, 6+len(l.fields)+len(kv))
+	fields = append(fields, "time", time.Now(), "level", level.String(), "msg", msg)
+	fields = append(fields, l.fields...)
+	fields = append(fields, kv...)
+	if len(fields)%2 != 0 {
+		fields = append(fields, "(MISSING)")
+	}
+
+	b := strings.Builder{}
+	if l.format == LogFormatJson {
+		writeJsonRecord(&b, fields)
+	} else {
+		writeLogfmtRecord(&b, fields)
+	}
+	b.WriteByte('\n')
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, _ = io.WriteString(l.out, b.String())
+}
+
+func writeLogfmtRecord(b *strings.Builder, fields []any) {
+	for i := 0; i < len(fields); i += 2 {
+		if i > 0 {
+			b.WriteByte(' ')
+		}
+		b.WriteString(fmt.Sprint(fields[i]))
+		b.WriteByte('=')
+		s := logValueString(fields[i+1])
+		if s == "" || strings.ContainsAny(s, " =\"\t\r\n\\") {
+			s = strconv.Quote(s)
+		}
+		b.WriteString(s)
+	}
+}
+
+func writeJsonRecord(b *strings.Builder, fields []any) {
+	b.WriteByte('{')
+	for i := 0; i < len(fields); i += 2 {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		key, _ := json.Marshal(fmt.Sprint(fields[i]))
+		b.Write(key)
+		b.WriteByte(':')
+		var value []byte
+		var err error
+		switch v := fields[i+1].(type) {
+		case error, fmt.Stringer, time.Time, time.Duration:
+			value, err = json.Marshal(logValueString(v))
+		default:
+			value, err = json.Marshal(v)
+		}
+		if err != nil {
+			value, _ = json.Marshal(fmt.Sprint(fields[i+1]))
+		}
+		b.Write(value)
+	}
+	b.WriteByte('}')
+}
+
+func logValueString(v any) string {
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case time.Time:
+		return v.Format(time.RFC3339Nano)
+	case error:
+		return v.Error()
+	case fmt.Stringer:
+		return v.String()
+	}
+	return fmt.Sprint(v)
+}
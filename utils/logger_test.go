@@ -0,0 +1,75 @@
+package utils
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLogger(t *testing.T) {
+	tests := []struct {
+		name    string
+		format  LogFormat
+		level   LogLevel
+		log     func(l *Logger)
+		wantOut string
+	}{
+		{
+			name:    "logfmt",
+			format:  LogFormatLogfmt,
+			level:   LogLevelInfo,
+			log:     func(l *Logger) { l.Info("hello world", "n", 5, "s", "a b", "e", "") },
+			wantOut: `level=info msg="hello world" n=5 s="a b" e=""`,
+		},
+		{
+			name:    "logfmt with fields",
+			format:  LogFormatLogfmt,
+			level:   LogLevelInfo,
+			log:     func(l *Logger) { l.With("requestId", "r1").Warn("oops", "err", errors.New("bad")) },
+			wantOut: `level=warn msg=oops requestId=r1 err=bad`,
+		},
+		{
+			name:    "json",
+			format:  LogFormatJson,
+			level:   LogLevelDebug,
+			log:     func(l *Logger) { l.Debug("hi", "n", 5, "ok", true, "err", errors.New("bad")) },
+			wantOut: `"level":"debug","msg":"hi","n":5,"ok":true,"err":"bad"}`,
+		},
+		{
+			name:    "missing value",
+			format:  LogFormatLogfmt,
+			level:   LogLevelInfo,
+			log:     func(l *Logger) { l.Error("odd", "key") },
+			wantOut: `level=error msg=odd key=(MISSING)`,
+		},
+		{
+			name:    "filtered by level",
+			format:  LogFormatLogfmt,
+			level:   LogLevelWarn,
+			log:     func(l *Logger) { l.Info("skipped") },
+			wantOut: ``,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out := &strings.Builder{}
+			tt.log(NewLogger(out, tt.format, tt.level))
+			if tt.wantOut == "" {
+				assert.Empty(t, out.String())
+				return
+			}
+			assert.True(t, strings.HasSuffix(out.String(), tt.wantOut+"\n"), out.String())
+		})
+	}
+}
+
+func TestParseLogLevel(t *testing.T) {
+	level, err := ParseLogLevel("WARN")
+	assert.NoError(t, err)
+	assert.Equal(t, LogLevelWarn, level)
+
+	_, err = ParseLogLevel("verbose")
+	assert.Error(t, err)
+}
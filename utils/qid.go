@@ -4,6 +4,7 @@ import (
 	"math/rand"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -17,6 +18,7 @@ var (
 		"abcdefghijklmnopqrstuvwxyz")
 	qidRandomByteLen = len(qidRandomBytes)
 	qidRandom        = rand.NewSource(time.Now().UnixNano())
+	qidRandomMu      sync.Mutex // rand.Source is not safe for concurrent use
 )
 
 func GenerateQid(len int) string {
@@ -32,6 +34,8 @@ func GenerateQid(len int) string {
 	if err != nil {
 		panic(err)
 	}
+	qidRandomMu.Lock()
+	defer qidRandomMu.Unlock()
 	for i < len {
 		err = res.WriteByte(qidRandomBytes[qidRandom.Int63()%int64(qidRandomByteLen)])
 		if err != nil {
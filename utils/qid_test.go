@@ -0,0 +1,29 @@
+package utils
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGenerateQidConcurrent(t *testing.T) {
+	const n = 100
+	qids := make([]string, n)
+	wg := sync.WaitGroup{}
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			qids[i] = GenerateQid(16)
+		}(i)
+	}
+	wg.Wait()
+
+	seen := map[string]bool{}
+	for _, qid := range qids {
+		assert.Len(t, qid, 16)
+		assert.False(t, seen[qid], "duplicate qid %s", qid)
+		seen[qid] = true
+	}
+}
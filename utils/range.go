@@ -32,6 +32,22 @@ func (r Range) HttpHeader(size int64) string {
 	)
 }
 
+// HttpRangeHeader formats the range as a value for Range request header,
+// reverse to ParseHttpRangeHeader.
+func (r Range) HttpRangeHeader() string {
+	if r.To < 0 {
+		return fmt.Sprintf("bytes=-%d", -r.To)
+	}
+	if r.To == 0 {
+		return fmt.Sprintf("bytes=%d-", r.From)
+	}
+	return fmt.Sprintf(
+		"bytes=%d-%d",
+		r.From,
+		r.To-1, // exclusive to inclusive
+	)
+}
+
 func (r *Range) Normalize(size int64) (err error) {
 	if 0 <= r.From && 0 <= r.To && r.From < r.To && r.To <= size {
 		// range already normalized
@@ -162,3 +162,28 @@ func TestRange(t *testing.T) {
 		})
 	}
 }
+
+func TestRangeHttpRangeHeader(t *testing.T) {
+	tests := []struct {
+		name string
+		rng  Range
+		want string
+	}{
+		{name: "bounded", rng: Range{3, 9}, want: "bytes=3-8"},
+		{name: "single byte", rng: Range{0, 1}, want: "bytes=0-0"},
+		{name: "open end", rng: Range{5, 0}, want: "bytes=5-"},
+		{name: "suffix", rng: Range{0, -4}, want: "bytes=-4"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := tt.rng.HttpRangeHeader()
+			assert.Equal(t, tt.want, got)
+
+			// reverse to ParseHttpRangeHeader
+			parsed, err := ParseHttpRangeHeader(got)
+			if assert.NoError(t, err) {
+				assert.Equal(t, tt.rng, *parsed)
+			}
+		})
+	}
+}